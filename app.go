@@ -6,6 +6,7 @@ import (
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"html"
 	"io"
 	"math/rand"
 	"net"
@@ -76,6 +77,7 @@ type result struct {
 	Message  string            `json:"message"`
 	Reload   bool              `json:"reload"`
 	Register bool              `json:"register"`
+	Redirect string            `json:"redirect,omitempty"`
 	Data     map[string]string `json:"data,omitempty"`
 }
 
@@ -85,6 +87,7 @@ type uiconfig struct {
 	OperationMode string `json:"operation_mode"`
 	CaptchaMode   string `json:"captcha_mode"`
 	DurationSecs  int    `json:"duration_secs"`
+	Password      bool   `json:"require_password"`
 }
 
 type gzipResponseWriter struct {
@@ -98,7 +101,7 @@ func (w gzipResponseWriter) Write(b []byte) (int, error) {
 
 func (m *MiddlewareApp) IsAppRequest(r *http.Request) bool {
 	if m.authHost == r.Host {
-		return r.URL.Query().Get(dmrequest) != ""
+		return r.URL.Query().Get(dmrequest) != "" || isDeviceRequest(r)
 	}
 	return false
 }
@@ -145,6 +148,34 @@ func (m *MiddlewareApp) ServeApp(w http.ResponseWriter, r *http.Request, clip st
 	case "/uisettings":
 		m.uisettings(w, r)
 		return
+	case "/device/start":
+		m.deviceStart(w, r)
+		return
+	case "/device/poll":
+		m.devicePoll(w, r)
+		return
+	case "/device/verify":
+		appFunc(m.logger, w, r, m.verifyDevice)
+		return
+	case "/admin/grants":
+		m.listGrants(w, r)
+		return
+	case "/admin/usercache/invalidate":
+		appFunc(m.logger, w, r, m.invalidateUserCache)
+		return
+	}
+	if m.PersonalTokens != nil {
+		switch pt {
+		case "/tokens/list":
+			m.listPersonalTokens(w, r)
+			return
+		case "/tokens/create":
+			appFunc(m.logger, w, r, m.createPersonalToken)
+			return
+		case "/tokens/revoke":
+			appFunc(m.logger, w, r, m.revokePersonalToken)
+			return
+		}
 	}
 	_, err := m.assetsDir.Open(r.URL.Path)
 	if err != nil {
@@ -164,12 +195,14 @@ func (m *MiddlewareApp) ServeApp(w http.ResponseWriter, r *http.Request, clip st
 }
 
 func (m *MiddlewareApp) uisettings(w http.ResponseWriter, r *http.Request) {
+	pol := m.policyOf(r)
 	ucfg := uiconfig{
 		Imprint:       m.ImprintURL,
 		PrivacyPolicy: m.PrivacyPolicyURL,
-		OperationMode: string(m.OperationMode),
-		CaptchaMode:   string(m.CaptchaMode),
+		OperationMode: string(pol.mode),
+		CaptchaMode:   string(pol.captcha),
 		DurationSecs:  int(time.Duration(m.TokenDuration) / time.Second),
+		Password:      pol.password,
 	}
 	w.Header().Add("content-type", "application/json")
 	if err := json.NewEncoder(w).Encode(ucfg); err != nil {
@@ -178,7 +211,7 @@ func (m *MiddlewareApp) uisettings(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (m *MiddlewareApp) sendToken(ue *UserEntry, w http.ResponseWriter, r *http.Request) (int64, string, int) {
+func (m *MiddlewareApp) sendToken(pol *policy, ue *UserEntry, login cookieData, w http.ResponseWriter, r *http.Request) (int64, string, int) {
 	msg := ""
 	rc := http.StatusOK
 	created := m.clock.Now().UTC().Unix()
@@ -186,14 +219,11 @@ func (m *MiddlewareApp) sendToken(ue *UserEntry, w http.ResponseWriter, r *http.
 	if err != nil {
 		// only create/send a token when we dont have one pending
 		token := randToken(6)
-		m.secCookie.set(w, cookieData{
-			uidField:   ue.UID,
-			mailField:  ue.EMail,
-			tokenField: token,
-		})
+		login[tokenField] = token
+		m.secCookie.set(w, login)
 		// DANGER: logging the token should only be done in DEBUG mode!
 		m.logger.Debug("send token", zap.String("token", token), zap.String(uidField, ue.UID))
-		if err := m.sendMessage(ue, "Your login token", spacedToken(m.Spacing, token), "Your token: "+token); err != nil {
+		if err := m.sendMessage(pol.channels, ue, "Your login token", spacedToken(m.Spacing, token), "Your token: "+token); err != nil {
 			msg = fmt.Sprintf("Cannot send message: %s", err.Error())
 			rc = http.StatusInternalServerError
 		} else {
@@ -206,14 +236,11 @@ func (m *MiddlewareApp) sendToken(ue *UserEntry, w http.ResponseWriter, r *http.
 	return created, msg, rc
 }
 
-func (m *MiddlewareApp) sendYesNoLink(ue *UserEntry, w http.ResponseWriter, r *http.Request) (string, string, int) {
+func (m *MiddlewareApp) sendYesNoLink(pol *policy, ue *UserEntry, login cookieData, w http.ResponseWriter, r *http.Request) (string, string, int) {
 	msg := ""
 	rc := http.StatusOK
 	key := randomKey(8)
-	m.secCookie.set(w, cookieData{
-		uidField:  ue.UID,
-		mailField: ue.EMail,
-	})
+	m.secCookie.set(w, login)
 	// DANGER: logging the token should only be done in DEBUG mode!
 	m.logger.Debug("send yesno link", zap.String("key", key), zap.String(uidField, ue.UID))
 	link := fmt.Sprintf("%s/allow?t=%s&%s=1", m.IssuerBase, url.QueryEscape(key), dmrequest)
@@ -229,7 +256,7 @@ func (m *MiddlewareApp) sendYesNoLink(ue *UserEntry, w http.ResponseWriter, r *h
 		msg = fmt.Sprintf("Cannot render mail template: %s", err.Error())
 		rc = http.StatusInternalServerError
 	} else {
-		if err := m.sendMessage(ue, "Your login request", "Signin: "+link, buf.String()); err != nil {
+		if err := m.sendMessage(pol.channels, ue, "Your login request", "Signin: "+link, buf.String()); err != nil {
 			msg = fmt.Sprintf("Cannot send message: %s", err.Error())
 			rc = http.StatusInternalServerError
 		}
@@ -326,7 +353,10 @@ func (m *MiddlewareApp) allowSignin(w http.ResponseWriter, r *http.Request) {
 			fmt.Fprintln(w, noSigninRequestHTML)
 			return
 		}
-		fmt.Fprintf(w, signinRequestHTML, u, ip, url.QueryEscape(tok))
+		if loc := m.locate(ip).String(); loc != "" {
+			ip = fmt.Sprintf("%s (%s)", ip, loc)
+		}
+		fmt.Fprintf(w, signinRequestHTML, html.EscapeString(u), html.EscapeString(ip), url.QueryEscape(tok))
 		return
 	}
 	y := yesno(allow)
@@ -344,11 +374,21 @@ func (m *MiddlewareApp) waitFor(w http.ResponseWriter, r *http.Request) (rs resu
 		return
 	}
 	key := r.FormValue(tokenField)
+	pol := m.policyOf(r)
+	if !pol.mode.isLink() {
+		rs.Message = "Operation mode not allowed"
+		rc = http.StatusForbidden
+		return
+	}
 	data, err := m.secCookie.get(r)
 	if err != nil {
 		m.logger.Error("cannot parse cookie", zap.Error(err))
 		rc = http.StatusInternalServerError
 		rs.Message = "Internal Error"
+		return
+	}
+	if rs.Message, rc = m.checkLogin(data, pol); rc != 0 {
+		return
 	}
 	uid, ok := data[uidField].(string)
 	if !ok {
@@ -369,17 +409,17 @@ func (m *MiddlewareApp) waitFor(w http.ResponseWriter, r *http.Request) (rs resu
 	} else {
 		m.logger.Info("waiting returned answer", zap.String("answer", string(*yn)))
 		if yn.Yes() {
-			m.allowUserIP(m.Issuer, uid, ip)
+			rc = m.grantAccess(w, r, uid, ip, &rs)
 		}
 	}
 	rs.Reload = true
 	return
 }
 
-func (m *MiddlewareApp) createCaptchaRaw() (string, string, error) {
+func (m *MiddlewareApp) createCaptchaRaw(mode captchaMode) (string, string, error) {
 	var capdata *captcha.Data
 	var err error
-	switch m.CaptchaMode {
+	switch mode {
 	case captchaFull:
 		capdata, err = captcha.New(250, 50)
 	case captchaMath:
@@ -400,7 +440,7 @@ func (m *MiddlewareApp) createCaptchaRaw() (string, string, error) {
 }
 
 func (m *MiddlewareApp) createCaptcha(w http.ResponseWriter, r *http.Request) (rs result, rc int) {
-	capval, captext, err := m.createCaptchaRaw()
+	capval, captext, err := m.createCaptchaRaw(m.policyOf(r).captcha)
 
 	if err != nil {
 		m.logger.Error("captcha creation error", zap.Error(err))
@@ -418,15 +458,23 @@ func (m *MiddlewareApp) createCaptcha(w http.ResponseWriter, r *http.Request) (r
 }
 
 func (m *MiddlewareApp) sendUser(w http.ResponseWriter, r *http.Request) (rs result, rc int) {
+	if clip := findClientIP(r); m.isBlocked(r, clip) || m.geoDenied(clip) {
+		// never send a token or a message to a blocked client
+		m.auditBlocked(r, clip)
+		rs.Message = "Access denied"
+		rc = m.BlockedResponse.status()
+		return
+	}
 	if err := r.ParseMultipartForm(1024); err != nil {
 		m.logger.Error("cannot parse form", zap.Error(err))
 		rc = http.StatusInternalServerError
 		return
 	}
 
+	pol := m.policyOf(r)
 	uid := r.FormValue(uidField)
 	cap := r.FormValue(captchaField)
-	if m.CaptchaMode != captchaNone {
+	if pol.captcha != captchaNone {
 		data, err := m.secCookie.get(r)
 		if err != nil {
 			m.logger.Debug("no values found in cookie", zap.Error(err))
@@ -443,7 +491,7 @@ func (m *MiddlewareApp) sendUser(w http.ResponseWriter, r *http.Request) (rs res
 		if cap != capdata {
 			rs.Message = "Wrong captcha data"
 			rc = http.StatusForbidden
-			capval, captext, _ := m.createCaptchaRaw()
+			capval, captext, _ := m.createCaptchaRaw(pol.captcha)
 			m.secCookie.set(w, cookieData{
 				captchaField: captext,
 			})
@@ -459,8 +507,8 @@ func (m *MiddlewareApp) sendUser(w http.ResponseWriter, r *http.Request) (rs res
 			m.logger.Error("cannot find user", zap.String("uid", uid), zap.Error(err))
 			rs.Message = "Unknown user: " + uid
 			rc = http.StatusForbidden
-			if m.CaptchaMode != captchaNone {
-				capval, captext, _ := m.createCaptchaRaw()
+			if pol.captcha != captchaNone {
+				capval, captext, _ := m.createCaptchaRaw(pol.captcha)
 				m.secCookie.set(w, cookieData{
 					captchaField: captext,
 				})
@@ -470,19 +518,32 @@ func (m *MiddlewareApp) sendUser(w http.ResponseWriter, r *http.Request) (rs res
 			}
 			return
 		} else {
-			m.secCookie.set(w, cookieData{
-				uidField:  ue.UID,
-				mailField: ue.EMail,
-			})
+			if !pol.allows(ue) {
+				m.audit("user not allowed by policy", zap.String("uid", ue.UID), zap.String("policy", pol.name), zap.String("clientip", findClientIP(r)))
+				rs.Message = "Access denied"
+				rc = http.StatusForbidden
+				return
+			}
+			// the second factor is only started with the correct password
+			login := loginCookie(pol, ue)
+			if pol.password {
+				if rs.Message, rc = m.checkPassword(r, ue); rc != 0 {
+					return
+				}
+				login[passwordVerifiedField] = m.clock.Now().Unix()
+			}
+			m.secCookie.set(w, login)
 			clip := findClientIP(r)
-			if ipallowed := m.store.isIPAllowed(m.logger, clip); ipallowed {
+			// a device authorization always needs the user to authorize
+			if ipallowed := m.store.isIPAllowed(m.logger, clip, pol.name); ipallowed && r.FormValue(userCodeField) == "" {
 				rs.Reload = true
 				rs.Message = "please reload"
+				m.setReturnTo(r, &rs)
 				return
 			}
 
-			if m.OperationMode.isToken() {
-				c, msg, rtc := m.sendToken(ue, w, r)
+			if pol.mode.isToken() {
+				c, msg, rtc := m.sendToken(pol, ue, login, w, r)
 				m.logger.Info("sent token", zap.Int64("created", c), zap.Int("rc", rtc))
 				if rtc/100 == 2 {
 					rs.Data = map[string]string{
@@ -492,7 +553,7 @@ func (m *MiddlewareApp) sendUser(w http.ResponseWriter, r *http.Request) (rs res
 				rs.Message, rc = msg, rtc
 				return
 			}
-			if m.OperationMode.isOTP() {
+			if pol.mode.isOTP() {
 				has, err := m.store.tokensrv.hasUser(m.logger, m.Issuer, ue.UID)
 				m.logger.Info("otp hasuser", zap.Bool("has", has), zap.Error(err))
 				if err != nil {
@@ -503,9 +564,9 @@ func (m *MiddlewareApp) sendUser(w http.ResponseWriter, r *http.Request) (rs res
 				rs.Register = !has
 				return
 			}
-			if m.OperationMode.isLink() {
+			if pol.mode.isLink() {
 				var key string
-				key, rs.Message, rc = m.sendYesNoLink(ue, w, r)
+				key, rs.Message, rc = m.sendYesNoLink(pol, ue, login, w, r)
 				m.logger.Info("sent yesnolink", zap.String("key", key), zap.Int("rc", rc))
 				if rc/100 == 2 {
 					rs.Data = map[string]string{"key": key}
@@ -526,6 +587,12 @@ func (m *MiddlewareApp) checkOTP(w http.ResponseWriter, r *http.Request) (rs res
 		rc = http.StatusInternalServerError
 		return
 	}
+	pol := m.policyOf(r)
+	if !pol.mode.isOTP() {
+		rs.Message = "Operation mode not allowed"
+		rc = http.StatusForbidden
+		return
+	}
 	data, err := m.secCookie.get(r)
 	formtoken := r.FormValue(tokenField)
 	if err == nil {
@@ -535,6 +602,9 @@ func (m *MiddlewareApp) checkOTP(w http.ResponseWriter, r *http.Request) (rs res
 			rc = http.StatusForbidden
 			return
 		}
+		if rs.Message, rc = m.checkLogin(data, pol); rc != 0 {
+			return
+		}
 		ok, err := m.store.tokensrv.validateUser(m.logger, m.Issuer, uid.(string), formtoken)
 		if err != nil {
 			m.logger.Error("cannot validate user", zap.Error(err))
@@ -547,7 +617,7 @@ func (m *MiddlewareApp) checkOTP(w http.ResponseWriter, r *http.Request) (rs res
 			rc = http.StatusForbidden
 			return
 		}
-		m.allowUserIP(m.Issuer, uid.(string), findClientIP(r))
+		rc = m.grantAccess(w, r, uid.(string), findClientIP(r), &rs)
 	} else {
 		m.logger.Debug("no values found in cookie", zap.Error(err))
 		rs.Message = "No values found"
@@ -561,6 +631,12 @@ func (m *MiddlewareApp) checkToken(w http.ResponseWriter, r *http.Request) (rs r
 		rc = http.StatusInternalServerError
 		return
 	}
+	pol := m.policyOf(r)
+	if !pol.mode.isToken() {
+		rs.Message = "Operation mode not allowed"
+		rc = http.StatusForbidden
+		return
+	}
 	data, err := m.secCookie.get(r)
 	formtoken := r.FormValue(tokenField)
 	if err == nil {
@@ -571,6 +647,9 @@ func (m *MiddlewareApp) checkToken(w http.ResponseWriter, r *http.Request) (rs r
 			rc = http.StatusForbidden
 			return
 		}
+		if rs.Message, rc = m.checkLogin(data, pol); rc != 0 {
+			return
+		}
 		token, ok := data[tokenField]
 		if !ok {
 			rs.Message = "No stored token found"
@@ -583,11 +662,8 @@ func (m *MiddlewareApp) checkToken(w http.ResponseWriter, r *http.Request) (rs r
 			rc = http.StatusForbidden
 			return
 		}
-		m.secCookie.set(w, cookieData{
-			uidField: uid,
-		})
 		m.logger.Info("allow user", zap.String(uidField, uid.(string)))
-		m.allowUserIP(m.Issuer, uid.(string), findClientIP(r))
+		rc = m.grantAccess(w, r, uid.(string), findClientIP(r), &rs)
 	} else {
 		m.logger.Debug("no values found in cookie", zap.Error(err))
 		rs.Message = "No values found"
@@ -595,6 +671,61 @@ func (m *MiddlewareApp) checkToken(w http.ResponseWriter, r *http.Request) (rs r
 	return
 }
 
+// grantAccess is called when the user passed the operation mode of the
+// policy. It allows the client IP or, when the user authorizes a device, the
+// IP of the device.
+func (m *MiddlewareApp) grantAccess(w http.ResponseWriter, r *http.Request, uid, clip string, rs *result) int {
+	pol := m.policyOf(r)
+	data, err := m.secCookie.get(r)
+	if err != nil {
+		rs.Message = "No values found"
+		return http.StatusForbidden
+	}
+	var rc int
+	if rs.Message, rc = m.checkLogin(data, pol); rc != 0 {
+		return rc
+	}
+	if uc := r.FormValue(userCodeField); uc != "" {
+		// remove a used token from the cookie, but do not mark this browser
+		// as authorized
+		m.secCookie.set(w, cookieData{
+			uidField: uid,
+		})
+		if err := m.approveDevice(pol, uid, uc); err != nil {
+			m.logger.Error("cannot approve device", zap.String("uid", uid), zap.Error(err))
+			rs.Message = "Cannot authorize device"
+			return http.StatusForbidden
+		}
+		m.store.tokensrv.removeTempToken(m.logger, m.Issuer, uid)
+		rs.Message = "Device authorized"
+		return http.StatusOK
+	}
+	if m.geoDenied(clip) {
+		m.auditBlocked(r, clip)
+		rs.Message = "Access denied"
+		return m.BlockedResponse.status()
+	}
+	ue, err := m.userOf(uid)
+	if err != nil {
+		m.logger.Error("cannot find user", zap.String("uid", uid), zap.Error(err))
+		rs.Message = "Cannot find user"
+		return http.StatusForbidden
+	}
+	if !pol.allows(ue) {
+		m.audit("user not allowed by policy", zap.String("uid", uid), zap.String("policy", pol.name), zap.String("clientip", clip))
+		rs.Message = "Access denied"
+		return http.StatusForbidden
+	}
+	m.allowUserIP(pol, ue, clip)
+	m.secCookie.set(w, cookieData{
+		uidField:        uid,
+		policyField:     pol.name,
+		authorizedField: m.clock.Now().UTC().Unix(),
+	})
+	m.setReturnTo(r, rs)
+	return http.StatusOK
+}
+
 func findClientIP(r *http.Request) string {
 	for _, h := range headersForClient {
 		v := r.Header.Get(h)
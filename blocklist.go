@@ -0,0 +1,80 @@
+package doorman
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultBlockedDetail = "access from this address is not allowed"
+)
+
+// BlockedResponse is the answer for blocked clients. Without a Body a
+// browser gets a short text and other clients a problem document.
+type BlockedResponse struct {
+	Status      int    `json:"status,omitempty"`
+	Body        string `json:"body,omitempty"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+func (br BlockedResponse) status() int {
+	if br.Status == 0 {
+		return http.StatusForbidden
+	}
+	return br.Status
+}
+
+// isBlocked returns true if the client matches the blocklist. A blocked
+// client is never admitted, neither by a whitelist nor by a grant.
+func (m *MiddlewareApp) isBlocked(r *http.Request, clip string) bool {
+	if m.blocklister == nil {
+		return false
+	}
+	if m.blocklister.isAllowed(m.logger, clip) {
+		return true
+	}
+	_, blocked := m.blocklister.allowRequest(m.logger, r)
+	return blocked
+}
+
+func (m *MiddlewareApp) auditBlocked(r *http.Request, clip string) {
+	m.audit("blocked request",
+		zap.String("clientip", clip),
+		zap.String("host", r.Host),
+		zap.String("url", r.URL.RequestURI()),
+		zap.String("useragent", r.UserAgent()),
+	)
+}
+
+func (m *MiddlewareApp) serveBlocked(w http.ResponseWriter, r *http.Request, clip string) {
+	m.auditBlocked(r, clip)
+	br := m.BlockedResponse
+	status := br.status()
+	switch {
+	case br.Body != "":
+		ct := br.ContentType
+		if ct == "" {
+			ct = "text/plain; charset=utf-8"
+		}
+		w.Header().Set("Content-Type", ct)
+		w.WriteHeader(status)
+		_, _ = w.Write([]byte(br.Body))
+	case isBrowserRequest(r):
+		http.Error(w, http.StatusText(status), status)
+	default:
+		w.Header().Set("Content-Type", problemContentType)
+		w.WriteHeader(status)
+		pb := problem{
+			Type:     "about:blank",
+			Title:    http.StatusText(status),
+			Status:   status,
+			Detail:   defaultBlockedDetail,
+			Instance: r.URL.RequestURI(),
+		}
+		if err := json.NewEncoder(w).Encode(pb); err != nil {
+			m.logger.Error("cannot write problem to stream", zap.Error(err))
+		}
+	}
+}
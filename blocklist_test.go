@@ -0,0 +1,103 @@
+package doorman
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newBlockingApp(t *testing.T, blocked ...string) *MiddlewareApp {
+	m, _ := newDeviceApp(t)
+	wl := newWhitelister()
+	if err := wl.add(zap.NewNop(), "office", &staticWhiteList{"10.0.0.0/8"}); err != nil {
+		t.Fatal(err)
+	}
+	bl := newWhitelister()
+	sw := staticWhiteList(blocked)
+	if err := bl.add(zap.NewNop(), "tor", &sw); err != nil {
+		t.Fatal(err)
+	}
+	m.whitelister = wl
+	m.blocklister = bl
+	m.store.whs = wl
+	m.store.bls = bl
+	return m
+}
+
+func Test_persistentStore_isAllowed_blocked(t *testing.T) {
+	m := newBlockingApp(t, "10.6.6.6", "192.0.2.0/24")
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "ddk", "192.0.2.10", time.Hour)
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "ddk", "198.51.100.1", time.Hour)
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "10.1.1.1", want: true},
+		{ip: "10.6.6.6", want: false},
+		{ip: "198.51.100.1", want: true},
+		{ip: "192.0.2.10", want: false},
+		{ip: "203.0.113.1", want: false},
+	}
+	for _, tt := range tests {
+		if got := m.store.isAllowed(tt.ip, ""); got != tt.want {
+			t.Errorf("isAllowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+func Test_serveBlocked(t *testing.T) {
+	tests := []struct {
+		name       string
+		response   BlockedResponse
+		accept     string
+		wantStatus int
+		wantType   string
+		wantBody   string
+	}{
+		{name: "browser", accept: "text/html", wantStatus: http.StatusForbidden, wantType: "text/plain", wantBody: "Forbidden"},
+		{name: "api client", accept: "application/json", wantStatus: http.StatusForbidden, wantType: problemContentType, wantBody: defaultBlockedDetail},
+		{
+			name:       "configured",
+			response:   BlockedResponse{Status: http.StatusUnavailableForLegalReasons, Body: "<h1>no</h1>", ContentType: "text/html"},
+			accept:     "text/html",
+			wantStatus: http.StatusUnavailableForLegalReasons,
+			wantType:   "text/html",
+			wantBody:   "<h1>no</h1>",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newBlockingApp(t, "10.6.6.6")
+			m.BlockedResponse = tt.response
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodGet, "https://wiki.example.com/", nil)
+			r.Header.Set("Accept", tt.accept)
+			m.serveBlocked(w, r, "10.6.6.6")
+			if w.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if ct := w.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantType) {
+				t.Errorf("content type = %q, want %q", ct, tt.wantType)
+			}
+			if !strings.Contains(w.Body.String(), tt.wantBody) {
+				t.Errorf("body = %q, want %q", w.Body.String(), tt.wantBody)
+			}
+		})
+	}
+}
+
+func Test_sendUser_blocked(t *testing.T) {
+	m := newBlockingApp(t, "10.6.6.6")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "https://auth.example.com/sendUser", strings.NewReader("uid=ddk"))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.RemoteAddr = "10.6.6.6:4711"
+	if _, rc := m.sendUser(w, r); rc != http.StatusForbidden {
+		t.Errorf("sendUser() = %d, want %d", rc, http.StatusForbidden)
+	}
+}
@@ -0,0 +1,142 @@
+package doorman
+
+import (
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+var (
+	_ requestWhitelist = (*clientCertWhitelist)(nil)
+
+	valueWhiteListMTLS = "mtls"
+)
+
+// requestWhitelist admits a request by other properties than the client IP;
+// it returns the identity of the admitted client.
+type requestWhitelist interface {
+	AllowRequest(log *zap.Logger, r *http.Request) (string, bool)
+}
+
+type clientCertConfig struct {
+	CAFile   string   `json:"ca_file,omitempty"`
+	CA       string   `json:"ca,omitempty"`
+	Subjects []string `json:"subjects,omitempty"`
+	SANs     []string `json:"sans,omitempty"`
+}
+
+// clientCertWhitelist admits requests with a client certificate which is
+// issued by a configured CA and whose subject or SAN matches a pattern.
+type clientCertWhitelist struct {
+	roots    *x509.CertPool
+	subjects []*regexp.Regexp
+	sans     []*regexp.Regexp
+}
+
+// globPattern compiles a pattern where '*' matches any sequence of
+// characters.
+func globPattern(p string) (*regexp.Regexp, error) {
+	q := strings.ReplaceAll(regexp.QuoteMeta(p), `\*`, ".*")
+	return regexp.Compile("^(?i:" + q + ")$")
+}
+
+func globPatterns(ps []string) ([]*regexp.Regexp, error) {
+	var res []*regexp.Regexp
+	for _, p := range ps {
+		rx, err := globPattern(p)
+		if err != nil {
+			return nil, fmt.Errorf("illegal pattern %q: %w", p, err)
+		}
+		res = append(res, rx)
+	}
+	return res, nil
+}
+
+func newClientCertWhitelist(cfg clientCertConfig) (*clientCertWhitelist, error) {
+	pem := []byte(cfg.CA)
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ca bundle: %w", err)
+		}
+		pem = append(pem, data...)
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in ca bundle")
+	}
+	if len(cfg.Subjects) == 0 && len(cfg.SANs) == 0 {
+		return nil, fmt.Errorf("at least one pattern for subjects or sans is needed")
+	}
+	subjects, err := globPatterns(cfg.Subjects)
+	if err != nil {
+		return nil, err
+	}
+	sans, err := globPatterns(cfg.SANs)
+	if err != nil {
+		return nil, err
+	}
+	return &clientCertWhitelist{roots: roots, subjects: subjects, sans: sans}, nil
+}
+
+func matchAny(rxs []*regexp.Regexp, vals ...string) (string, bool) {
+	for _, v := range vals {
+		if v == "" {
+			continue
+		}
+		for _, rx := range rxs {
+			if rx.MatchString(v) {
+				return v, true
+			}
+		}
+	}
+	return "", false
+}
+
+func certSANs(c *x509.Certificate) []string {
+	res := append([]string{}, c.DNSNames...)
+	res = append(res, c.EmailAddresses...)
+	for _, u := range c.URIs {
+		res = append(res, u.String())
+	}
+	for _, ip := range c.IPAddresses {
+		res = append(res, ip.String())
+	}
+	return res
+}
+
+func (cc *clientCertWhitelist) AllowRequest(log *zap.Logger, r *http.Request) (string, bool) {
+	if r.TLS == nil || len(r.TLS.PeerCertificates) == 0 {
+		return "", false
+	}
+	leaf := r.TLS.PeerCertificates[0]
+	inter := x509.NewCertPool()
+	for _, c := range r.TLS.PeerCertificates[1:] {
+		inter.AddCert(c)
+	}
+	if _, err := leaf.Verify(x509.VerifyOptions{
+		Roots:         cc.roots,
+		Intermediates: inter,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}); err != nil {
+		log.Debug("client certificate not verified", zap.String("subject", leaf.Subject.String()), zap.Error(err))
+		return "", false
+	}
+	if _, ok := matchAny(cc.subjects, leaf.Subject.CommonName, leaf.Subject.String()); ok {
+		log.Debug("client certificate is whitelisted", zap.String("subject", leaf.Subject.String()))
+		if leaf.Subject.CommonName != "" {
+			return leaf.Subject.CommonName, true
+		}
+		return leaf.Subject.String(), true
+	}
+	if san, ok := matchAny(cc.sans, certSANs(leaf)...); ok {
+		log.Debug("client certificate is whitelisted", zap.String("san", san))
+		return san, true
+	}
+	return "", false
+}
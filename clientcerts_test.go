@@ -0,0 +1,144 @@
+package doorman
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func createTestCert(t *testing.T, tmpl *x509.Certificate, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl.SerialNumber = big.NewInt(time.Now().UnixNano())
+	tmpl.NotBefore = time.Now().Add(-time.Hour)
+	tmpl.NotAfter = time.Now().Add(time.Hour)
+	signer, signerKey := tmpl, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: c, key: key}
+}
+
+func createTestCA(t *testing.T, cn string) *testCert {
+	return createTestCert(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: cn},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+}
+
+func createClientCert(t *testing.T, ca *testCert, cn string, dns ...string) *testCert {
+	return createTestCert(t, &x509.Certificate{
+		Subject:     pkix.Name{CommonName: cn, Organization: []string{"Corp"}},
+		DNSNames:    dns,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, ca)
+}
+
+func Test_clientCertWhitelist_AllowRequest(t *testing.T) {
+	ca := createTestCA(t, "internal ca")
+	other := createTestCA(t, "other ca")
+	capem := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+
+	tests := []struct {
+		name     string
+		subjects []string
+		sans     []string
+		cert     *testCert
+		wantID   string
+		wantOK   bool
+	}{
+		{
+			name:     "subject matches",
+			subjects: []string{"svc-*"},
+			cert:     createClientCert(t, ca, "svc-backup"),
+			wantID:   "svc-backup",
+			wantOK:   true,
+		},
+		{
+			name:     "full subject matches",
+			subjects: []string{"CN=svc-*,O=Corp"},
+			cert:     createClientCert(t, ca, "svc-backup"),
+			wantID:   "svc-backup",
+			wantOK:   true,
+		},
+		{
+			name:   "san matches",
+			sans:   []string{"*.internal.example.com"},
+			cert:   createClientCert(t, ca, "something", "build.internal.example.com"),
+			wantID: "build.internal.example.com",
+			wantOK: true,
+		},
+		{
+			name:     "no pattern matches",
+			subjects: []string{"svc-*"},
+			sans:     []string{"*.internal.example.com"},
+			cert:     createClientCert(t, ca, "user", "www.example.com"),
+		},
+		{
+			name:     "other ca",
+			subjects: []string{"svc-*"},
+			cert:     createClientCert(t, other, "svc-backup"),
+		},
+		{
+			name:     "no certificate",
+			subjects: []string{"*"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cc, err := newClientCertWhitelist(clientCertConfig{CA: capem, Subjects: tt.subjects, SANs: tt.sans})
+			if err != nil {
+				t.Fatal(err)
+			}
+			r := httptest.NewRequest(http.MethodGet, "https://wiki.example.com/", nil)
+			r.TLS = &tls.ConnectionState{}
+			if tt.cert != nil {
+				r.TLS.PeerCertificates = []*x509.Certificate{tt.cert.cert}
+			}
+			id, ok := cc.AllowRequest(zap.NewNop(), r)
+			if id != tt.wantID || ok != tt.wantOK {
+				t.Errorf("AllowRequest() = %q, %v, want %q, %v", id, ok, tt.wantID, tt.wantOK)
+			}
+		})
+	}
+}
+
+func Test_newClientCertWhitelist_needsPattern(t *testing.T) {
+	ca := createTestCA(t, "internal ca")
+	capem := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	if _, err := newClientCertWhitelist(clientCertConfig{CA: capem}); err == nil {
+		t.Errorf("a whitelist without patterns must not be created")
+	}
+	if _, err := newClientCertWhitelist(clientCertConfig{Subjects: []string{"*"}}); err == nil {
+		t.Errorf("a whitelist without ca must not be created")
+	}
+}
@@ -59,3 +59,15 @@ func (ch *cookieHandler) get(r *http.Request) (cookieData, error) {
 	}
 	return nil, fmt.Errorf("no cookie found")
 }
+
+func (ch *cookieHandler) sign(name, value string) (string, error) {
+	return ch.c.Encode(name, value)
+}
+
+func (ch *cookieHandler) verify(name, signed string) (string, error) {
+	var value string
+	if err := ch.c.Decode(name, signed, &value); err != nil {
+		return "", fmt.Errorf("value cannot be decoded: %w", err)
+	}
+	return value, nil
+}
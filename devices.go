@@ -0,0 +1,266 @@
+package doorman
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	deviceCodeField = "device_code"
+	userCodeField   = "user_code"
+
+	toplevelDevice     = "device:"
+	toplevelDeviceUser = "deviceuser:"
+	toplevelDeviceOK   = "deviceok:"
+	toplevelDevicePoll = "devicepoll:"
+
+	defaultDeviceDuration = Duration(10 * time.Minute)
+	devicePollInterval    = 5 * time.Second
+
+	// no vowels, so we do not generate words; no digits which look like letters
+	userCodeChars  = "BCDFGHJKLMNPQRSTVWXZ"
+	userCodeLength = 8
+
+	deviceErrPending  = "authorization_pending"
+	deviceErrSlowDown = "slow_down"
+	deviceErrExpired  = "expired_token"
+	deviceErrRequest  = "invalid_request"
+)
+
+// deviceAuthorization is a pending authorization request of a device which
+// cannot display the gate itself.
+type deviceAuthorization struct {
+	UserCode string             `json:"user_code"`
+	IP       string             `json:"ip"`
+	Policy   string             `json:"policy,omitempty"`
+	Groups   []storedGroupRules `json:"groups,omitempty"`
+}
+
+// deviceStart is the answer for a device which starts the authorization
+// flow. The names are the same as in RFC 8628.
+type deviceStart struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+type devicePoll struct {
+	Error     string `json:"error,omitempty"`
+	Status    string `json:"status,omitempty"`
+	IP        string `json:"ip,omitempty"`
+	ExpiresIn int    `json:"expires_in,omitempty"`
+}
+
+func newUserCode() (string, error) {
+	var sb strings.Builder
+	limit := big.NewInt(int64(len(userCodeChars)))
+	for i := 0; i < userCodeLength; i++ {
+		n, err := rand.Int(rand.Reader, limit)
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(userCodeChars[n.Int64()])
+	}
+	return sb.String(), nil
+}
+
+func newDeviceCode() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// normalizeUserCode removes the separators a user may type, so "bcdf-ghjk"
+// and "BCDFGHJK" are the same code.
+func normalizeUserCode(uc string) string {
+	uc = strings.ToUpper(uc)
+	uc = strings.ReplaceAll(uc, "-", "")
+	return strings.ReplaceAll(uc, " ", "")
+}
+
+func displayUserCode(uc string) string {
+	if len(uc) != userCodeLength {
+		return uc
+	}
+	return uc[:userCodeLength/2] + "-" + uc[userCodeLength/2:]
+}
+
+func isDeviceRequest(r *http.Request) bool {
+	return r.URL.Path == "/device/start" || r.URL.Path == "/device/poll"
+}
+
+func writeJSON(l *zap.Logger, w http.ResponseWriter, rc int, v interface{}) {
+	w.Header().Add("content-type", "application/json")
+	w.Header().Add("Cache-Control", "no-store")
+	w.WriteHeader(rc)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		l.Error("cannot write result to stream", zap.Error(err))
+	}
+}
+
+func (m *MiddlewareApp) deviceStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(m.logger, w, http.StatusMethodNotAllowed, devicePoll{Error: deviceErrRequest})
+		return
+	}
+	dc, err := newDeviceCode()
+	if err != nil {
+		m.logger.Error("cannot create device code", zap.Error(err))
+		writeJSON(m.logger, w, http.StatusInternalServerError, devicePoll{Error: deviceErrRequest})
+		return
+	}
+	uc, err := newUserCode()
+	if err != nil {
+		m.logger.Error("cannot create user code", zap.Error(err))
+		writeJSON(m.logger, w, http.StatusInternalServerError, devicePoll{Error: deviceErrRequest})
+		return
+	}
+	pol := m.policyOf(r)
+	da := deviceAuthorization{UserCode: uc, IP: findClientIP(r), Policy: pol.name, Groups: storeGroups(pol)}
+	data, err := json.Marshal(da)
+	if err != nil {
+		m.logger.Error("cannot marshal device authorization", zap.Error(err))
+		writeJSON(m.logger, w, http.StatusInternalServerError, devicePoll{Error: deviceErrRequest})
+		return
+	}
+	ttl := time.Duration(m.DeviceCodeDuration)
+	if err := m.store.kvs.PutTTL(m.logger, toplevelDevice+dc, string(data), ttl); err != nil {
+		m.logger.Error("cannot store device authorization", zap.Error(err))
+		writeJSON(m.logger, w, http.StatusInternalServerError, devicePoll{Error: deviceErrRequest})
+		return
+	}
+	if err := m.store.kvs.PutTTL(m.logger, toplevelDeviceUser+uc, dc, ttl); err != nil {
+		m.logger.Error("cannot store user code", zap.Error(err))
+		writeJSON(m.logger, w, http.StatusInternalServerError, devicePoll{Error: deviceErrRequest})
+		return
+	}
+	m.logger.Info("device authorization started", zap.String("clientip", da.IP), zap.String(userCodeField, uc))
+	base := strings.TrimSuffix(m.IssuerBase, "/")
+	params := fmt.Sprintf("%s=1", dmrequest)
+	if pol.name != "" {
+		params += fmt.Sprintf("&%s=%s", policyField, url.QueryEscape(pol.name))
+	}
+	writeJSON(m.logger, w, http.StatusOK, deviceStart{
+		DeviceCode:              dc,
+		UserCode:                displayUserCode(uc),
+		VerificationURI:         fmt.Sprintf("%s/?%s#/device", base, params),
+		VerificationURIComplete: fmt.Sprintf("%s/?%s=%s&%s", base, userCodeField, url.QueryEscape(displayUserCode(uc)), params),
+		ExpiresIn:               int(ttl / time.Second),
+		Interval:                int(devicePollInterval / time.Second),
+	})
+}
+
+func (m *MiddlewareApp) devicePoll(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	dc := r.FormValue(deviceCodeField)
+	if dc == "" {
+		writeJSON(m.logger, w, http.StatusBadRequest, devicePoll{Error: deviceErrRequest})
+		return
+	}
+	val, err := m.store.kvs.GetTTL(m.logger, toplevelDevice+dc)
+	if err != nil {
+		writeJSON(m.logger, w, http.StatusBadRequest, devicePoll{Error: deviceErrExpired})
+		return
+	}
+	var da deviceAuthorization
+	if err := json.Unmarshal([]byte(val), &da); err != nil {
+		m.logger.Error("cannot unmarshal device authorization", zap.Error(err))
+		writeJSON(m.logger, w, http.StatusBadRequest, devicePoll{Error: deviceErrExpired})
+		return
+	}
+	if uid, err := m.store.kvs.GetTTL(m.logger, toplevelDeviceOK+dc); err == nil {
+		m.logger.Info("device authorization finished", zap.String("uid", uid), zap.String("clientip", da.IP))
+		// the device code is used up
+		m.store.kvs.Del(m.logger, toplevelDevice+dc)
+		m.store.kvs.Del(m.logger, toplevelDeviceOK+dc)
+		m.store.kvs.Del(m.logger, toplevelDevicePoll+dc)
+		pol, _ := m.namedPolicy(da.Policy)
+		writeJSON(m.logger, w, http.StatusOK, devicePoll{
+			Status:    "approved",
+			IP:        da.IP,
+			ExpiresIn: int(pol.access / time.Second),
+		})
+		return
+	}
+	if _, err := m.store.kvs.GetTTL(m.logger, toplevelDevicePoll+dc); err == nil {
+		writeJSON(m.logger, w, http.StatusBadRequest, devicePoll{Error: deviceErrSlowDown})
+		return
+	}
+	_ = m.store.kvs.PutTTL(m.logger, toplevelDevicePoll+dc, "", devicePollInterval)
+	writeJSON(m.logger, w, http.StatusBadRequest, devicePoll{Error: deviceErrPending})
+}
+
+func (m *MiddlewareApp) findDevice(usercode string) (string, *deviceAuthorization, error) {
+	dc, err := m.store.kvs.GetTTL(m.logger, toplevelDeviceUser+normalizeUserCode(usercode))
+	if err != nil {
+		return "", nil, fmt.Errorf("unknown user code: %w", err)
+	}
+	val, err := m.store.kvs.GetTTL(m.logger, toplevelDevice+dc)
+	if err != nil {
+		return "", nil, fmt.Errorf("device authorization expired: %w", err)
+	}
+	var da deviceAuthorization
+	if err := json.Unmarshal([]byte(val), &da); err != nil {
+		return "", nil, fmt.Errorf("cannot unmarshal device authorization: %w", err)
+	}
+	return dc, &da, nil
+}
+
+// verifyDevice is called by the gate UI to check the user code before the
+// user authorizes.
+func (m *MiddlewareApp) verifyDevice(w http.ResponseWriter, r *http.Request) (rs result, rc int) {
+	if err := r.ParseMultipartForm(1024); err != nil {
+		m.logger.Error("cannot parse form", zap.Error(err))
+		rc = http.StatusInternalServerError
+		return
+	}
+	if _, _, err := m.findDevice(r.FormValue(userCodeField)); err != nil {
+		m.logger.Info("cannot find device", zap.Error(err))
+		rs.Message = "Unknown or expired device code"
+		rc = http.StatusNotFound
+	}
+	return
+}
+
+// approveDevice grants access for the IP of the device which started the
+// authorization with the given user code. The user must have passed the gate
+// with the policy of the device, which also carries the group rules of the
+// site; the user code can be approved only once.
+func (m *MiddlewareApp) approveDevice(gate *policy, uid, usercode string) error {
+	dc, da, err := m.findDevice(usercode)
+	if err != nil {
+		return err
+	}
+	if gate.name != da.Policy {
+		return fmt.Errorf("the device was started for policy %q, not %q", da.Policy, gate.name)
+	}
+	ue, err := m.userOf(uid)
+	if err != nil {
+		return err
+	}
+	if !gate.allows(ue) {
+		return fmt.Errorf("user %q is not allowed by policy %q", uid, gate.name)
+	}
+	if m.geoDenied(da.IP) {
+		m.audit("device location denied", zap.String("uid", uid), zap.String("clientip", da.IP))
+		return fmt.Errorf("the location of the device %s is denied", da.IP)
+	}
+	m.store.kvs.Del(m.logger, toplevelDeviceUser+normalizeUserCode(usercode))
+	m.allowUserIP(gate, ue, da.IP)
+	m.logger.Info("device authorized", zap.String("uid", uid), zap.String("clientip", da.IP))
+	return m.store.kvs.PutTTL(m.logger, toplevelDeviceOK+dc, uid, time.Duration(m.DeviceCodeDuration))
+}
@@ -0,0 +1,179 @@
+package doorman
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap"
+)
+
+func newDeviceApp(t *testing.T) (*MiddlewareApp, *clock.Mock) {
+	mock := clock.NewMock()
+	st, err := newStore(zap.NewNop(), mock, StoreSettings{PersistentType: storageMemory}, &whitelister{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newReturnToApp()
+	m.clock = mock
+	m.store = st
+	m.AccessDuration = defaultAccessDuration
+	m.DeviceCodeDuration = defaultDeviceDuration
+	return m, mock
+}
+
+func pollDevice(m *MiddlewareApp, dc string) (int, devicePoll) {
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "https://auth.example.com/device/poll", strings.NewReader(url.Values{deviceCodeField: {dc}}.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	m.devicePoll(w, r)
+	var res devicePoll
+	_ = json.NewDecoder(w.Body).Decode(&res)
+	return w.Code, res
+}
+
+func Test_deviceFlow(t *testing.T) {
+	m, mock := newDeviceApp(t)
+	def, _ := m.namedPolicy("")
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "https://auth.example.com/device/start", nil)
+	r.RemoteAddr = "10.1.2.3:4711"
+	m.deviceStart(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("deviceStart() status = %d", w.Code)
+	}
+	var ds deviceStart
+	if err := json.NewDecoder(w.Body).Decode(&ds); err != nil {
+		t.Fatal(err)
+	}
+	if ds.DeviceCode == "" || len(ds.UserCode) != userCodeLength+1 {
+		t.Fatalf("deviceStart() returned illegal codes: %+v", ds)
+	}
+
+	if rc, res := pollDevice(m, ds.DeviceCode); rc != http.StatusBadRequest || res.Error != deviceErrPending {
+		t.Errorf("first poll = %d/%q, want pending", rc, res.Error)
+	}
+	if _, res := pollDevice(m, ds.DeviceCode); res.Error != deviceErrSlowDown {
+		t.Errorf("second poll = %q, want slow_down", res.Error)
+	}
+	if _, res := pollDevice(m, "unknown"); res.Error != deviceErrExpired {
+		t.Errorf("poll with unknown code = %q, want expired_token", res.Error)
+	}
+
+	m.Policies = map[string]*Policy{"wiki": {}}
+	wiki, _ := m.namedPolicy("wiki")
+	if err := m.approveDevice(wiki, "ddk", ds.UserCode); err == nil {
+		t.Errorf("approveDevice() must fail on the gate of another policy")
+	}
+	if err := m.approveDevice(def, "ddk", strings.ToLower(ds.UserCode)); err != nil {
+		t.Fatalf("approveDevice() error = %v", err)
+	}
+	if !m.store.isIPAllowed(zap.NewNop(), "10.1.2.3", "") {
+		t.Errorf("the ip of the device should be allowed")
+	}
+	if err := m.approveDevice(def, "other", ds.UserCode); err == nil {
+		t.Errorf("approveDevice() should fail for a used code")
+	}
+	mock.Add(devicePollInterval)
+	if rc, res := pollDevice(m, ds.DeviceCode); rc != http.StatusOK || res.Status != "approved" || res.IP != "10.1.2.3" {
+		t.Errorf("poll after approval = %d/%+v", rc, res)
+	}
+	if _, res := pollDevice(m, ds.DeviceCode); res.Error != deviceErrExpired {
+		t.Errorf("poll after the approval was returned = %q, want expired_token", res.Error)
+	}
+}
+
+func Test_deviceFlow_expired(t *testing.T) {
+	m, mock := newDeviceApp(t)
+	def, _ := m.namedPolicy("")
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodPost, "https://auth.example.com/device/start", nil)
+	m.deviceStart(w, r)
+	var ds deviceStart
+	if err := json.NewDecoder(w.Body).Decode(&ds); err != nil {
+		t.Fatal(err)
+	}
+	mock.Add(time.Duration(defaultDeviceDuration))
+	if _, res := pollDevice(m, ds.DeviceCode); res.Error != deviceErrExpired {
+		t.Errorf("poll after timeout = %q, want expired_token", res.Error)
+	}
+	if err := m.approveDevice(def, "ddk", ds.UserCode); err == nil {
+		t.Errorf("approveDevice() should fail for an expired code")
+	}
+}
+
+func Test_normalizeUserCode(t *testing.T) {
+	if got := normalizeUserCode(" bcdf-ghjk"); got != "BCDFGHJK" {
+		t.Errorf("normalizeUserCode() = %q", got)
+	}
+	if got := displayUserCode("BCDFGHJK"); got != "BCDF-GHJK" {
+		t.Errorf("displayUserCode() = %q", got)
+	}
+}
+
+func Test_approveDevice_geo(t *testing.T) {
+	m, _ := newDeviceApp(t)
+	m.geo = newTestGeoIP(t, GeoIPConfig{DenyCountries: []string{"US"}})
+	def, _ := m.namedPolicy("")
+	start := func(ip string) string {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, "https://auth.example.com/device/start", nil)
+		r.RemoteAddr = ip + ":4711"
+		m.deviceStart(w, r)
+		var ds deviceStart
+		if err := json.NewDecoder(w.Body).Decode(&ds); err != nil {
+			t.Fatal(err)
+		}
+		return ds.UserCode
+	}
+	if err := m.approveDevice(def, "ddk", start("198.51.100.1")); err == nil {
+		t.Errorf("approveDevice() of a device in a denied country must fail")
+	}
+	if m.store.isIPAllowed(zap.NewNop(), "198.51.100.1", "") {
+		t.Errorf("a device in a denied country must not get a grant")
+	}
+	if err := m.approveDevice(def, "ddk", start("192.0.2.10")); err != nil {
+		t.Errorf("approveDevice() of a device in an allowed country = %v", err)
+	}
+}
+
+func Test_approveDevice_groups(t *testing.T) {
+	m := newPolicyApp(t)
+	m.userbackends = &userBackends{searchers: []userSearcher{&userlistBackend{
+		{UID: "ddk", Groups: []string{"admins"}},
+		{UID: "other", Groups: []string{"users"}},
+	}}}
+	m.lookupGroups = true
+	def, _ := m.namedPolicy("")
+	wiki, _ := m.namedPolicy("wiki")
+	site := wiki.withGroups(groupRules{allow: []string{"admins"}})
+
+	w := httptest.NewRecorder()
+	m.deviceStart(w, withPolicy(httptest.NewRequest(http.MethodPost, "https://wiki.example.com/device/start", nil), site))
+	var ds deviceStart
+	if err := json.NewDecoder(w.Body).Decode(&ds); err != nil {
+		t.Fatal(err)
+	}
+
+	// the gate on the auth host gets the group rules of the device
+	gate, err := m.gatePolicy(multipartRequest(t, "https://auth.example.com/", map[string]string{userCodeField: ds.UserCode}), def)
+	if err != nil {
+		t.Fatalf("gatePolicy() error = %v", err)
+	}
+	if err := m.approveDevice(gate, "other", ds.UserCode); err == nil {
+		t.Errorf("approveDevice() must fail for a user who is not in the groups of the site")
+	}
+	if err := m.approveDevice(gate, "ddk", ds.UserCode); err != nil {
+		t.Fatalf("approveDevice() error = %v", err)
+	}
+	g, ok := m.store.grantOf(zap.NewNop(), "192.0.2.1", "wiki")
+	if !ok || g.UID != "ddk" || len(g.Groups) != 1 || g.Groups[0] != "admins" {
+		t.Errorf("grantOf() = %+v, %v, want the grant of ddk with the groups", g, ok)
+	}
+}
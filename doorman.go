@@ -129,34 +129,59 @@ type StoreSettings struct {
 
 // MiddlewareApp implements an HTTP handler
 type MiddlewareApp struct {
-	Users            Plugins         `json:"users,omitempty"`
-	Whitelist        Plugins         `json:"whitelist,omitempty"`
-	CookieHash       []byte          `json:"cookie_hash"`
-	CookieBlock      []byte          `json:"cookie_block"`
-	InsecureCookie   bool            `json:"insecure_cookie,omitempty"`
-	Domain           string          `json:"domain,omitempty"`
-	Issuer           string          `json:"issuer,omitempty"`
-	IssuerBase       string          `json:"issuer_base"`
-	Spacing          string          `json:"spacing,omitempty"`
-	OperationMode    operationMode   `json:"operation_mode"`
-	CaptchaMode      captchaMode     `json:"captcha_mode"`
-	Channels         []string        `json:"channels"`
-	AccessDuration   Duration        `json:"access_duration"`
-	TokenDuration    Duration        `json:"token_duration"`
-	Messenger        MessengerConfig `json:"messenger_config"`
-	StoreSettings    StoreSettings   `json:"store_settings"`
-	ImprintURL       string          `json:"imprint_url"`
-	PrivacyPolicyURL string          `json:"privacy_policy_url"`
-	logger           *zap.Logger
-	store            *persistentStore
-	secCookie        *cookieHandler
-	clock            clock.Clock
-	assets           http.Handler
-	assetsDir        http.FileSystem
-	transporters     transporters
-	userbackends     *userBackends
-	whitelister      *whitelister
-	authHost         string
+	Users              Plugins              `json:"users,omitempty"`
+	Whitelist          Plugins              `json:"whitelist,omitempty"`
+	WhitelistRefresh   WhitelistRefresh     `json:"whitelist_refresh,omitempty"`
+	Blocklist          Plugins              `json:"blocklist,omitempty"`
+	BlockedResponse    BlockedResponse      `json:"blocked_response,omitempty"`
+	GeoIP              *GeoIPConfig         `json:"geoip,omitempty"`
+	GrantPrefixes      GrantPrefixes        `json:"grant_prefixes,omitempty"`
+	CookieHash         []byte               `json:"cookie_hash"`
+	CookieBlock        []byte               `json:"cookie_block"`
+	InsecureCookie     bool                 `json:"insecure_cookie,omitempty"`
+	Domain             string               `json:"domain,omitempty"`
+	Issuer             string               `json:"issuer,omitempty"`
+	IssuerBase         string               `json:"issuer_base"`
+	ReturnToHosts      []string             `json:"return_to_hosts,omitempty"`
+	WWWAuthenticate    string               `json:"www_authenticate,omitempty"`
+	NonBrowserStatus   int                  `json:"non_browser_status,omitempty"`
+	Spacing            string               `json:"spacing,omitempty"`
+	OperationMode      operationMode        `json:"operation_mode"`
+	CaptchaMode        captchaMode          `json:"captcha_mode"`
+	Channels           []string             `json:"channels"`
+	AccessDuration     Duration             `json:"access_duration"`
+	TokenDuration      Duration             `json:"token_duration"`
+	DeviceCodeDuration Duration             `json:"device_code_duration,omitempty"`
+	Messenger          MessengerConfig      `json:"messenger_config"`
+	StoreSettings      StoreSettings        `json:"store_settings"`
+	ImprintURL         string               `json:"imprint_url"`
+	PrivacyPolicyURL   string               `json:"privacy_policy_url"`
+	PersonalTokens     *PersonalTokenConfig `json:"personal_tokens,omitempty"`
+	Admins             []string             `json:"admins,omitempty"`
+	Policies           map[string]*Policy   `json:"policies,omitempty"`
+	RequirePassword    bool                 `json:"require_password,omitempty"`
+	PasswordLockout    PasswordLockout      `json:"password_lockout,omitempty"`
+	UserCache          *UserCache           `json:"user_cache,omitempty"`
+	UserMerge          *UserMerge           `json:"user_merge,omitempty"`
+	UIDNormalization   *UIDNormalization    `json:"uid_normalization,omitempty"`
+	UserAliases        []string             `json:"user_aliases,omitempty"`
+	logger             *zap.Logger
+	store              *persistentStore
+	secCookie          *cookieHandler
+	clock              clock.Clock
+	assets             http.Handler
+	assetsDir          http.FileSystem
+	transporters       transporters
+	userbackends       *userBackends
+	usercache          *userCache
+	whitelister        *whitelister
+	blocklister        *whitelister
+	geo                *geoIP
+	patokens           *personalTokens
+	authHost           string
+	lookupGroups       bool
+	// openPolicies are the policies of sites without group rules
+	openPolicies map[string]bool
 }
 
 // CaddyModule returns the Caddy module information.
@@ -168,13 +193,35 @@ func (MiddlewareApp) CaddyModule() caddy.ModuleInfo {
 }
 
 func (m *MiddlewareApp) Start() error {
+	m.whitelister.startRefresh(m.logger, m.clock, m.WhitelistRefresh)
+	m.blocklister.startRefresh(m.logger, m.clock, m.WhitelistRefresh)
 	return nil
 }
 
 func (m *MiddlewareApp) Stop() error {
+	if m.whitelister != nil {
+		m.whitelister.stop()
+	}
+	if m.blocklister != nil {
+		m.blocklister.stop()
+	}
+	if m.geo != nil {
+		m.geo.stop()
+	}
+	if m.userbackends != nil {
+		m.userbackends.close()
+	}
 	return nil
 }
 
+// Cleanup implements caddy.CleanerUpper. The watchers of the lists and of
+// the geoip databases are started in Provision, so they must also be stopped
+// when the app is not started because Provision failed or the config is only
+// validated.
+func (m *MiddlewareApp) Cleanup() error {
+	return m.Stop()
+}
+
 // Provision implements caddy.Provisioner.
 func (m *MiddlewareApp) Provision(ctx caddy.Context) error {
 	m.logger = ctx.Logger(m)
@@ -222,6 +269,9 @@ assetsInitialized:
 	if m.TokenDuration == 0 {
 		m.TokenDuration = defaultTokenDuration
 	}
+	if m.DeviceCodeDuration == 0 {
+		m.DeviceCodeDuration = defaultDeviceDuration
+	}
 	if m.OperationMode == "" {
 		m.OperationMode = operationsModeToken
 	}
@@ -230,23 +280,59 @@ assetsInitialized:
 		return fmt.Errorf("cannot create messenger: %w", err)
 	}
 	m.transporters = trsp
-	ub, err := fromUserSpecs(m.logger, m.Users)
+	ub, err := fromUserSpecs(m.logger, m.Users, m.UserMerge)
 	if err != nil {
 		return fmt.Errorf("cannot create user backends: %w", err)
 	}
+	ub.normalizeWith(m.UIDNormalization)
+	if err := validateAliases(m.UserAliases); err != nil {
+		return err
+	}
 	m.userbackends = ub
 
-	ws, err := fromWhitelistSpecs(m.logger, m.Whitelist)
+	ws, err := fromWhitelistSpecs(m.logger, m.clock, m.Whitelist)
 	if err != nil {
 		return fmt.Errorf("cannot create whitelist loaders: %w", err)
 	}
 	m.whitelister = ws
 
-	store, err := newStore(m.logger, m.clock, m.StoreSettings, ws)
+	bs, err := fromWhitelistSpecs(m.logger, m.clock, m.Blocklist)
+	if err != nil {
+		return fmt.Errorf("cannot create blocklist loaders: %w", err)
+	}
+	m.blocklister = bs
+
+	if m.GeoIP != nil {
+		geo, err := newGeoIP(m.logger, *m.GeoIP)
+		if err != nil {
+			return fmt.Errorf("cannot create geoip: %w", err)
+		}
+		m.geo = geo
+	}
+
+	store, err := newStore(m.logger, m.clock, m.StoreSettings, ws, bs)
 	if err != nil {
 		return fmt.Errorf("cannot initialize store: %w", err)
 	}
+	store.geo = m.geo
+	store.grants = m.GrantPrefixes
 	m.store = store
+	if m.UserCache != nil {
+		uc, err := newUserCache(*m.UserCache, m.userbackends, m.clock, m.StoreSettings, store.kvs)
+		if err != nil {
+			return fmt.Errorf("cannot create user cache: %w", err)
+		}
+		m.usercache = uc
+	}
+	if m.PersonalTokens != nil {
+		if m.PersonalTokens.DefaultDuration == 0 {
+			m.PersonalTokens.DefaultDuration = defaultPersonalTokenDuration
+		}
+		if m.PersonalTokens.MaxDuration == 0 {
+			m.PersonalTokens.MaxDuration = defaultPersonalTokenMaxDuration
+		}
+		m.patokens = &personalTokens{kvs: store.kvs}
+	}
 	m.logger.Info("configdata", zap.Any("config", *m))
 
 	return nil
@@ -275,6 +361,15 @@ func (m *MiddlewareApp) Validate() error {
 	if m.IssuerBase == "" {
 		return fmt.Errorf("you must specify the issuer_base as a base url, aka https://www.example.com")
 	}
+	if m.NonBrowserStatus != 0 && m.NonBrowserStatus != http.StatusUnauthorized && m.NonBrowserStatus != http.StatusForbidden {
+		return fmt.Errorf("non_browser_status must be %d or %d", http.StatusUnauthorized, http.StatusForbidden)
+	}
+	if err := m.GrantPrefixes.validate(); err != nil {
+		return err
+	}
+	if err := m.validatePolicies(); err != nil {
+		return err
+	}
 	if u, e := url.Parse(m.IssuerBase); e != nil {
 		return fmt.Errorf("you must specify the issuer_base as a base url, aka https://www.example.com: %w", e)
 	} else {
@@ -290,17 +385,32 @@ func (m *MiddlewareApp) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	return nil
 }
 
+// searchUser searches the normalized uid and then the aliases. The entry has
+// the uid of the backend, which is stored in the cookie and the grants.
 func (m *MiddlewareApp) searchUser(uid string) (*UserEntry, error) {
-	ue, err := m.userbackends.Search(m.logger, uid)
+	var us userSearcher = m.userbackends
+	if m.usercache != nil {
+		us = m.usercache
+	}
+	ue, err := us.Search(m.logger, m.UIDNormalization.normalize(uid))
+	for _, a := range m.UserAliases {
+		if !errors.Is(err, ErrNoUser) {
+			break
+		}
+		var canonical string
+		if canonical, err = m.userbackends.searchAlias(m.logger, a, m.UIDNormalization.clean(uid)); err == nil {
+			ue, err = us.Search(m.logger, canonical)
+		}
+	}
 	if err == nil {
 		m.logger.Info("found user", zap.Any("user", ue))
 	}
 	return ue, err
 }
 
-func (m *MiddlewareApp) sendMessage(usr *UserEntry, subject, msg, body string) error {
+func (m *MiddlewareApp) sendMessage(channels []string, usr *UserEntry, subject, msg, body string) error {
 	m.logger.Info("send message", zap.Any("transporters", m.transporters))
-	for _, c := range m.Channels {
+	for _, c := range channels {
 		t, ok := m.transporters[c]
 		if !ok {
 			continue
@@ -319,7 +429,7 @@ func (m *MiddlewareApp) sendMessage(usr *UserEntry, subject, msg, body string) e
 		m.logger.Info("message to user sent", zap.String("output", res))
 		return nil
 	}
-	return fmt.Errorf("no message transport found for channels: %v", m.Channels)
+	return fmt.Errorf("no message transport found for channels: %v", channels)
 }
 
 func (m *MiddlewareApp) createTempRegistration(log *zap.Logger, uid string) (string, error) {
@@ -361,11 +471,28 @@ func (m *MiddlewareApp) sendOTPRegistration(uid, email, mobile, regkey string) e
 	return nil
 }
 
-func (m *MiddlewareApp) allowUserIP(issuer, userid, clip string) {
-	if err := m.store.allowUserIP(m.logger, clip, time.Duration(m.AccessDuration)); err != nil {
-		m.logger.Error("cannot allow userip", zap.Error(err))
+func (m *MiddlewareApp) allowUserIP(pol *policy, ue *UserEntry, clip string) {
+	rng, err := m.store.allowUserIP(m.logger, pol.name, ue.UID, clip, pol.access, ue.Groups...)
+	if err != nil {
+		m.logger.Error("cannot allow userip", zap.String("range", rng), zap.Error(err))
+	}
+	m.store.tokensrv.removeTempToken(m.logger, m.Issuer, ue.UID)
+	m.audit("access granted", zap.String("uid", ue.UID), zap.String("clientip", clip), zap.String("range", rng), zap.String("policy", pol.name), zap.Duration("duration", pol.access))
+}
+
+// audit logs security relevant events with a separate logger, so they can
+// be routed to an audit log. Events with a client ip also get the location
+// of the client.
+func (m *MiddlewareApp) audit(msg string, fields ...zap.Field) {
+	if m.geo != nil {
+		for _, f := range fields {
+			if f.Key == "clientip" {
+				fields = append(fields, m.locate(f.String).fields()...)
+				break
+			}
+		}
 	}
-	m.store.tokensrv.removeTempToken(m.logger, issuer, userid)
+	m.logger.Named("audit").Info(msg, fields...)
 }
 
 func (m *MiddlewareApp) canDoOTP() bool {
@@ -373,7 +500,14 @@ func (m *MiddlewareApp) canDoOTP() bool {
 }
 
 type Middleware struct {
-	app *MiddlewareApp
+	Policy      string        `json:"policy,omitempty"`
+	AllowGroups []string      `json:"allow_groups,omitempty"`
+	DenyGroups  []string      `json:"deny_groups,omitempty"`
+	Exempt      []*ExemptRule `json:"exempt,omitempty"`
+
+	app    *MiddlewareApp
+	policy *policy
+	groups groupRules
 }
 
 func (Middleware) CaddyModule() caddy.ModuleInfo {
@@ -383,19 +517,71 @@ func (Middleware) CaddyModule() caddy.ModuleInfo {
 	}
 }
 
+// setUpstreamUser makes the identity of an admitted request available for
+// the upstream with the placeholder {http.auth.user.id}.
+func setUpstreamUser(r *http.Request, uid string) {
+	if repl, ok := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer); ok {
+		repl.Set("http.auth.user.id", uid)
+	}
+}
+
 // ServeHTTP implements caddyhttp.MiddlewareHandler.
 func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
 	clip := findClientIP(r)
-	ipallowed := m.app.store.isAllowed(clip)
+	if m.app.isBlocked(r, clip) {
+		m.app.serveBlocked(w, r, clip)
+		return nil
+	}
+	if rule, ok := m.exemptRule(r); ok {
+		return m.serveExempt(w, r, next, rule, clip)
+	}
+	if uid, ok := m.app.checkPersonalToken(r, clip, m.policy.name); ok && m.identityAllowed(uid, clip) {
+		setUpstreamUser(r, uid)
+		return next.ServeHTTP(w, r)
+	}
+	if id, ok := m.app.whitelister.allowRequest(m.app.logger, r); ok && m.identityAllowed(id, clip) {
+		m.app.logger.Debug("client certificate admitted", zap.String("identity", id), zap.String("clientip", clip), zap.String("url", r.URL.String()))
+		setUpstreamUser(r, id)
+		return next.ServeHTTP(w, r)
+	}
+	ipallowed := m.app.store.isAllowed(clip, m.policy.name) && m.grantGroupsAllowed(clip)
+	if !ipallowed && m.app.geoDenied(clip) {
+		// neither the gate nor a grant for this location
+		m.app.serveBlocked(w, r, clip)
+		return nil
+	}
 	if m.app.IsAppRequest(r) {
 		m.app.logger.Debug("app request", zap.String("clientip", clip), zap.Bool("ipallowed", ipallowed), zap.String("url", r.URL.String()))
-		m.app.ServeApp(w, r, clip)
+		pol, err := m.app.gatePolicy(r, m.policy)
+		if err != nil {
+			m.app.audit("gate call rejected", zap.String("clientip", clip), zap.String("url", r.URL.String()), zap.Error(err))
+			appFunc(m.app.logger, w, r, func(w http.ResponseWriter, r *http.Request) (result, int) {
+				return result{Message: "Access denied"}, http.StatusForbidden
+			})
+			return nil
+		}
+		m.app.ServeApp(w, withPolicy(r, pol), clip)
 		return nil
 	}
+	r = withPolicy(r, m.policy)
 	m.app.logger.Debug("check if access is allowed", zap.String("clientip", clip), zap.Bool("ipallowed", ipallowed))
 	if ipallowed {
 		return next.ServeHTTP(w, r)
 	}
+	if !m.app.isGateRequest(r) && !isBrowserRequest(r) {
+		m.app.serveProblem(w, r)
+		return nil
+	}
+	if r.Method == http.MethodGet && r.Host != m.app.authHost && m.app.isReturnHostAllowed(r.Host) {
+		// show the gate on the auth host and come back to the original url
+		// when the user is authorized
+		target, err := m.app.gateURL(r)
+		if err == nil {
+			http.Redirect(w, r, target, http.StatusFound)
+			return nil
+		}
+		m.app.logger.Error("cannot create gate url", zap.Error(err))
+	}
 	m.app.ServeApp(w, r, clip)
 	return nil
 }
@@ -406,6 +592,23 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 		return err
 	}
 	m.app = dm.(*MiddlewareApp)
+	pol, ok := m.app.namedPolicy(m.Policy)
+	if !ok {
+		return fmt.Errorf("unknown policy: %q", m.Policy)
+	}
+	m.groups = groupRules{allow: m.AllowGroups, deny: m.DenyGroups}
+	if !m.groups.empty() {
+		m.app.lookupGroups = true
+	}
+	if m.groups.empty() {
+		m.app.openPolicy(pol.name)
+	}
+	m.policy = pol.withGroups(m.groups)
+	for i, er := range m.Exempt {
+		if err := er.provision(ctx, i); err != nil {
+			return fmt.Errorf("cannot provision exempt rule: %w", err)
+		}
+	}
 	return nil
 }
 
@@ -413,6 +616,7 @@ func (m *Middleware) Provision(ctx caddy.Context) error {
 var (
 	_ caddy.Provisioner           = (*MiddlewareApp)(nil)
 	_ caddy.Validator             = (*MiddlewareApp)(nil)
+	_ caddy.CleanerUpper          = (*MiddlewareApp)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Middleware)(nil)
 	_ caddyfile.Unmarshaler       = (*MiddlewareApp)(nil)
 	_ caddy.App                   = (*MiddlewareApp)(nil)
@@ -0,0 +1,87 @@
+package doorman
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.uber.org/zap"
+)
+
+var exemptRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+	Namespace: "doorman",
+	Name:      "exempt_requests_total",
+	Help:      "Number of requests which bypassed the gate because of an exempt rule.",
+}, []string{"rule"})
+
+// ExemptRule lets requests bypass the gate, for example health checks,
+// ACME challenges or webhooks. All given conditions must match; the paths
+// use the globs of the caddy path matcher and Match can contain any caddy
+// request matcher.
+type ExemptRule struct {
+	Name     string                `json:"name,omitempty"`
+	Paths    caddyhttp.MatchPath   `json:"paths,omitempty"`
+	Methods  caddyhttp.MatchMethod `json:"methods,omitempty"`
+	Headers  caddyhttp.MatchHeader `json:"headers,omitempty"`
+	MatchRaw caddy.ModuleMap       `json:"match,omitempty" caddy:"namespace=http.matchers"`
+
+	matchers caddyhttp.MatcherSet
+}
+
+func (er *ExemptRule) provision(ctx caddy.Context, idx int) error {
+	if er.Name == "" {
+		er.Name = fmt.Sprintf("rule-%d", idx)
+	}
+	if len(er.Paths) > 0 {
+		if err := er.Paths.Provision(ctx); err != nil {
+			return err
+		}
+		er.matchers = append(er.matchers, er.Paths)
+	}
+	if len(er.Methods) > 0 {
+		for i, m := range er.Methods {
+			er.Methods[i] = strings.ToUpper(m)
+		}
+		er.matchers = append(er.matchers, er.Methods)
+	}
+	if len(er.Headers) > 0 {
+		er.matchers = append(er.matchers, er.Headers)
+	}
+	if er.MatchRaw != nil {
+		mods, err := ctx.LoadModule(er, "MatchRaw")
+		if err != nil {
+			return fmt.Errorf("cannot load matchers: %w", err)
+		}
+		for _, mod := range mods.(map[string]interface{}) {
+			rm, ok := mod.(caddyhttp.RequestMatcher)
+			if !ok {
+				return fmt.Errorf("decoded module is not a RequestMatcher: %#v", mod)
+			}
+			er.matchers = append(er.matchers, rm)
+		}
+	}
+	if len(er.matchers) == 0 {
+		return fmt.Errorf("the exempt rule %q has no condition and would exempt every request", er.Name)
+	}
+	return nil
+}
+
+// exemptRule returns the name of the first rule which matches the request.
+func (m *Middleware) exemptRule(r *http.Request) (string, bool) {
+	for _, er := range m.Exempt {
+		if er.matchers.Match(r) {
+			return er.Name, true
+		}
+	}
+	return "", false
+}
+
+func (m *Middleware) serveExempt(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler, rule, clip string) error {
+	exemptRequests.WithLabelValues(rule).Inc()
+	m.app.logger.Debug("request is exempt", zap.String("rule", rule), zap.String("clientip", clip), zap.String("url", r.URL.String()))
+	return next.ServeHTTP(w, r)
+}
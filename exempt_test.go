@@ -0,0 +1,110 @@
+package doorman
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newExemptMiddleware(t *testing.T, rules string) *Middleware {
+	var mw Middleware
+	if err := json.Unmarshal([]byte(rules), &mw.Exempt); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	t.Cleanup(cancel)
+	for i, er := range mw.Exempt {
+		if err := er.provision(ctx, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mw.app = newBlockingApp(t, "10.6.6.6")
+	return &mw
+}
+
+func exemptRequest(method, target string, hdr http.Header) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	for k, v := range hdr {
+		r.Header[k] = v
+	}
+	r.RemoteAddr = "192.0.2.1:4711"
+	return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+}
+
+func Test_Middleware_exemptRule(t *testing.T) {
+	mw := newExemptMiddleware(t, `[
+		{"name": "acme", "paths": ["/.well-known/acme-challenge/*"]},
+		{"name": "health", "paths": ["/healthz"], "methods": ["get", "head"]},
+		{"paths": ["/hooks/*"], "methods": ["POST"], "headers": {"X-Hub-Signature": ["*"]}},
+		{"name": "internal", "match": {"remote_ip": {"ranges": ["192.0.2.0/24"]}, "path": ["/internal/*"]}}
+	]`)
+	tests := []struct {
+		name     string
+		method   string
+		target   string
+		header   http.Header
+		wantRule string
+	}{
+		{name: "acme challenge", method: http.MethodGet, target: "https://wiki.example.com/.well-known/acme-challenge/abc", wantRule: "acme"},
+		{name: "health check", method: http.MethodHead, target: "https://wiki.example.com/healthz", wantRule: "health"},
+		{name: "health check with wrong method", method: http.MethodPost, target: "https://wiki.example.com/healthz"},
+		{name: "webhook", method: http.MethodPost, target: "https://wiki.example.com/hooks/git", header: http.Header{"X-Hub-Signature": {"sha1=abc"}}, wantRule: "rule-2"},
+		{name: "webhook without signature", method: http.MethodPost, target: "https://wiki.example.com/hooks/git"},
+		{name: "caddy matchers", method: http.MethodGet, target: "https://wiki.example.com/internal/status", wantRule: "internal"},
+		{name: "protected page", method: http.MethodGet, target: "https://wiki.example.com/wiki/Main"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rule, ok := mw.exemptRule(exemptRequest(tt.method, tt.target, tt.header))
+			if rule != tt.wantRule || ok != (tt.wantRule != "") {
+				t.Errorf("exemptRule() = %q, %v, want %q", rule, ok, tt.wantRule)
+			}
+		})
+	}
+}
+
+func Test_Middleware_serveExempt(t *testing.T) {
+	mw := newExemptMiddleware(t, `[{"name": "health-test", "paths": ["/healthz"]}]`)
+	before := testutil.ToFloat64(exemptRequests.WithLabelValues("health-test"))
+	called := false
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		called = true
+		return nil
+	})
+	w := httptest.NewRecorder()
+	if err := mw.ServeHTTP(w, exemptRequest(http.MethodGet, "https://wiki.example.com/healthz", nil), next); err != nil {
+		t.Fatal(err)
+	}
+	if !called {
+		t.Errorf("an exempt request must be passed to the upstream")
+	}
+	if got := testutil.ToFloat64(exemptRequests.WithLabelValues("health-test")); got != before+1 {
+		t.Errorf("exempt counter = %v, want %v", got, before+1)
+	}
+
+	// the blocklist is checked before the exemptions
+	called = false
+	r := exemptRequest(http.MethodGet, "https://wiki.example.com/healthz", nil)
+	r.RemoteAddr = "10.6.6.6:4711"
+	if err := mw.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Errorf("a blocked client must not be exempt")
+	}
+}
+
+func Test_ExemptRule_needsCondition(t *testing.T) {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	er := &ExemptRule{Name: "all"}
+	if err := er.provision(ctx, 0); err == nil {
+		t.Errorf("a rule without conditions must be rejected")
+	}
+}
@@ -0,0 +1,227 @@
+package doorman
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/oschwald/maxminddb-golang"
+	"go.uber.org/zap"
+)
+
+// GeoIPConfig restricts the clients by their location which is looked up in
+// local MaxMind databases (GeoLite2 Country and ASN). A client is denied if
+// its country or ASN is in a deny list. If an allow list is set, the country
+// or ASN of the client must also be in this list; an unknown location is not
+// allowed then.
+type GeoIPConfig struct {
+	CountryDB      string   `json:"country_db,omitempty"`
+	ASNDB          string   `json:"asn_db,omitempty"`
+	AllowCountries []string `json:"allow_countries,omitempty"`
+	DenyCountries  []string `json:"deny_countries,omitempty"`
+	AllowASNs      []uint   `json:"allow_asns,omitempty"`
+	DenyASNs       []uint   `json:"deny_asns,omitempty"`
+}
+
+// geoLocation is the location of a client.
+type geoLocation struct {
+	Country string
+	ASN     uint
+	Org     string
+}
+
+func (gl geoLocation) String() string {
+	var parts []string
+	if gl.Country != "" {
+		parts = append(parts, gl.Country)
+	}
+	if gl.ASN != 0 {
+		parts = append(parts, strings.TrimSpace(fmt.Sprintf("AS%d %s", gl.ASN, gl.Org)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func (gl geoLocation) fields() []zap.Field {
+	return []zap.Field{zap.String("country", gl.Country), zap.Uint("asn", gl.ASN), zap.String("asorg", gl.Org)}
+}
+
+type countryRecord struct {
+	Country struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"country"`
+	RegisteredCountry struct {
+		ISOCode string `maxminddb:"iso_code"`
+	} `maxminddb:"registered_country"`
+}
+
+type asnRecord struct {
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+// geoDB is a database which is replaced when the file changes. The file is
+// read into memory and not mapped, so a replaced reader can still be used
+// by running lookups.
+type geoDB struct {
+	path   string
+	reader atomic.Pointer[maxminddb.Reader]
+}
+
+func (db *geoDB) load(log *zap.Logger) error {
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return fmt.Errorf("cannot read geoip database: %w", err)
+	}
+	rd, err := maxminddb.FromBytes(data)
+	if err != nil {
+		return fmt.Errorf("cannot open geoip database %q: %w", db.path, err)
+	}
+	db.reader.Store(rd)
+	log.Info("geoip database loaded", zap.String("path", db.path), zap.String("type", rd.Metadata.DatabaseType), zap.Uint("build", rd.Metadata.BuildEpoch))
+	return nil
+}
+
+func (db *geoDB) lookup(ip net.IP, res interface{}) error {
+	if db == nil {
+		return nil
+	}
+	rd := db.reader.Load()
+	if rd == nil {
+		return nil
+	}
+	return rd.Lookup(ip, res)
+}
+
+type geoIP struct {
+	cfg     GeoIPConfig
+	country *geoDB
+	asn     *geoDB
+	done    chan struct{}
+}
+
+func newGeoIP(log *zap.Logger, cfg GeoIPConfig) (*geoIP, error) {
+	if cfg.CountryDB == "" && cfg.ASNDB == "" {
+		return nil, fmt.Errorf("geoip needs a country_db or an asn_db")
+	}
+	if cfg.CountryDB == "" && (len(cfg.AllowCountries) > 0 || len(cfg.DenyCountries) > 0) {
+		return nil, fmt.Errorf("geoip country rules need a country_db")
+	}
+	if cfg.ASNDB == "" && (len(cfg.AllowASNs) > 0 || len(cfg.DenyASNs) > 0) {
+		return nil, fmt.Errorf("geoip asn rules need an asn_db")
+	}
+	g := &geoIP{cfg: cfg, done: make(chan struct{})}
+	for _, c := range []struct {
+		path string
+		db   **geoDB
+	}{{cfg.CountryDB, &g.country}, {cfg.ASNDB, &g.asn}} {
+		if c.path == "" {
+			continue
+		}
+		db := &geoDB{path: c.path}
+		if err := db.load(log); err != nil {
+			g.stop()
+			return nil, err
+		}
+		err := watchFile(log, c.path, g.done, func() {
+			if err := db.load(log); err != nil {
+				log.Error("cannot reload geoip database, keep the last one", zap.Error(err))
+			}
+		})
+		if err != nil {
+			g.stop()
+			return nil, fmt.Errorf("cannot watch geoip database: %w", err)
+		}
+		*c.db = db
+	}
+	return g, nil
+}
+
+func (g *geoIP) stop() {
+	if g.done != nil {
+		close(g.done)
+		g.done = nil
+	}
+}
+
+func (g *geoIP) locate(log *zap.Logger, clip string) geoLocation {
+	var res geoLocation
+	ip := net.ParseIP(clip)
+	if ip == nil {
+		return res
+	}
+	var cr countryRecord
+	if err := g.country.lookup(ip, &cr); err != nil {
+		log.Debug("cannot lookup country", zap.String("ip", clip), zap.Error(err))
+	}
+	res.Country = cr.Country.ISOCode
+	if res.Country == "" {
+		res.Country = cr.RegisteredCountry.ISOCode
+	}
+	var ar asnRecord
+	if err := g.asn.lookup(ip, &ar); err != nil {
+		log.Debug("cannot lookup asn", zap.String("ip", clip), zap.Error(err))
+	}
+	res.ASN = ar.ASN
+	res.Org = ar.Org
+	return res
+}
+
+func containsCountry(list []string, c string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, c) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsASN(list []uint, asn uint) bool {
+	for _, l := range list {
+		if l == asn {
+			return true
+		}
+	}
+	return false
+}
+
+// allowed checks the location against the rules.
+func (g *geoIP) allowed(gl geoLocation) bool {
+	if gl.Country != "" && containsCountry(g.cfg.DenyCountries, gl.Country) {
+		return false
+	}
+	if gl.ASN != 0 && containsASN(g.cfg.DenyASNs, gl.ASN) {
+		return false
+	}
+	if len(g.cfg.AllowCountries) > 0 && !containsCountry(g.cfg.AllowCountries, gl.Country) {
+		return false
+	}
+	if len(g.cfg.AllowASNs) > 0 && !containsASN(g.cfg.AllowASNs, gl.ASN) {
+		return false
+	}
+	return true
+}
+
+// locate returns the location of the client, it is empty if no geoip is
+// configured.
+func (m *MiddlewareApp) locate(clip string) geoLocation {
+	if m.geo == nil {
+		return geoLocation{}
+	}
+	return m.geo.locate(m.logger, clip)
+}
+
+// geoDenied returns true if the client may not use the gate or a grant
+// because of its location.
+func (m *MiddlewareApp) geoDenied(clip string) bool {
+	if m.geo == nil {
+		return false
+	}
+	gl := m.geo.locate(m.logger, clip)
+	if m.geo.allowed(gl) {
+		return false
+	}
+	m.logger.Debug("location of client is denied", append(gl.fields(), zap.String("clientip", clip))...)
+	return true
+}
@@ -0,0 +1,231 @@
+package doorman
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// mmdbEncode encodes a value in the data section format of a MaxMind DB.
+// Only the types needed by the tests are supported.
+func mmdbEncode(buf *bytes.Buffer, v interface{}) {
+	uintBytes := func(n uint64) []byte {
+		var b [8]byte
+		binary.BigEndian.PutUint64(b[:], n)
+		i := 0
+		for i < 8 && b[i] == 0 {
+			i++
+		}
+		return b[i:]
+	}
+	switch t := v.(type) {
+	case string:
+		if len(t) < 29 {
+			buf.WriteByte(2<<5 | byte(len(t)))
+		} else {
+			buf.Write([]byte{2<<5 | 29, byte(len(t) - 29)})
+		}
+		buf.WriteString(t)
+	case uint16:
+		b := uintBytes(uint64(t))
+		buf.WriteByte(5<<5 | byte(len(b)))
+		buf.Write(b)
+	case uint32:
+		b := uintBytes(uint64(t))
+		buf.WriteByte(6<<5 | byte(len(b)))
+		buf.Write(b)
+	case map[string]interface{}:
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte(7<<5 | byte(len(t)))
+		for _, k := range keys {
+			mmdbEncode(buf, k)
+			mmdbEncode(buf, t[k])
+		}
+	default:
+		panic("unsupported mmdb type")
+	}
+}
+
+type mmdbNode struct {
+	children [2]int
+	data     [2]int
+}
+
+// writeTestMMDB writes an IPv4 MaxMind DB with the given records for CIDRs.
+func writeTestMMDB(t *testing.T, path, dbtype string, records map[string]map[string]interface{}) {
+	var data bytes.Buffer
+	nodes := []*mmdbNode{{children: [2]int{-1, -1}, data: [2]int{-1, -1}}}
+	for cidr, rec := range records {
+		_, nw, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ones, _ := nw.Mask.Size()
+		offset := data.Len()
+		mmdbEncode(&data, rec)
+		ip := binary.BigEndian.Uint32(nw.IP.To4())
+		n := nodes[0]
+		for i := 0; i < ones; i++ {
+			bit := (ip >> (31 - i)) & 1
+			if i == ones-1 {
+				n.data[bit] = offset
+				break
+			}
+			if n.children[bit] < 0 {
+				nodes = append(nodes, &mmdbNode{children: [2]int{-1, -1}, data: [2]int{-1, -1}})
+				n.children[bit] = len(nodes) - 1
+			}
+			n = nodes[n.children[bit]]
+		}
+	}
+	var out bytes.Buffer
+	count := uint32(len(nodes))
+	for _, n := range nodes {
+		for b := 0; b < 2; b++ {
+			rec := count
+			if n.children[b] >= 0 {
+				rec = uint32(n.children[b])
+			} else if n.data[b] >= 0 {
+				rec = count + 16 + uint32(n.data[b])
+			}
+			_ = binary.Write(&out, binary.BigEndian, rec)
+		}
+	}
+	out.Write(make([]byte, 16))
+	out.Write(data.Bytes())
+	out.WriteString("\xAB\xCD\xEFMaxMind.com")
+	mmdbEncode(&out, map[string]interface{}{
+		"node_count":                  count,
+		"record_size":                 uint16(32),
+		"ip_version":                  uint16(4),
+		"database_type":               dbtype,
+		"binary_format_major_version": uint16(2),
+	})
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func mmdbCountry(iso string) map[string]interface{} {
+	return map[string]interface{}{"country": map[string]interface{}{"iso_code": iso}}
+}
+
+func mmdbASN(n uint32, org string) map[string]interface{} {
+	return map[string]interface{}{"autonomous_system_number": n, "autonomous_system_organization": org}
+}
+
+func newTestGeoIP(t *testing.T, cfg GeoIPConfig) *geoIP {
+	dir := t.TempDir()
+	cfg.CountryDB = filepath.Join(dir, "country.mmdb")
+	cfg.ASNDB = filepath.Join(dir, "asn.mmdb")
+	writeTestMMDB(t, cfg.CountryDB, "GeoLite2-Country", map[string]map[string]interface{}{
+		"192.0.2.0/24":    mmdbCountry("DE"),
+		"198.51.100.0/24": mmdbCountry("US"),
+		"203.0.113.0/25":  mmdbCountry("KP"),
+	})
+	writeTestMMDB(t, cfg.ASNDB, "GeoLite2-ASN", map[string]map[string]interface{}{
+		"192.0.2.0/24":    mmdbASN(3320, "Deutsche Telekom AG"),
+		"198.51.100.0/24": mmdbASN(16509, "AMAZON-02"),
+	})
+	g, err := newGeoIP(zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(g.stop)
+	return g
+}
+
+func Test_geoIP_locate(t *testing.T) {
+	g := newTestGeoIP(t, GeoIPConfig{})
+	tests := []struct {
+		ip   string
+		want geoLocation
+	}{
+		{ip: "192.0.2.10", want: geoLocation{Country: "DE", ASN: 3320, Org: "Deutsche Telekom AG"}},
+		{ip: "198.51.100.1", want: geoLocation{Country: "US", ASN: 16509, Org: "AMAZON-02"}},
+		{ip: "203.0.113.1", want: geoLocation{Country: "KP"}},
+		{ip: "10.1.1.1"},
+		{ip: "no ip"},
+	}
+	for _, tt := range tests {
+		if got := g.locate(zap.NewNop(), tt.ip); got != tt.want {
+			t.Errorf("locate(%s) = %+v, want %+v", tt.ip, got, tt.want)
+		}
+	}
+	if got := tests[0].want.String(); got != "DE, AS3320 Deutsche Telekom AG" {
+		t.Errorf("String() = %q", got)
+	}
+}
+
+func Test_geoIP_allowed(t *testing.T) {
+	de := geoLocation{Country: "DE", ASN: 3320}
+	aws := geoLocation{Country: "US", ASN: 16509}
+	unknown := geoLocation{}
+	tests := []struct {
+		name string
+		cfg  GeoIPConfig
+		loc  geoLocation
+		want bool
+	}{
+		{name: "no rules", loc: unknown, want: true},
+		{name: "allowed country", cfg: GeoIPConfig{AllowCountries: []string{"de", "at"}}, loc: de, want: true},
+		{name: "other country", cfg: GeoIPConfig{AllowCountries: []string{"DE"}}, loc: aws, want: false},
+		{name: "unknown country with allow list", cfg: GeoIPConfig{AllowCountries: []string{"DE"}}, loc: unknown, want: false},
+		{name: "denied country", cfg: GeoIPConfig{DenyCountries: []string{"US"}}, loc: aws, want: false},
+		{name: "denied asn", cfg: GeoIPConfig{AllowCountries: []string{"US"}, DenyASNs: []uint{16509}}, loc: aws, want: false},
+		{name: "allowed asn", cfg: GeoIPConfig{AllowASNs: []uint{3320}}, loc: de, want: true},
+		{name: "unknown with deny lists", cfg: GeoIPConfig{DenyCountries: []string{"US"}, DenyASNs: []uint{16509}}, loc: unknown, want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := &geoIP{cfg: tt.cfg}
+			if got := g.allowed(tt.loc); got != tt.want {
+				t.Errorf("allowed() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_geoIP_reload(t *testing.T) {
+	g := newTestGeoIP(t, GeoIPConfig{})
+	writeTestMMDB(t, g.cfg.CountryDB, "GeoLite2-Country", map[string]map[string]interface{}{
+		"192.0.2.0/24": mmdbCountry("AT"),
+	})
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if g.locate(zap.NewNop(), "192.0.2.10").Country == "AT" {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("the changed database was not reloaded")
+}
+
+func Test_persistentStore_isAllowed_geo(t *testing.T) {
+	m := newBlockingApp(t)
+	m.store.geo = newTestGeoIP(t, GeoIPConfig{DenyASNs: []uint{16509}})
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "ddk", "192.0.2.10", time.Hour)
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "ddk", "198.51.100.1", time.Hour)
+
+	if !m.store.isAllowed("192.0.2.10", "") {
+		t.Errorf("a grant from an allowed location must be admitted")
+	}
+	if m.store.isAllowed("198.51.100.1", "") {
+		t.Errorf("a grant from a denied location must not be admitted")
+	}
+}
@@ -0,0 +1,76 @@
+package doorman
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"go.uber.org/zap"
+)
+
+// GrantPrefixes is the size of the range which is granted to an authorized
+// client. IPv6 clients with privacy extensions change their address within
+// their /64 network every few hours, so a grant for the exact address would
+// send them back to the gate. The default is the exact address.
+type GrantPrefixes struct {
+	IPv4 int `json:"ipv4,omitempty"`
+	IPv6 int `json:"ipv6,omitempty"`
+}
+
+func (gp GrantPrefixes) validate() error {
+	if gp.IPv4 < 0 || gp.IPv4 > 32 {
+		return fmt.Errorf("the grant prefix for ipv4 must be between 1 and 32, or 0 for the default: %d", gp.IPv4)
+	}
+	if gp.IPv6 < 0 || gp.IPv6 > 128 {
+		return fmt.Errorf("the grant prefix for ipv6 must be between 1 and 128, or 0 for the default: %d", gp.IPv6)
+	}
+	return nil
+}
+
+// grantRange returns the normalized range which is granted for the client
+// ip. A range of a single address is the address itself, so grants of
+// earlier versions are still valid.
+func (gp GrantPrefixes) grantRange(clip string) string {
+	ip, err := netip.ParseAddr(clip)
+	if err != nil {
+		return clip
+	}
+	ip = ip.Unmap().WithZone("")
+	bits := gp.IPv6
+	if ip.Is4() {
+		bits = gp.IPv4
+	}
+	if bits == 0 || bits >= ip.BitLen() {
+		return ip.String()
+	}
+	p, err := ip.Prefix(bits)
+	if err != nil {
+		return ip.String()
+	}
+	return p.String()
+}
+
+// grant is the access of a user from a range of addresses.
+type grant struct {
+	UID    string   `json:"uid"`
+	Range  string   `json:"range"`
+	Policy string   `json:"policy,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+	Until  int64    `json:"until"`
+}
+
+// listGrants shows the active grants to an admin.
+func (m *MiddlewareApp) listGrants(w http.ResponseWriter, r *http.Request) {
+	uid, ok := m.currentUser(r)
+	if !ok || !m.isAdmin(uid) {
+		writeJSON(m.logger, w, http.StatusForbidden, result{Message: "Not authorized"})
+		return
+	}
+	grants, err := m.store.listGrants(m.logger)
+	if err != nil {
+		m.logger.Error("cannot list grants", zap.Error(err))
+		writeJSON(m.logger, w, http.StatusInternalServerError, result{Message: "Cannot list grants"})
+		return
+	}
+	writeJSON(m.logger, w, http.StatusOK, grants)
+}
@@ -0,0 +1,104 @@
+package doorman
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func Test_GrantPrefixes_grantRange(t *testing.T) {
+	tests := []struct {
+		name string
+		gp   GrantPrefixes
+		ip   string
+		want string
+	}{
+		{name: "default ipv4", ip: "192.0.2.10", want: "192.0.2.10"},
+		{name: "default ipv6", ip: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2:3:4:5:6"},
+		{name: "ipv6 /64", gp: GrantPrefixes{IPv6: 64}, ip: "2001:db8:1:2:3:4:5:6", want: "2001:db8:1:2::/64"},
+		{name: "ipv4 /24", gp: GrantPrefixes{IPv4: 24, IPv6: 64}, ip: "192.0.2.10", want: "192.0.2.0/24"},
+		{name: "full ipv4 prefix", gp: GrantPrefixes{IPv4: 32}, ip: "192.0.2.10", want: "192.0.2.10"},
+		{name: "mapped ipv4", gp: GrantPrefixes{IPv4: 24, IPv6: 64}, ip: "::ffff:192.0.2.10", want: "192.0.2.0/24"},
+		{name: "no ip", gp: GrantPrefixes{IPv4: 24}, ip: "unknown", want: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.gp.grantRange(tt.ip); got != tt.want {
+				t.Errorf("grantRange() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_GrantPrefixes_validate(t *testing.T) {
+	if err := (GrantPrefixes{IPv4: 32, IPv6: 64}).validate(); err != nil {
+		t.Errorf("validate() error = %v", err)
+	}
+	if err := (GrantPrefixes{IPv4: 33}).validate(); err == nil {
+		t.Errorf("validate() must reject an ipv4 prefix of 33")
+	}
+	if err := (GrantPrefixes{IPv6: 129}).validate(); err == nil {
+		t.Errorf("validate() must reject an ipv6 prefix of 129")
+	}
+	if err := (GrantPrefixes{}).validate(); err != nil {
+		t.Errorf("validate() must accept 0 for the default: %v", err)
+	}
+	if err := (GrantPrefixes{IPv4: -1}).validate(); err == nil || !strings.Contains(err.Error(), "or 0 for the default") {
+		t.Errorf("validate() of a negative prefix = %v", err)
+	}
+}
+
+func Test_persistentStore_prefixGrant(t *testing.T) {
+	m, _ := newDeviceApp(t)
+	m.store.grants = GrantPrefixes{IPv6: 64}
+	rng, err := m.store.allowUserIP(zap.NewNop(), "", "ddk", "2001:db8:1:2::1", time.Hour)
+	if err != nil || rng != "2001:db8:1:2::/64" {
+		t.Fatalf("allowUserIP() = %q, %v", rng, err)
+	}
+	if !m.store.isIPAllowed(zap.NewNop(), "2001:db8:1:2:aaaa:bbbb:cccc:dddd", "") {
+		t.Errorf("a rotated address in the granted prefix must be allowed")
+	}
+	if m.store.isIPAllowed(zap.NewNop(), "2001:db8:1:3::1", "") {
+		t.Errorf("an address outside the granted prefix must not be allowed")
+	}
+}
+
+func Test_listGrants(t *testing.T) {
+	m, _ := newDeviceApp(t)
+	m.Admins = []string{"admin"}
+	m.store.grants = GrantPrefixes{IPv6: 64}
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "ddk", "2001:db8:1:2::1", time.Hour)
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "other", "192.0.2.10", time.Hour)
+
+	request := func(uid string) *httptest.ResponseRecorder {
+		cw := httptest.NewRecorder()
+		m.secCookie.set(cw, cookieData{uidField: uid, authorizedField: m.clock.Now().Unix()})
+		r := httptest.NewRequest(http.MethodGet, "https://auth.example.com/admin/grants?__dm_request__=1", nil)
+		for _, c := range cw.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		w := httptest.NewRecorder()
+		m.listGrants(w, r)
+		return w
+	}
+
+	if w := request("ddk"); w.Code != http.StatusForbidden {
+		t.Errorf("listGrants() for a user = %d, want %d", w.Code, http.StatusForbidden)
+	}
+	w := request("admin")
+	if w.Code != http.StatusOK {
+		t.Fatalf("listGrants() for an admin = %d", w.Code)
+	}
+	var grants []grant
+	if err := json.NewDecoder(w.Body).Decode(&grants); err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 2 || grants[0].Range != "192.0.2.10" || grants[0].UID != "other" || grants[1].Range != "2001:db8:1:2::/64" || grants[1].UID != "ddk" {
+		t.Errorf("listGrants() = %+v", grants)
+	}
+}
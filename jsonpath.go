@@ -0,0 +1,68 @@
+package doorman
+
+import (
+	"strconv"
+	"strings"
+)
+
+// jsonPathValues returns all values of a decoded JSON document at the given
+// path. A path is a dot separated list of keys, optionally starting with
+// '$'; arrays on the way are flattened, so "prefixes.ip_prefix" returns the
+// ip_prefix of every element of the prefixes array.
+func jsonPathValues(v interface{}, path string) []interface{} {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	var parts []string
+	if path != "" {
+		parts = strings.Split(path, ".")
+	}
+	return lookupJSONPath(v, parts)
+}
+
+func lookupJSONPath(v interface{}, parts []string) []interface{} {
+	switch t := v.(type) {
+	case []interface{}:
+		var res []interface{}
+		for _, e := range t {
+			res = append(res, lookupJSONPath(e, parts)...)
+		}
+		return res
+	case map[string]interface{}:
+		if len(parts) == 0 {
+			return []interface{}{t}
+		}
+		c, ok := t[parts[0]]
+		if !ok {
+			return nil
+		}
+		return lookupJSONPath(c, parts[1:])
+	default:
+		if len(parts) == 0 {
+			return []interface{}{t}
+		}
+		return nil
+	}
+}
+
+// jsonPathStrings returns all string values at the given path.
+func jsonPathStrings(v interface{}, path string) []string {
+	var res []string
+	for _, r := range jsonPathValues(v, path) {
+		if s, ok := r.(string); ok {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// jsonPathString returns the first string or number at the given path.
+func jsonPathString(v interface{}, path string) string {
+	for _, r := range jsonPathValues(v, path) {
+		switch t := r.(type) {
+		case string:
+			return t
+		case float64:
+			return strconv.FormatFloat(t, 'f', -1, 64)
+		}
+	}
+	return ""
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -86,17 +88,23 @@ type kvstore interface {
 	Get(log *zap.Logger, key string) (string, error)
 	Has(log *zap.Logger, key string) bool
 	Del(log *zap.Logger, key string)
+	Incr(log *zap.Logger, key string, ttl time.Duration) (int64, error)
+	Keys(log *zap.Logger, prefix string) ([]string, error)
 	Block(log *zap.Logger, key string, ttl time.Duration) (*yesNoWaiter, error)
 	Unblock(log *zap.Logger, key string, val yesno, ttl time.Duration) error
 }
 
+// memstoreSweepInterval is the time between two sweeps of the expired keys.
+const memstoreSweepInterval = time.Minute
+
 type memstore struct {
 	sync.RWMutex
-	cl       clock.Clock
-	data     map[string]ttlValue
-	rawdata  map[string]string
-	locks    map[string]*yesNoWaiter
-	settings StoreSettings
+	cl        clock.Clock
+	data      map[string]ttlValue
+	rawdata   map[string]string
+	locks     map[string]*yesNoWaiter
+	settings  StoreSettings
+	nextSweep time.Time
 }
 
 func newMemstore(cl clock.Clock, sst StoreSettings) *memstore {
@@ -112,6 +120,7 @@ func (ms *memstore) PutTTL(log *zap.Logger, key, value string, ttl time.Duration
 	ms.Lock()
 	defer ms.Unlock()
 
+	ms.sweep()
 	until := ms.cl.Now().Add(ttl)
 	if value == "" {
 		value = until.UTC().Format(time.RFC3339)
@@ -175,6 +184,64 @@ func (ms *memstore) Del(log *zap.Logger, key string) {
 	defer ms.Unlock()
 
 	delete(ms.rawdata, key)
+	delete(ms.data, key)
+}
+
+// Incr increments the counter of the key. The ttl starts with the first
+// increment and is not extended by the following ones.
+func (ms *memstore) Incr(log *zap.Logger, key string, ttl time.Duration) (int64, error) {
+	ms.Lock()
+	defer ms.Unlock()
+
+	now := ms.cl.Now().UTC()
+	v, ok := ms.data[key]
+	if !ok || now.Unix() >= v.Until {
+		v = ttlValue{Value: "0", Until: now.Add(ttl).Unix()}
+	}
+	n, err := strconv.ParseInt(v.Value, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a counter: %w", key, err)
+	}
+	n++
+	v.Value = strconv.FormatInt(n, 10)
+	ms.data[key] = v
+	return n, nil
+}
+
+// Keys returns the keys with the given prefix; expired keys are skipped.
+func (ms *memstore) Keys(log *zap.Logger, prefix string) ([]string, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+
+	now := ms.cl.Now().UTC().Unix()
+	var res []string
+	for k, v := range ms.data {
+		if strings.HasPrefix(k, prefix) && now < v.Until {
+			res = append(res, k)
+		}
+	}
+	for k := range ms.rawdata {
+		if strings.HasPrefix(k, prefix) {
+			res = append(res, k)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// sweep deletes the expired keys which were never read again, like the
+// negative entries of the user cache. The caller holds the lock.
+func (ms *memstore) sweep() {
+	now := ms.cl.Now()
+	if now.Before(ms.nextSweep) {
+		return
+	}
+	ms.nextSweep = now.Add(memstoreSweepInterval)
+	for k, v := range ms.data {
+		if now.UTC().Unix() >= v.Until {
+			delete(ms.data, k)
+		}
+	}
 }
 
 func (ms *memstore) delKey(key string) {
@@ -301,6 +368,39 @@ func (rs *redisStore) Has(log *zap.Logger, key string) bool {
 
 func (rs *redisStore) Del(log *zap.Logger, key string) {
 	_, _ = rs.rc.Del(context.Background(), key).Result()
+	// the local cache would still return the value until it expires
+	_ = rs.cache.Remove(context.Background(), key)
+}
+
+// Incr increments the counter of the key. The ttl starts with the first
+// increment and is not extended by the following ones.
+func (rs *redisStore) Incr(log *zap.Logger, key string, ttl time.Duration) (int64, error) {
+	ctx := context.Background()
+	n, err := rs.rc.Incr(ctx, key).Result()
+	if err != nil {
+		return 0, fmt.Errorf("cannot increment %q: %w", key, err)
+	}
+	if n == 1 {
+		if err := rs.rc.Expire(ctx, key, ttl).Err(); err != nil {
+			return n, fmt.Errorf("cannot expire %q: %w", key, err)
+		}
+	}
+	return n, nil
+}
+
+// Keys returns the keys with the given prefix. It uses SCAN, so it does not
+// block the server with large databases.
+func (rs *redisStore) Keys(log *zap.Logger, prefix string) ([]string, error) {
+	var res []string
+	iter := rs.rc.Scan(context.Background(), 0, prefix+"*", 100).Iterator()
+	for iter.Next(context.Background()) {
+		res = append(res, iter.Val())
+	}
+	if err := iter.Err(); err != nil {
+		return nil, fmt.Errorf("cannot scan keys: %w", err)
+	}
+	sort.Strings(res)
+	return res, nil
 }
 
 func (rs *redisStore) getTTL(ctx context.Context, log *zap.Logger, key string) (string, *time.Time, error) {
@@ -199,3 +199,29 @@ func Test_YesNoWaiter(t *testing.T) {
 		})
 	}
 }
+
+func Test_memstore_Incr(t *testing.T) {
+	lg := zap.NewNop()
+	mock := clock.NewMock()
+	ms := newMemstore(mock, StoreSettings{})
+	for want := int64(1); want <= 3; want++ {
+		n, err := ms.Incr(lg, "counter", time.Minute)
+		if err != nil || n != want {
+			t.Fatalf("Incr() = %d, %v, want %d", n, err, want)
+		}
+		mock.Add(15 * time.Second)
+	}
+	// the ttl is not extended by the increments
+	mock.Add(15 * time.Second)
+	if n, _ := ms.Incr(lg, "counter", time.Minute); n != 1 {
+		t.Errorf("Incr() after the ttl = %d, want 1", n)
+	}
+	ms.Del(lg, "counter")
+	if n, _ := ms.Incr(lg, "counter", time.Minute); n != 1 {
+		t.Errorf("Incr() after Del() = %d, want 1", n)
+	}
+	_ = ms.PutTTL(lg, "text", "value", time.Minute)
+	if _, err := ms.Incr(lg, "text", time.Minute); err == nil {
+		t.Errorf("Incr() of a text value must fail")
+	}
+}
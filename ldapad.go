@@ -0,0 +1,129 @@
+package doorman
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-ldap/ldap"
+	"go.uber.org/zap"
+)
+
+const (
+	flavorLdap = ""
+	flavorAD   = "ad"
+
+	adUID                = "sAMAccountName"
+	adUserFilter         = "(&(objectCategory=person)(objectClass=user)(|(sAMAccountName={uid})(userPrincipalName={uid})))"
+	adUserAccountControl = "userAccountControl"
+	adPageSize           = 500
+	// ACCOUNTDISABLE flag of userAccountControl
+	adAccountDisabled = 0x2
+)
+
+var (
+	dialReferral = func(cfg *ldapConfiguration, srv string) (ldapsearcher, error) {
+		return cfg.dial(srv)
+	}
+	// a trunk prefix like in +49 (0)89 123456
+	trunkPrefix = strings.NewReplacer("(0)", "")
+)
+
+// initFlavor sets the defaults of the flavor for the empty values, it is
+// called before the common defaults are set.
+func (cfg *ldapConfiguration) initFlavor() {
+	if cfg.Flavor != flavorAD {
+		return
+	}
+	cfg.UIDAttribute = setdefault(cfg.UIDAttribute, adUID)
+	cfg.UserFilter = setdefault(cfg.UserFilter, adUserFilter)
+	cfg.TelephoneAttribute = setdefault(cfg.TelephoneAttribute, defaultTelephone)
+	cfg.NestedGroups = true
+	if cfg.PageSize == 0 {
+		cfg.PageSize = adPageSize
+	}
+}
+
+// disabled returns true if the entry is a disabled active directory account.
+func (cfg *ldapConfiguration) disabled(e *ldap.Entry) bool {
+	if cfg.Flavor != flavorAD {
+		return false
+	}
+	uac, err := strconv.ParseInt(e.GetAttributeValue(adUserAccountControl), 10, 64)
+	return err == nil && uac&adAccountDisabled != 0
+}
+
+// phone returns the digits of a phone number. Active directory contains
+// numbers like +49 (0)89 123-456, they keep the plus sign; the ldap flavor
+// replaces it with 00.
+func (cfg *ldapConfiguration) phone(s string) string {
+	if cfg.Flavor == flavorAD {
+		s = trunkPrefix.Replace(strings.TrimSpace(s))
+		var b strings.Builder
+		for i, r := range s {
+			if (r >= '0' && r <= '9') || (r == '+' && i == 0) {
+				b.WriteRune(r)
+			}
+		}
+		return b.String()
+	}
+	s = strings.ReplaceAll(s, "+", "00")
+	return onlynum.ReplaceAllString(s, "")
+}
+
+// searchAll runs the search with paging if a page size is set. The entries
+// of referrals are added when follow_referrals is set; referrals of the
+// referred servers are not followed.
+func (cfg *ldapConfiguration) searchAll(lg *zap.Logger, con ldapsearcher, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	sr, err := cfg.searchPaged(con, req)
+	if err != nil {
+		return nil, err
+	}
+	if !cfg.FollowReferrals {
+		return sr, nil
+	}
+	for _, ref := range sr.Referrals {
+		entries, err := cfg.searchReferral(lg, ref, req)
+		if err != nil {
+			// the other servers of a forest may be unreachable, the
+			// entries of the own server are still valid
+			lg.Warn("cannot follow referral", zap.String("referral", ref), zap.Error(err))
+			continue
+		}
+		sr.Entries = append(sr.Entries, entries...)
+	}
+	return sr, nil
+}
+
+func (cfg *ldapConfiguration) searchPaged(con ldapsearcher, req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	if cfg.PageSize > 0 {
+		return con.SearchWithPaging(req, cfg.PageSize)
+	}
+	return con.Search(req)
+}
+
+func (cfg *ldapConfiguration) searchReferral(lg *zap.Logger, ref string, req *ldap.SearchRequest) ([]*ldap.Entry, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, fmt.Errorf("illegal referral: %w", err)
+	}
+	base := strings.TrimPrefix(u.Path, "/")
+	if base == "" {
+		base = req.BaseDN
+	}
+	con, err := dialReferral(cfg, u.Scheme+"://"+u.Host)
+	if err != nil {
+		return nil, err
+	}
+	defer con.Close()
+	lg.Debug("follow referral", zap.String("referral", ref), zap.String("base", base))
+	rr := *req
+	rr.BaseDN = base
+	rr.Controls = nil
+	sr, err := cfg.searchPaged(con, &rr)
+	if err != nil {
+		return nil, err
+	}
+	return sr.Entries, nil
+}
@@ -0,0 +1,213 @@
+package doorman
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-ldap/ldap"
+	"go.uber.org/zap"
+)
+
+// adconnection answers the user search with the user and the group search
+// with the groups, both with the referrals of the connection.
+type adconnection struct {
+	user      *ldap.Entry
+	groups    []*ldap.Entry
+	referrals []string
+
+	filters []string
+	bases   []string
+	pages   []uint32
+}
+
+func (ac *adconnection) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	return ac.SearchWithPaging(req, 0)
+}
+
+func (ac *adconnection) SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	ac.filters = append(ac.filters, req.Filter)
+	ac.bases = append(ac.bases, req.BaseDN)
+	ac.pages = append(ac.pages, pagingSize)
+	res := &ldap.SearchResult{Referrals: ac.referrals}
+	if strings.Contains(req.Filter, "member") {
+		res.Entries = ac.groups
+	} else if ac.user != nil {
+		res.Entries = []*ldap.Entry{ac.user}
+	}
+	return res, nil
+}
+
+func (ac *adconnection) Bind(username, password string) error { return nil }
+
+func (ac *adconnection) Close() {}
+
+func adUser(uac string) *ldap.Entry {
+	return ldap.NewEntry("CN=Jane Doe,OU=People,DC=example,DC=com", map[string][]string{
+		adUID:                {"jdoe"},
+		"userPrincipalName":  {"jdoe@example.com"},
+		defaultMobile:        {"+49 (0)171 123-4567"},
+		defaultTelephone:     {"+49 89 1234 5"},
+		defaultEMail:         {"jane.doe@example.com"},
+		defaultName:          {"Jane Doe"},
+		adUserAccountControl: {uac},
+	})
+}
+
+func adGroup(cn string) *ldap.Entry {
+	return ldap.NewEntry("CN="+cn+",OU=Groups,DC=example,DC=com", map[string][]string{defaultGroupName: {cn}})
+}
+
+func newADConfiguration(t *testing.T, con ldapsearcher) *ldapConfiguration {
+	getConnection = func(_ *zap.Logger, cfg *ldapConfiguration) (ldapsearcher, error) {
+		return con, nil
+	}
+	cfg := (&ldapConfiguration{Flavor: flavorAD, SearchBase: "DC=example,DC=com"}).init(caddy.NewReplacer())
+	if err := cfg.start(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func Test_ldapConfiguration_initAD(t *testing.T) {
+	cfg := (&ldapConfiguration{Flavor: flavorAD}).init(caddy.NewReplacer())
+	if cfg.UIDAttribute != adUID || cfg.UserFilter != adUserFilter {
+		t.Errorf("uid attribute %q, filter %q are not the defaults of active directory", cfg.UIDAttribute, cfg.UserFilter)
+	}
+	if !cfg.NestedGroups || cfg.GroupFilter != nestedGroupFilter || cfg.PageSize != adPageSize {
+		t.Errorf("active directory must search nested groups with paging: %v, %q, %d", cfg.NestedGroups, cfg.GroupFilter, cfg.PageSize)
+	}
+	cfg = (&ldapConfiguration{Flavor: flavorAD, UIDAttribute: "employeeID", PageSize: 100}).init(caddy.NewReplacer())
+	if cfg.UIDAttribute != "employeeID" || cfg.UserFilter != adUserFilter || cfg.PageSize != 100 {
+		t.Errorf("configured values must not be overwritten: %q, %d", cfg.UIDAttribute, cfg.PageSize)
+	}
+	if err := (&ldapConfiguration{Flavor: "openldap"}).init(caddy.NewReplacer()).start(); err == nil {
+		t.Errorf("an unknown flavor must be rejected")
+	}
+}
+
+func Test_ldapConfiguration_SearchAD(t *testing.T) {
+	tests := []struct {
+		name       string
+		uid        string
+		uac        string
+		wantFilter string
+		wantNoUser bool
+	}{
+		{
+			name:       "sAMAccountName",
+			uid:        "jdoe",
+			uac:        "512",
+			wantFilter: "(&(objectCategory=person)(objectClass=user)(|(sAMAccountName=jdoe)(userPrincipalName=jdoe)))",
+		},
+		{
+			name:       "userPrincipalName",
+			uid:        "jdoe@example.com",
+			uac:        "66048",
+			wantFilter: "(&(objectCategory=person)(objectClass=user)(|(sAMAccountName=jdoe@example.com)(userPrincipalName=jdoe@example.com)))",
+		},
+		{name: "disabled", uid: "jdoe", uac: "514", wantNoUser: true},
+		{name: "disabled with password never expires", uid: "jdoe", uac: "66050", wantNoUser: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			con := &adconnection{user: adUser(tt.uac), groups: []*ldap.Entry{adGroup("wiki"), adGroup("Staff")}}
+			cfg := newADConfiguration(t, con)
+			ue, err := cfg.Search(zap.NewNop(), tt.uid)
+			if tt.wantNoUser {
+				if !errors.Is(err, ErrNoUser) {
+					t.Errorf("Search() error = %v, want ErrNoUser", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+			want := &UserEntry{
+				UID:       "jdoe",
+				Name:      "Jane Doe",
+				EMail:     "jane.doe@example.com",
+				Mobile:    "+491711234567",
+				Telephone: "+498912345",
+				Groups:    []string{"wiki", "Staff"},
+			}
+			if !reflect.DeepEqual(ue, want) {
+				t.Errorf("Search() = %+v, want %+v", ue, want)
+			}
+			if con.filters[0] != tt.wantFilter {
+				t.Errorf("user filter = %q, want %q", con.filters[0], tt.wantFilter)
+			}
+			wantGroups := `(member:1.2.840.113556.1.4.1941:=CN=Jane Doe,OU=People,DC=example,DC=com)`
+			if len(con.filters) != 2 || con.filters[1] != wantGroups {
+				t.Errorf("group filters = %v, want %q", con.filters, wantGroups)
+			}
+			if !reflect.DeepEqual(con.pages, []uint32{adPageSize, adPageSize}) {
+				t.Errorf("paging sizes = %v, want paged searches", con.pages)
+			}
+		})
+	}
+}
+
+func Test_ldapConfiguration_referrals(t *testing.T) {
+	child := &adconnection{groups: []*ldap.Entry{adGroup("child-admins")}}
+	var dialed []string
+	defer func(d func(*ldapConfiguration, string) (ldapsearcher, error)) { dialReferral = d }(dialReferral)
+	dialReferral = func(cfg *ldapConfiguration, srv string) (ldapsearcher, error) {
+		dialed = append(dialed, srv)
+		if srv == "ldap://child.example.com" {
+			return child, nil
+		}
+		return nil, ErrNoConnection
+	}
+	con := &adconnection{
+		user:   adUser("512"),
+		groups: []*ldap.Entry{adGroup("wiki")},
+		referrals: []string{
+			"ldap://child.example.com/DC=child,DC=example,DC=com",
+			"ldap://offline.example.com/DC=offline,DC=example,DC=com",
+		},
+	}
+
+	cfg := newADConfiguration(t, con)
+	ue, err := cfg.Search(zap.NewNop(), "jdoe")
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	if !reflect.DeepEqual(ue.Groups, []string{"wiki"}) || len(dialed) != 0 {
+		t.Errorf("referrals must not be followed by default: %v, %v", ue.Groups, dialed)
+	}
+
+	cfg.FollowReferrals = true
+	ue, err = cfg.Search(zap.NewNop(), "jdoe")
+	if err != nil {
+		t.Fatalf("Search() error = %v", err)
+	}
+	if !reflect.DeepEqual(ue.Groups, []string{"wiki", "child-admins"}) {
+		t.Errorf("Groups = %v, want the groups of the referral", ue.Groups)
+	}
+	if !reflect.DeepEqual(child.bases, []string{"DC=child,DC=example,DC=com", "DC=child,DC=example,DC=com"}) {
+		t.Errorf("referral bases = %v, want the dn of the referral", child.bases)
+	}
+}
+
+func Test_ldapConfiguration_phone(t *testing.T) {
+	tests := []struct {
+		flavor string
+		number string
+		want   string
+	}{
+		{flavor: flavorLdap, number: "+49 171 1234567", want: "00491711234567"},
+		{flavor: flavorLdap, number: "0171/1234567", want: "01711234567"},
+		{flavor: flavorAD, number: "+49 (0)171 123-4567", want: "+491711234567"},
+		{flavor: flavorAD, number: " +1 (555) 010-9999 ", want: "+15550109999"},
+		{flavor: flavorAD, number: "0171/1234567", want: "01711234567"},
+	}
+	for _, tt := range tests {
+		cfg := &ldapConfiguration{Flavor: tt.flavor}
+		if got := cfg.phone(tt.number); got != tt.want {
+			t.Errorf("phone(%q) with flavor %q = %q, want %q", tt.number, tt.flavor, got, tt.want)
+		}
+	}
+}
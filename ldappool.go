@@ -0,0 +1,298 @@
+package doorman
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/go-ldap/ldap"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultLdapPoolSize    = 4
+	defaultLdapIdleTimeout = Duration(5 * time.Minute)
+	defaultLdapTimeout     = Duration(10 * time.Second)
+	defaultLdapBackoff     = 5 * time.Second
+	maxLdapBackoff         = 5 * time.Minute
+	// an idle connection is checked with a search of the root DSE before it
+	// is used again, the server or a firewall may have dropped it silently
+	ldapCheckAfterIdle = 30 * time.Second
+)
+
+// pooledConn is a bound connection in the pool.
+type pooledConn struct {
+	ldapsearcher
+	used time.Time
+}
+
+// ldapPool keeps up to size bound connections. A connection which was idle
+// for too long, was closed by the server or fails the health check is not
+// used again.
+type ldapPool struct {
+	clock   clock.Clock
+	idle    time.Duration
+	timeout time.Duration
+	slots   chan struct{}
+
+	mu     sync.Mutex
+	conns  []*pooledConn
+	closed bool
+}
+
+func newLdapPool(cl clock.Clock, size int, idle, timeout time.Duration) *ldapPool {
+	return &ldapPool{
+		clock:   cl,
+		idle:    idle,
+		timeout: timeout,
+		slots:   make(chan struct{}, size),
+	}
+}
+
+func isClosing(con ldapsearcher) bool {
+	c, ok := con.(interface{ IsClosing() bool })
+	return ok && c.IsClosing()
+}
+
+// healthy checks a connection which was idle for a while with a search of
+// the root DSE, which every server answers without a special permission.
+func (p *ldapPool) healthy(pc *pooledConn) bool {
+	if isClosing(pc.ldapsearcher) {
+		return false
+	}
+	if p.clock.Since(pc.used) < ldapCheckAfterIdle {
+		return true
+	}
+	_, err := pc.Search(ldap.NewSearchRequest(
+		"",
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, int(p.timeout.Seconds()), false,
+		"(objectClass=*)",
+		[]string{"1.1"},
+		nil,
+	))
+	return err == nil
+}
+
+// get returns an idle connection or dials a new one. It waits for a free
+// slot if all connections are in use.
+func (p *ldapPool) get(dial func() (ldapsearcher, error)) (*pooledConn, error) {
+	t := p.clock.Timer(p.timeout)
+	defer t.Stop()
+	select {
+	case p.slots <- struct{}{}:
+	case <-t.C:
+		return nil, fmt.Errorf("%w: all ldap connections are in use", ErrNoConnection)
+	}
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		<-p.slots
+		return nil, fmt.Errorf("%w: ldap pool is closed", ErrNoConnection)
+	}
+	for len(p.conns) > 0 {
+		pc := p.conns[len(p.conns)-1]
+		p.conns = p.conns[:len(p.conns)-1]
+		if p.clock.Since(pc.used) > p.idle {
+			pc.Close()
+			continue
+		}
+		p.mu.Unlock()
+		if p.healthy(pc) {
+			return pc, nil
+		}
+		pc.Close()
+		p.mu.Lock()
+	}
+	p.mu.Unlock()
+	con, err := dial()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return &pooledConn{ldapsearcher: con}, nil
+}
+
+// put gives the connection back to the pool, a broken connection or one of
+// a closed pool is closed.
+func (p *ldapPool) put(pc *pooledConn, broken bool) {
+	defer func() { <-p.slots }()
+	if broken || isClosing(pc.ldapsearcher) {
+		pc.Close()
+		return
+	}
+	pc.used = p.clock.Now()
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		pc.Close()
+		return
+	}
+	p.conns = append(p.conns, pc)
+}
+
+// close closes the idle connections; the connections in use are closed when
+// they are put back.
+func (p *ldapPool) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, pc := range p.conns {
+		pc.Close()
+	}
+	p.conns = nil
+}
+
+type serverBackoff struct {
+	until   time.Time
+	backoff time.Duration
+}
+
+// ldapServers remembers the servers which failed. A failed server is tried
+// after all other servers until its back-off is over; the back-off doubles
+// with every failure.
+type ldapServers struct {
+	clock clock.Clock
+	mu    sync.Mutex
+	down  map[string]*serverBackoff
+}
+
+func newLdapServers(cl clock.Clock) *ldapServers {
+	return &ldapServers{clock: cl, down: make(map[string]*serverBackoff)}
+}
+
+// order returns the servers in the configured order, the servers in their
+// back-off are moved to the end.
+func (s *ldapServers) order(servers []string) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	var up, down []string
+	for _, srv := range servers {
+		if b, ok := s.down[srv]; ok && now.Before(b.until) {
+			down = append(down, srv)
+			continue
+		}
+		up = append(up, srv)
+	}
+	return append(up, down...)
+}
+
+func (s *ldapServers) failed(srv string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	b, ok := s.down[srv]
+	if !ok {
+		b = &serverBackoff{backoff: defaultLdapBackoff}
+		s.down[srv] = b
+	} else if b.backoff < maxLdapBackoff {
+		b.backoff *= 2
+		if b.backoff > maxLdapBackoff {
+			b.backoff = maxLdapBackoff
+		}
+	}
+	b.until = s.clock.Now().Add(b.backoff)
+}
+
+func (s *ldapServers) succeeded(srv string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.down, srv)
+}
+
+// serverURLs returns the configured servers; without servers the address is
+// used with the scheme of the tls flag.
+func (cfg *ldapConfiguration) serverURLs() []string {
+	if len(cfg.Servers) > 0 {
+		return cfg.Servers
+	}
+	if cfg.TLS {
+		return []string{"ldaps://" + cfg.Address}
+	}
+	return []string{"ldap://" + cfg.Address}
+}
+
+// start checks the flavor and loads the certificates for TLS connections.
+func (cfg *ldapConfiguration) start() error {
+	if cfg.Flavor != flavorLdap && cfg.Flavor != flavorAD {
+		return fmt.Errorf("unknown ldap flavor: %q", cfg.Flavor)
+	}
+	tc, err := newTLSConfig(cfg.CAFile, cfg.CertFile, cfg.KeyFile, cfg.InsecureSkip)
+	if err != nil {
+		return fmt.Errorf("ldap: %w", err)
+	}
+	cfg.tlsConfig = tc
+	return nil
+}
+
+// dial connects to the server, starts TLS if needed and binds with the
+// configured user.
+func (cfg *ldapConfiguration) dial(srv string) (*ldap.Conn, error) {
+	u, err := url.Parse(srv)
+	if err != nil {
+		return nil, fmt.Errorf("illegal ldap server url %q: %w", srv, err)
+	}
+	host, port, err := net.SplitHostPort(u.Host)
+	if err != nil {
+		host, port = u.Host, ""
+	}
+	tc := &tls.Config{InsecureSkipVerify: cfg.InsecureSkip}
+	if cfg.tlsConfig != nil {
+		tc = cfg.tlsConfig.Clone()
+	}
+	tc.ServerName = host
+	timeout := time.Duration(cfg.Timeout)
+	dialer := &net.Dialer{Timeout: timeout}
+	var c net.Conn
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = ldap.DefaultLdapPort
+		}
+		c, err = dialer.Dial("tcp", net.JoinHostPort(host, port))
+	case "ldaps":
+		if port == "" {
+			port = ldap.DefaultLdapsPort
+		}
+		c, err = tls.DialWithDialer(dialer, "tcp", net.JoinHostPort(host, port), tc)
+	default:
+		return nil, fmt.Errorf("unknown scheme of ldap server url %q", srv)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to ldap server: %w", err)
+	}
+	con := ldap.NewConn(c, u.Scheme == "ldaps")
+	con.Start()
+	con.SetTimeout(timeout)
+	if cfg.StartTLS && u.Scheme == "ldap" {
+		if err := con.StartTLS(tc); err != nil {
+			con.Close()
+			return nil, fmt.Errorf("cannot start tls: %w", err)
+		}
+	}
+	// bind with a user to make queries
+	if err := con.Bind(cfg.User, cfg.Password); err != nil {
+		con.Close()
+		return nil, fmt.Errorf("cannot bind to ldap server: %w", err)
+	}
+	return con, nil
+}
+
+func initConnection(lg *zap.Logger, cfg *ldapConfiguration) (ldapsearcher, error) {
+	var lastErr error
+	for _, srv := range cfg.servers.order(cfg.serverURLs()) {
+		con, err := cfg.dial(srv)
+		if err != nil {
+			lg.Error("cannot connect to ldap server", zap.String("server", srv), zap.Error(err))
+			cfg.servers.failed(srv)
+			lastErr = err
+			continue
+		}
+		cfg.servers.succeeded(srv)
+		return con, nil
+	}
+	return nil, fmt.Errorf("%w: no ldap server available: %v", ErrNoConnection, lastErr)
+}
@@ -0,0 +1,462 @@
+package doorman
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-ldap/ldap"
+	"go.uber.org/zap"
+	ber "gopkg.in/asn1-ber.v1"
+)
+
+type poolconnection struct {
+	dummyconnection
+	id      int
+	closed  bool
+	closing bool
+}
+
+func (pc *poolconnection) Close() { pc.closed = true }
+
+func (pc *poolconnection) IsClosing() bool { return pc.closing }
+
+func countingDial(conns *[]*poolconnection) func() (ldapsearcher, error) {
+	return func() (ldapsearcher, error) {
+		c := &poolconnection{id: len(*conns)}
+		*conns = append(*conns, c)
+		return c, nil
+	}
+}
+
+// getTimedOut calls get on an exhausted pool and moves the mock clock until
+// the wait for a free slot times out.
+func getTimedOut(mock *clock.Mock, p *ldapPool, dial func() (ldapsearcher, error)) error {
+	done := make(chan error)
+	go func() {
+		_, err := p.get(dial)
+		done <- err
+	}()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-time.After(time.Millisecond):
+			mock.Add(p.timeout)
+		}
+	}
+}
+
+func Test_ldapPool_get(t *testing.T) {
+	mock := clock.NewMock()
+	p := newLdapPool(mock, 2, time.Minute, 50*time.Millisecond)
+	var conns []*poolconnection
+	dial := countingDial(&conns)
+
+	pc, err := p.get(dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.put(pc, false)
+	if pc2, _ := p.get(dial); pc2 != pc || len(conns) != 1 {
+		t.Errorf("an idle connection must be reused")
+	} else {
+		p.put(pc2, false)
+	}
+
+	mock.Add(2 * time.Minute)
+	pc, _ = p.get(dial)
+	if len(conns) != 2 || !conns[0].closed || pc.ldapsearcher != conns[1] {
+		t.Errorf("an expired connection must be closed and replaced")
+	}
+	conns[1].closing = true
+	p.put(pc, false)
+	if !conns[1].closed {
+		t.Errorf("a connection closed by the server must not go back to the pool")
+	}
+
+	pc, _ = p.get(dial)
+	p.put(pc, true)
+	if !conns[2].closed {
+		t.Errorf("a broken connection must be closed")
+	}
+
+	a, _ := p.get(dial)
+	b, _ := p.get(dial)
+	if err := getTimedOut(mock, p, dial); !errors.Is(err, ErrNoConnection) {
+		t.Errorf("get() on an exhausted pool = %v, want ErrNoConnection", err)
+	}
+	p.put(a, false)
+	p.put(b, false)
+
+	mock.Add(2 * time.Minute)
+	failing := func() (ldapsearcher, error) { return nil, ErrNoConnection }
+	if _, err := p.get(failing); err == nil || len(p.slots) != 0 {
+		t.Errorf("a failed dial must release its slot, %d slots in use", len(p.slots))
+	}
+}
+
+// probeconnection fails the search of the health check if it is dead.
+type probeconnection struct {
+	poolconnection
+	dead   bool
+	probes int
+}
+
+func (pc *probeconnection) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	pc.probes++
+	if pc.dead {
+		return nil, ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset"))
+	}
+	return &ldap.SearchResult{}, nil
+}
+
+func Test_ldapPool_healthCheck(t *testing.T) {
+	mock := clock.NewMock()
+	p := newLdapPool(mock, 2, time.Hour, 50*time.Millisecond)
+	var conns []*probeconnection
+	dial := func() (ldapsearcher, error) {
+		c := &probeconnection{}
+		conns = append(conns, c)
+		return c, nil
+	}
+
+	pc, _ := p.get(dial)
+	p.put(pc, false)
+	pc, _ = p.get(dial)
+	if conns[0].probes != 0 {
+		t.Errorf("a connection which was just used must not be checked")
+	}
+	p.put(pc, false)
+
+	mock.Add(time.Minute)
+	pc, _ = p.get(dial)
+	if len(conns) != 1 || conns[0].probes != 1 {
+		t.Errorf("a healthy idle connection must be checked and reused, %d connections", len(conns))
+	}
+	p.put(pc, false)
+
+	mock.Add(time.Minute)
+	conns[0].dead = true
+	pc, _ = p.get(dial)
+	if len(conns) != 2 || !conns[0].closed || pc.ldapsearcher != conns[1] {
+		t.Errorf("a dead idle connection must be closed and replaced")
+	}
+	p.put(pc, false)
+}
+
+func Test_ldapPool_close(t *testing.T) {
+	p := newLdapPool(clock.NewMock(), 2, time.Hour, 50*time.Millisecond)
+	var conns []*poolconnection
+	dial := countingDial(&conns)
+
+	idle, _ := p.get(dial)
+	inuse, _ := p.get(dial)
+	p.put(idle, false)
+
+	ulb := &userBackends{searchers: []userSearcher{&ldapConfiguration{pool: p}, &userlistBackend{}}}
+	ulb.close()
+	if !conns[0].closed || conns[1].closed {
+		t.Errorf("close() must close the idle connections only")
+	}
+	p.put(inuse, false)
+	if !conns[1].closed {
+		t.Errorf("a connection put back to a closed pool must be closed")
+	}
+	if _, err := p.get(dial); !errors.Is(err, ErrNoConnection) || len(conns) != 2 {
+		t.Errorf("get() of a closed pool = %v", err)
+	}
+}
+
+func Test_ldapServers_order(t *testing.T) {
+	mock := clock.NewMock()
+	s := newLdapServers(mock)
+	servers := []string{"ldap://a", "ldap://b", "ldap://c"}
+
+	if got := s.order(servers); !reflect.DeepEqual(got, servers) {
+		t.Errorf("order() = %v, want %v", got, servers)
+	}
+	s.failed("ldap://a")
+	want := []string{"ldap://b", "ldap://c", "ldap://a"}
+	if got := s.order(servers); !reflect.DeepEqual(got, want) {
+		t.Errorf("order() with a failed server = %v, want %v", got, want)
+	}
+	mock.Add(defaultLdapBackoff)
+	if got := s.order(servers); !reflect.DeepEqual(got, servers) {
+		t.Errorf("order() after the back-off = %v, want %v", got, servers)
+	}
+	s.failed("ldap://a")
+	mock.Add(defaultLdapBackoff)
+	if got := s.order(servers); !reflect.DeepEqual(got, want) {
+		t.Errorf("the back-off must double after the next failure: %v", got)
+	}
+	for i := 0; i < 20; i++ {
+		s.failed("ldap://a")
+	}
+	if b := s.down["ldap://a"].backoff; b != maxLdapBackoff {
+		t.Errorf("back-off = %v, want at most %v", b, maxLdapBackoff)
+	}
+	s.succeeded("ldap://a")
+	if got := s.order(servers); !reflect.DeepEqual(got, servers) {
+		t.Errorf("order() after success = %v, want %v", got, servers)
+	}
+}
+
+func Test_ldapConfiguration_Search_retry(t *testing.T) {
+	res := createLDAPSearchResult(map[string]string{defaultUID: "test"}, 1)
+	var conns []*dummyconnection
+	getConnection = func(_ *zap.Logger, cfg *ldapConfiguration) (ldapsearcher, error) {
+		c := &dummyconnection{result: res}
+		if len(conns) == 0 {
+			c.err = fmt.Errorf("connection closed")
+		}
+		conns = append(conns, c)
+		return c, nil
+	}
+	ld := (&ldapConfiguration{}).init(caddy.NewReplacer())
+	ue, err := ld.Search(zap.NewNop(), "test")
+	if err != nil || ue.UID != "test" {
+		t.Fatalf("Search() = %v, %v", ue, err)
+	}
+	if len(conns) != 2 {
+		t.Errorf("the search must be repeated with a new connection, got %d connections", len(conns))
+	}
+	if _, err := ld.Search(zap.NewNop(), "test"); err != nil || len(conns) != 2 {
+		t.Errorf("the next search must reuse the pooled connection")
+	}
+}
+
+// fakeLdapServer answers bind and StartTLS requests.
+type fakeLdapServer struct {
+	ln  net.Listener
+	tls *tls.Config
+
+	mu         sync.Mutex
+	ops        []string
+	clientCert string
+}
+
+func newFakeLdapServer(t *testing.T, tc *tls.Config) *fakeLdapServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &fakeLdapServer{ln: ln, tls: tc}
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeLdapServer) record(op string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ops = append(s.ops, op)
+}
+
+func (s *fakeLdapServer) operations() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.ops...)
+}
+
+func ldapResponse(id interface{}, tag ber.Tag, code int) []byte {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagInteger, id, "MessageID"))
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Response")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimitive, ber.TagEnumerated, code, "resultCode"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "matchedDN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimitive, ber.TagOctetString, "", "diagnosticMessage"))
+	p.AppendChild(op)
+	return p.Bytes()
+}
+
+func (s *fakeLdapServer) serve(c net.Conn) {
+	defer func() { c.Close() }()
+	for {
+		p, err := ber.ReadPacket(c)
+		if err != nil || len(p.Children) < 2 {
+			return
+		}
+		id := p.Children[0].Value
+		switch p.Children[1].Tag {
+		case ldap.ApplicationBindRequest:
+			s.record("bind")
+			code := ldap.LDAPResultSuccess
+			if len(p.Children[1].Children) < 3 || p.Children[1].Children[2].Data.String() != "secret" {
+				code = ldap.LDAPResultInvalidCredentials
+			}
+			if _, err := c.Write(ldapResponse(id, ldap.ApplicationBindResponse, code)); err != nil {
+				return
+			}
+		case ldap.ApplicationExtendedRequest:
+			s.record("starttls")
+			if _, err := c.Write(ldapResponse(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess)); err != nil {
+				return
+			}
+			tc := tls.Server(c, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			if certs := tc.ConnectionState().PeerCertificates; len(certs) > 0 {
+				s.mu.Lock()
+				s.clientCert = certs[0].Subject.CommonName
+				s.mu.Unlock()
+			}
+			c = tc
+		default:
+			return
+		}
+	}
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte) {
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_initConnection_startTLS(t *testing.T) {
+	ca := createTestCA(t, "ldap ca")
+	srv := createTestCert(t, &x509.Certificate{
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+	}, ca)
+	client := createClientCert(t, ca, "doorman")
+
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	writePEM(t, caFile, "CERTIFICATE", ca.cert.Raw)
+	writePEM(t, certFile, "CERTIFICATE", client.cert.Raw)
+	key, err := x509.MarshalECPrivateKey(client.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePEM(t, keyFile, "EC PRIVATE KEY", key)
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	fake := newFakeLdapServer(t, &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{srv.cert.Raw}, PrivateKey: srv.key}},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	// nothing listens on the first server
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadURL := "ldap://" + dead.Addr().String()
+	dead.Close()
+
+	cfg := (&ldapConfiguration{
+		Servers:  []string{deadURL, "ldap://" + fake.ln.Addr().String()},
+		StartTLS: true,
+		CAFile:   caFile,
+		CertFile: certFile,
+		KeyFile:  keyFile,
+		User:     "cn=doorman",
+		Password: "secret",
+	}).init(caddy.NewReplacer())
+	if err := cfg.start(); err != nil {
+		t.Fatal(err)
+	}
+	con, err := initConnection(zap.NewNop(), cfg)
+	if err != nil {
+		t.Fatalf("initConnection() error = %v", err)
+	}
+	con.Close()
+
+	if got := fake.operations(); !reflect.DeepEqual(got, []string{"starttls", "bind"}) {
+		t.Errorf("operations = %v, want starttls before bind", got)
+	}
+	fake.mu.Lock()
+	if fake.clientCert != "doorman" {
+		t.Errorf("client certificate = %q, want doorman", fake.clientCert)
+	}
+	fake.mu.Unlock()
+	if got := cfg.servers.order(cfg.Servers); got[0] == deadURL {
+		t.Errorf("the failed server must be tried last: %v", got)
+	}
+
+	cfg.Password = "wrong"
+	if _, err := initConnection(zap.NewNop(), cfg); !errors.Is(err, ErrNoConnection) {
+		t.Errorf("initConnection() with a wrong password = %v, want ErrNoConnection", err)
+	}
+
+	cfg.CAFile = certFile
+	cfg.CertFile, cfg.KeyFile = "", ""
+	if err := cfg.start(); err != nil {
+		t.Fatal(err)
+	}
+	cfg.Password = "secret"
+	if _, err := initConnection(zap.NewNop(), cfg); err == nil {
+		t.Errorf("a server with an unknown ca must be rejected")
+	}
+}
+
+func Test_ldapConfiguration_start(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := os.WriteFile(empty, []byte("no pem"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		cfg     *ldapConfiguration
+		wantErr bool
+	}{
+		{name: "no files", cfg: &ldapConfiguration{}},
+		{name: "missing ca file", cfg: &ldapConfiguration{CAFile: filepath.Join(dir, "missing.pem")}, wantErr: true},
+		{name: "no certificates", cfg: &ldapConfiguration{CAFile: empty}, wantErr: true},
+		{name: "cert without key", cfg: &ldapConfiguration{CertFile: empty}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.cfg.start(); (err != nil) != tt.wantErr {
+				t.Errorf("start() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_ldapConfiguration_serverURLs(t *testing.T) {
+	tests := []struct {
+		name string
+		cfg  *ldapConfiguration
+		want []string
+	}{
+		{name: "address", cfg: &ldapConfiguration{Address: "ldap.example.com:389"}, want: []string{"ldap://ldap.example.com:389"}},
+		{name: "tls address", cfg: &ldapConfiguration{Address: "ldap.example.com:636", TLS: true}, want: []string{"ldaps://ldap.example.com:636"}},
+		{name: "servers", cfg: &ldapConfiguration{Address: "ignored", Servers: []string{"ldaps://a", "ldap://b"}}, want: []string{"ldaps://a", "ldap://b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.serverURLs(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("serverURLs() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
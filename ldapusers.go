@@ -2,11 +2,14 @@ package doorman
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"regexp"
 	"strings"
 	"sync"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"github.com/caddyserver/caddy/v2"
 	"github.com/go-ldap/ldap"
 	"go.uber.org/zap"
@@ -15,6 +18,10 @@ import (
 var (
 	onlynum                        = regexp.MustCompile(`[^\w]`)
 	getConnection configInitialize = initConnection
+
+	// errStillBound marks a connection which is bound as a user and cannot
+	// be used again, but the call must not be retried
+	errStillBound = fmt.Errorf("connection is still bound as the user")
 )
 
 type configInitialize func(*zap.Logger, *ldapConfiguration) (ldapsearcher, error)
@@ -25,26 +32,54 @@ const (
 	defaultTelephone = "telephoneNumber"
 	defaultEMail     = "mail"
 	defaultName      = "displayName"
+
+	defaultGroupName   = "cn"
+	defaultGroupFilter = "(member={dn})"
+	// LDAP_MATCHING_RULE_IN_CHAIN of active directory also finds the
+	// groups of the groups of a user
+	nestedGroupFilter = "(member:1.2.840.113556.1.4.1941:={dn})"
 )
 
 type ldapConfiguration struct {
-	Address            string `json:"address"`
-	User               string `json:"user"`
-	Password           string `json:"password"`
-	SearchBase         string `json:"search_base"`
-	UIDAttribute       string `json:"uid_attributes"`
-	MobileAttribute    string `json:"mobile_attribute"`
-	TelephoneAttribute string `json:"telephone_attribute"`
-	EMailAttribute     string `json:"email_attribute"`
-	NameAttribute      string `json:"name_attribute"`
-	TLS                bool   `json:"tls"`
-	InsecureSkip       bool   `json:"insecure_skip"`
+	Flavor             string   `json:"flavor"`
+	Address            string   `json:"address"`
+	Servers            []string `json:"servers"`
+	User               string   `json:"user"`
+	Password           string   `json:"password"`
+	SearchBase         string   `json:"search_base"`
+	UserFilter         string   `json:"user_filter"`
+	UIDAttribute       string   `json:"uid_attributes"`
+	MobileAttribute    string   `json:"mobile_attribute"`
+	TelephoneAttribute string   `json:"telephone_attribute"`
+	EMailAttribute     string   `json:"email_attribute"`
+	NameAttribute      string   `json:"name_attribute"`
+	TLS                bool     `json:"tls"`
+	InsecureSkip       bool     `json:"insecure_skip"`
+	GroupAttribute     string   `json:"group_attribute"`
+	GroupSearchBase    string   `json:"group_search_base"`
+	GroupFilter        string   `json:"group_filter"`
+	GroupNameAttribute string   `json:"group_name_attribute"`
+	NestedGroups       bool     `json:"nested_groups"`
+	GroupDN            bool     `json:"group_dn"`
+	StartTLS           bool     `json:"start_tls"`
+	CAFile             string   `json:"ca_file"`
+	CertFile           string   `json:"cert_file"`
+	KeyFile            string   `json:"key_file"`
+	PoolSize           int      `json:"pool_size"`
+	IdleTimeout        Duration `json:"idle_timeout"`
+	Timeout            Duration `json:"timeout"`
+	PageSize           uint32   `json:"page_size"`
+	FollowReferrals    bool     `json:"follow_referrals"`
 
+	pool      *ldapPool
+	servers   *ldapServers
+	tlsConfig *tls.Config
 	sync.Mutex
 }
 
 type ldapsearcher interface {
 	Search(searchRequest *ldap.SearchRequest) (*ldap.SearchResult, error)
+	SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error)
 	Bind(username, password string) error
 	Close()
 }
@@ -57,54 +92,147 @@ func setdefault(s, d string) string {
 }
 
 func (cfg *ldapConfiguration) init(r *caddy.Replacer) *ldapConfiguration {
-	cfg.UIDAttribute = setdefault(r.ReplaceKnown(cfg.UIDAttribute, ""), defaultUID)
+	cfg.Flavor = r.ReplaceKnown(cfg.Flavor, "")
+	cfg.UIDAttribute = r.ReplaceKnown(cfg.UIDAttribute, "")
+	cfg.UserFilter = r.ReplaceKnown(cfg.UserFilter, "")
+	cfg.TelephoneAttribute = r.ReplaceKnown(cfg.TelephoneAttribute, "")
+	cfg.initFlavor()
+	cfg.UIDAttribute = setdefault(cfg.UIDAttribute, defaultUID)
 	cfg.MobileAttribute = setdefault(r.ReplaceKnown(cfg.MobileAttribute, ""), defaultMobile)
 	cfg.EMailAttribute = setdefault(r.ReplaceKnown(cfg.EMailAttribute, ""), defaultEMail)
 	cfg.NameAttribute = setdefault(r.ReplaceKnown(cfg.NameAttribute, ""), defaultName)
-	cfg.TelephoneAttribute = r.ReplaceKnown(cfg.TelephoneAttribute, "")
 	cfg.Address = r.ReplaceKnown(cfg.Address, "")
 	cfg.User = r.ReplaceKnown(cfg.User, "")
 	cfg.Password = r.ReplaceKnown(cfg.Password, "")
 	cfg.SearchBase = r.ReplaceKnown(cfg.SearchBase, "")
+	if cfg.UserFilter == "" {
+		cfg.UserFilter = fmt.Sprintf("(%s={uid})", cfg.UIDAttribute)
+	}
+	cfg.GroupAttribute = r.ReplaceKnown(cfg.GroupAttribute, "")
+	cfg.GroupSearchBase = r.ReplaceKnown(cfg.GroupSearchBase, "")
+	cfg.GroupNameAttribute = setdefault(r.ReplaceKnown(cfg.GroupNameAttribute, ""), defaultGroupName)
+	cfg.GroupFilter = r.ReplaceKnown(cfg.GroupFilter, "")
+	if cfg.GroupFilter == "" {
+		cfg.GroupFilter = defaultGroupFilter
+		if cfg.NestedGroups {
+			cfg.GroupFilter = nestedGroupFilter
+		}
+	}
+	for i, s := range cfg.Servers {
+		cfg.Servers[i] = r.ReplaceKnown(s, "")
+	}
+	cfg.CAFile = r.ReplaceKnown(cfg.CAFile, "")
+	cfg.CertFile = r.ReplaceKnown(cfg.CertFile, "")
+	cfg.KeyFile = r.ReplaceKnown(cfg.KeyFile, "")
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = defaultLdapPoolSize
+	}
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = defaultLdapIdleTimeout
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultLdapTimeout
+	}
+	cl := clock.New()
+	cfg.pool = newLdapPool(cl, cfg.PoolSize, time.Duration(cfg.IdleTimeout), time.Duration(cfg.Timeout))
+	cfg.servers = newLdapServers(cl)
 	return cfg
 }
 
-func (cfg *ldapConfiguration) Search(log *zap.Logger, uid string) (*UserEntry, error) {
-	con, err := getConnection(log, cfg)
-	if err != nil {
-		return nil, err
+// close closes the pooled connections when the app stops.
+func (cfg *ldapConfiguration) close() {
+	cfg.pool.close()
+}
+
+// withConnection calls fn with a pooled connection. If the connection was
+// closed by the server in the meantime, fn is called once more with a new one.
+// A connection which is still bound as a user is dropped without a retry.
+func (cfg *ldapConfiguration) withConnection(log *zap.Logger, fn func(con ldapsearcher) error) error {
+	var err error
+	for try := 0; try < 2; try++ {
+		var pc *pooledConn
+		pc, err = cfg.pool.get(func() (ldapsearcher, error) { return getConnection(log, cfg) })
+		if err != nil {
+			return err
+		}
+		err = fn(pc)
+		cfg.pool.put(pc, errors.Is(err, ErrNoConnection) || errors.Is(err, errStillBound))
+		if !errors.Is(err, ErrNoConnection) {
+			return err
+		}
 	}
-	defer con.Close()
+	return err
+}
 
-	return cfg.search(log, con, uid)
+func (cfg *ldapConfiguration) Search(log *zap.Logger, uid string) (*UserEntry, error) {
+	var ue *UserEntry
+	err := cfg.withConnection(log, func(con ldapsearcher) error {
+		var err error
+		ue, err = cfg.search(log, con, uid)
+		return err
+	})
+	return ue, err
 }
 
-func initConnection(lg *zap.Logger, cfg *ldapConfiguration) (ldapsearcher, error) {
-	var con *ldap.Conn
-	if cfg.TLS {
-		tlsConf := &tls.Config{InsecureSkipVerify: cfg.InsecureSkip}
-		c, err := ldap.DialTLS("tcp", cfg.Address, tlsConf)
+// SearchAlias finds the uid of the user with the email or mobile number.
+// The user is searched again with the user filter by its uid.
+func (cfg *ldapConfiguration) SearchAlias(log *zap.Logger, alias, value string) (*UserEntry, error) {
+	attr := cfg.EMailAttribute
+	if alias == aliasMobile {
+		attr = cfg.MobileAttribute
+	}
+	if attr == "" || value == "" {
+		return nil, fmt.Errorf("%w: %s %q", ErrNoUser, alias, value)
+	}
+	filter := fmt.Sprintf("(%s=%s)", attr, ldap.EscapeFilter(value))
+	var ue *UserEntry
+	err := cfg.withConnection(log, func(con ldapsearcher) error {
+		e, err := cfg.findFilter(log, con, filter, value, []string{"dn", cfg.UIDAttribute})
 		if err != nil {
-			lg.Error("cannot connect to TLS server", zap.Bool("insecure", cfg.InsecureSkip), zap.Error(err))
-			return nil, fmt.Errorf("%w: cannot connect to TLS ldap server", err)
+			return err
 		}
-		con = c
-	} else {
-		c, err := ldap.Dial("tcp", cfg.Address)
-		if err != nil {
-			lg.Error("cannot connect to server", zap.Error(err))
-			return nil, fmt.Errorf("%w: cannot connect to ldap server", err)
+		uid := e.GetAttributeValue(cfg.UIDAttribute)
+		if uid == "" {
+			return fmt.Errorf("%w: %s has no %s", ErrNoUser, e.DN, cfg.UIDAttribute)
 		}
-		con = c
-	}
-	// bind with a user to make queries
-	err := con.Bind(cfg.User, cfg.Password)
-	if err != nil {
-		lg.Error("cannot bind to server", zap.Error(err))
-		con.Close()
-		return nil, fmt.Errorf("%w: cannot bind to ldap server", err)
+		ue = &UserEntry{UID: uid}
+		return nil
+	})
+	return ue, err
+}
+
+// CheckPassword binds as the user with the password. The connection is bound
+// with the configured user again before it goes back to the pool.
+func (cfg *ldapConfiguration) CheckPassword(log *zap.Logger, uid, password string) error {
+	if password == "" {
+		// an empty password is an unauthenticated bind which always succeeds
+		return ErrWrongPassword
 	}
-	return con, nil
+	return cfg.withConnection(log, func(con ldapsearcher) error {
+		e, err := cfg.findEntry(log, con, uid, []string{"dn"})
+		if err != nil {
+			return err
+		}
+		berr := con.Bind(e.DN, password)
+		wrong := berr != nil && ldap.IsErrorWithCode(berr, ldap.LDAPResultInvalidCredentials)
+		if err := con.Bind(cfg.User, cfg.Password); err != nil {
+			log.Error("cannot bind to ldap server again", zap.Error(err))
+			if wrong {
+				// never bind with a wrong password twice, the directory may
+				// count every failure for its own lockout
+				return fmt.Errorf("%w: %s: %w", ErrWrongPassword, uid, errStillBound)
+			}
+			return fmt.Errorf("%w: cannot bind to ldap server", ErrNoConnection)
+		}
+		if wrong {
+			return fmt.Errorf("%w: %s", ErrWrongPassword, uid)
+		}
+		if berr != nil {
+			log.Error("cannot bind as user", zap.String("dn", e.DN), zap.Error(berr))
+			return fmt.Errorf("%w: cannot bind as user", ErrNoConnection)
+		}
+		return nil
+	})
 }
 
 func (cfg *ldapConfiguration) search(lg *zap.Logger, con ldapsearcher, uid string) (*UserEntry, error) {
@@ -121,17 +249,75 @@ func (cfg *ldapConfiguration) search(lg *zap.Logger, con ldapsearcher, uid strin
 	if cfg.TelephoneAttribute != "" {
 		returnattributes = append(returnattributes, cfg.TelephoneAttribute)
 	}
+	if cfg.GroupAttribute != "" {
+		returnattributes = append(returnattributes, cfg.GroupAttribute)
+	}
+	entry, err := cfg.findEntry(lg, con, uid, returnattributes)
+	if err != nil {
+		return nil, err
+	}
+
+	found := &UserEntry{
+		UID: uid,
+	}
+	for _, a := range entry.Attributes {
+		if a.Name == cfg.MobileAttribute {
+			found.Mobile = cfg.phone(a.Values[0])
+		}
+		if a.Name == cfg.UIDAttribute {
+			s := a.Values[0]
+			found.UID = s
+		}
+		if a.Name == cfg.EMailAttribute {
+			s := a.Values[0]
+			found.EMail = s
+		}
+		if a.Name == cfg.NameAttribute {
+			s := a.Values[0]
+			found.Name = s
+		}
+		if a.Name == cfg.TelephoneAttribute {
+			found.Telephone = cfg.phone(a.Values[0])
+		}
+		if a.Name == cfg.GroupAttribute {
+			for _, v := range a.Values {
+				found.Groups = appendGroup(found.Groups, cfg.groupOf(v))
+			}
+		}
+	}
+	if cfg.GroupSearchBase != "" || cfg.NestedGroups {
+		groups, err := cfg.searchGroups(lg, con, entry.DN, found.UID)
+		if err != nil {
+			return nil, err
+		}
+		for _, g := range groups {
+			found.Groups = appendGroup(found.Groups, g)
+		}
+	}
+
+	return found, nil
+}
+
+// findEntry searches the entry of the user, a disabled account is not found.
+func (cfg *ldapConfiguration) findEntry(lg *zap.Logger, con ldapsearcher, uid string, returnattributes []string) (*ldap.Entry, error) {
+	return cfg.findFilter(lg, con, cfg.userFilter(uid), uid, returnattributes)
+}
+
+func (cfg *ldapConfiguration) findFilter(lg *zap.Logger, con ldapsearcher, filter, uid string, returnattributes []string) (*ldap.Entry, error) {
+	if cfg.Flavor == flavorAD {
+		returnattributes = append(returnattributes, adUserAccountControl)
+	}
 
-	lg.Info("search user", zap.String("base", cfg.SearchBase), zap.String("uidattribute", cfg.UIDAttribute), zap.String("user", uid), zap.Strings("attributes", returnattributes))
+	lg.Info("search user", zap.String("base", cfg.SearchBase), zap.String("filter", filter), zap.String("user", uid), zap.Strings("attributes", returnattributes))
 	// Search for the given username
 	searchRequest := ldap.NewSearchRequest(
 		cfg.SearchBase,
 		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(%s=%s)", cfg.UIDAttribute, uid),
+		filter,
 		returnattributes,
 		nil,
 	)
-	sr, err := con.Search(searchRequest)
+	sr, err := cfg.searchAll(lg, con, searchRequest)
 	if err != nil {
 		lg.Error("error searching for user", zap.Error(err))
 		return nil, fmt.Errorf("%w: cannot connect to search ldap server", ErrNoConnection)
@@ -148,36 +334,77 @@ func (cfg *ldapConfiguration) search(lg *zap.Logger, con ldapsearcher, uid strin
 	}
 
 	lg.Info("found ldap entry", zap.Any("attributes", sr.Entries[0].Attributes))
+	if cfg.disabled(sr.Entries[0]) {
+		lg.Info("ldap account is disabled", zap.String("username", uid), zap.String("dn", sr.Entries[0].DN))
+		return nil, fmt.Errorf("%w: account %q is disabled", ErrNoUser, uid)
+	}
+	return sr.Entries[0], nil
+}
 
-	found := &UserEntry{
-		UID: uid,
+// userFilter returns the filter to search the user. The uid is escaped, so
+// a uid like "*" or "a)(mail=*" cannot change the filter.
+func (cfg *ldapConfiguration) userFilter(uid string) string {
+	return strings.ReplaceAll(cfg.UserFilter, "{uid}", ldap.EscapeFilter(uid))
+}
+
+// searchGroups returns the names of the groups which have the user as a
+// member. The placeholders {dn} and {uid} in the filter are replaced with
+// the escaped values of the user.
+func (cfg *ldapConfiguration) searchGroups(lg *zap.Logger, con ldapsearcher, dn, uid string) ([]string, error) {
+	base := setdefault(cfg.GroupSearchBase, cfg.SearchBase)
+	filter := strings.NewReplacer("{dn}", ldap.EscapeFilter(dn), "{uid}", ldap.EscapeFilter(uid)).Replace(cfg.GroupFilter)
+	lg.Debug("search groups", zap.String("base", base), zap.String("filter", filter))
+	sr, err := cfg.searchAll(lg, con, ldap.NewSearchRequest(
+		base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		filter,
+		[]string{cfg.GroupNameAttribute},
+		nil,
+	))
+	if err != nil {
+		lg.Error("error searching for groups", zap.Error(err))
+		return nil, fmt.Errorf("%w: cannot search groups", ErrNoConnection)
 	}
-	for _, a := range sr.Entries[0].Attributes {
-		if a.Name == cfg.MobileAttribute {
-			s := a.Values[0]
-			s = strings.ReplaceAll(s, "+", "00")
-			s = onlynum.ReplaceAllString(s, "")
-			found.Mobile = s
-		}
-		if a.Name == cfg.UIDAttribute {
-			s := a.Values[0]
-			found.UID = s
+	var res []string
+	for _, e := range sr.Entries {
+		name := e.DN
+		if !cfg.GroupDN {
+			name = e.GetAttributeValue(cfg.GroupNameAttribute)
 		}
-		if a.Name == cfg.EMailAttribute {
-			s := a.Values[0]
-			found.EMail = s
-		}
-		if a.Name == cfg.NameAttribute {
-			s := a.Values[0]
-			found.Name = s
+		if name == "" {
+			name = groupName(e.DN)
 		}
-		if a.Name == cfg.TelephoneAttribute {
-			s := a.Values[0]
-			s = strings.ReplaceAll(s, "+", "00")
-			s = onlynum.ReplaceAllString(s, "")
-			found.Telephone = s
+		if name != "" {
+			res = append(res, name)
 		}
 	}
+	return res, nil
+}
 
-	return found, nil
+// groupOf returns the group of a value of the group attribute; with GroupDN
+// it is the full DN, so groups with the same name in different OUs differ.
+func (cfg *ldapConfiguration) groupOf(v string) string {
+	if cfg.GroupDN {
+		return v
+	}
+	return groupName(v)
+}
+
+// groupName returns the value of the first RDN if the group is a DN like
+// the values of memberOf.
+func groupName(v string) string {
+	dn, err := ldap.ParseDN(v)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return v
+	}
+	return dn.RDNs[0].Attributes[0].Value
+}
+
+func appendGroup(groups []string, g string) []string {
+	for _, e := range groups {
+		if strings.EqualFold(e, g) {
+			return groups
+		}
+	}
+	return append(groups, g)
 }
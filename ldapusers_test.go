@@ -3,6 +3,7 @@ package doorman
 import (
 	"errors"
 	"fmt"
+	"reflect"
 	"testing"
 
 	"github.com/caddyserver/caddy/v2"
@@ -19,6 +20,10 @@ func (dc *dummyconnection) Search(searchRequest *ldap.SearchRequest) (*ldap.Sear
 	return dc.result, dc.err
 }
 
+func (dc *dummyconnection) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	return dc.Search(searchRequest)
+}
+
 func (dc *dummyconnection) Bind(username, password string) error {
 	return nil
 }
@@ -200,3 +205,134 @@ func Test_search(t *testing.T) {
 	}
 
 }
+
+// groupconnection answers the user search and the group search separately
+// and records the filters.
+type groupconnection struct {
+	dummyconnection
+	groups  *ldap.SearchResult
+	filters []string
+}
+
+func (gc *groupconnection) Search(sr *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	gc.filters = append(gc.filters, sr.Filter)
+	if sr.BaseDN == "ou=groups,dc=example,dc=com" {
+		return gc.groups, nil
+	}
+	return gc.result, gc.err
+}
+
+func Test_search_groups(t *testing.T) {
+	user := &ldap.SearchResult{Entries: []*ldap.Entry{{
+		DN: "cn=Test (Admin),ou=people,dc=example,dc=com",
+		Attributes: []*ldap.EntryAttribute{
+			{Name: defaultUID, Values: []string{"test"}},
+			{Name: "memberOf", Values: []string{"cn=wiki,ou=groups,dc=example,dc=com", "cn=Staff,ou=groups,dc=example,dc=com"}},
+		},
+	}}}
+	groups := &ldap.SearchResult{Entries: []*ldap.Entry{
+		{DN: "cn=admins,ou=groups,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{{Name: defaultGroupName, Values: []string{"admins"}}}},
+		{DN: "cn=staff,ou=groups,dc=example,dc=com", Attributes: []*ldap.EntryAttribute{{Name: defaultGroupName, Values: []string{"staff"}}}},
+	}}
+	tests := []struct {
+		name       string
+		cfg        *ldapConfiguration
+		wantGroups []string
+		wantFilter string
+	}{
+		{name: "no groups", cfg: &ldapConfiguration{}, wantGroups: nil},
+		{name: "member of", cfg: &ldapConfiguration{GroupAttribute: "memberOf"}, wantGroups: []string{"wiki", "Staff"}},
+		{
+			name:       "group search",
+			cfg:        &ldapConfiguration{GroupSearchBase: "ou=groups,dc=example,dc=com"},
+			wantGroups: []string{"admins", "staff"},
+			wantFilter: `(member=cn=Test \28Admin\29,ou=people,dc=example,dc=com)`,
+		},
+		{
+			name:       "nested groups",
+			cfg:        &ldapConfiguration{GroupSearchBase: "ou=groups,dc=example,dc=com", NestedGroups: true},
+			wantGroups: []string{"admins", "staff"},
+			wantFilter: `(member:1.2.840.113556.1.4.1941:=cn=Test \28Admin\29,ou=people,dc=example,dc=com)`,
+		},
+		{
+			name:       "member of with dn",
+			cfg:        &ldapConfiguration{GroupAttribute: "memberOf", GroupDN: true},
+			wantGroups: []string{"cn=wiki,ou=groups,dc=example,dc=com", "cn=Staff,ou=groups,dc=example,dc=com"},
+		},
+		{
+			name:       "group search with dn",
+			cfg:        &ldapConfiguration{GroupSearchBase: "ou=groups,dc=example,dc=com", GroupDN: true},
+			wantGroups: []string{"cn=admins,ou=groups,dc=example,dc=com", "cn=staff,ou=groups,dc=example,dc=com"},
+		},
+		{
+			name:       "member of and custom filter",
+			cfg:        &ldapConfiguration{GroupAttribute: "memberOf", GroupSearchBase: "ou=groups,dc=example,dc=com", GroupFilter: "(memberUid={uid})"},
+			wantGroups: []string{"wiki", "Staff", "admins"},
+			wantFilter: "(memberUid=test)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			con := &groupconnection{dummyconnection: dummyconnection{result: user}, groups: groups}
+			getConnection = func(_ *zap.Logger, cfg *ldapConfiguration) (ldapsearcher, error) {
+				return con, nil
+			}
+			ld := tt.cfg.init(caddy.NewReplacer())
+			ue, err := ld.Search(zap.NewNop(), "test")
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+			if !reflect.DeepEqual(ue.Groups, tt.wantGroups) {
+				t.Errorf("Groups = %v, want %v", ue.Groups, tt.wantGroups)
+			}
+			if tt.wantFilter != "" && (len(con.filters) != 2 || con.filters[1] != tt.wantFilter) {
+				t.Errorf("group filters = %v, want %q", con.filters, tt.wantFilter)
+			}
+		})
+	}
+}
+
+func Test_search_userFilter(t *testing.T) {
+	tests := []struct {
+		name       string
+		filter     string
+		uid        string
+		wantFilter string
+	}{
+		{name: "default", uid: "test", wantFilter: "(uid=test)"},
+		{name: "wildcard", uid: "*", wantFilter: `(uid=\2a)`},
+		{name: "injection", uid: "a)(mail=*", wantFilter: `(uid=a\29\28mail=\2a)`},
+		{name: "backslash and nul", uid: "a\\b\x00", wantFilter: `(uid=a\5cb\00)`},
+		{
+			name:       "template",
+			filter:     "(&(objectClass=person)(|(uid={uid})(mail={uid}))(!(nsAccountLock=TRUE)))",
+			uid:        "test@example.com",
+			wantFilter: "(&(objectClass=person)(|(uid=test@example.com)(mail=test@example.com))(!(nsAccountLock=TRUE)))",
+		},
+		{
+			name:       "template with injection",
+			filter:     "(&(objectClass=person)(mail={uid}))",
+			uid:        "*)(objectClass=*",
+			wantFilter: `(&(objectClass=person)(mail=\2a\29\28objectClass=\2a))`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			con := &groupconnection{dummyconnection: dummyconnection{result: createLDAPSearchResult(map[string]string{defaultUID: "test"}, 1)}}
+			getConnection = func(_ *zap.Logger, cfg *ldapConfiguration) (ldapsearcher, error) {
+				return con, nil
+			}
+			ld := (&ldapConfiguration{UserFilter: tt.filter}).init(caddy.NewReplacer())
+			ue, err := ld.Search(zap.NewNop(), tt.uid)
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+			if ue.UID != "test" {
+				t.Errorf("UID = %q, want the uid of the entry", ue.UID)
+			}
+			if len(con.filters) != 1 || con.filters[0] != tt.wantFilter {
+				t.Errorf("filters = %v, want %q", con.filters, tt.wantFilter)
+			}
+		})
+	}
+}
@@ -0,0 +1,132 @@
+package doorman
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+func init() {
+	caddy.RegisterModule(Matcher{})
+}
+
+// Matcher matches requests of admitted clients without serving the gate, so
+// routes can differ for admitted and other visitors. A client is admitted
+// by the same rules as in the handler: it is not blocked and it is
+// whitelisted or has a grant. With Users the identity of the client must
+// also be one of these users and with Groups a member of one of these
+// groups; the identity is the user of the grant or of the session cookie.
+// With Policy the grants of this policy are used.
+//
+//	@admitted doorman [<uid>...]
+type Matcher struct {
+	Policy string   `json:"policy,omitempty"`
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+
+	app *MiddlewareApp
+}
+
+func (Matcher) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.matchers.doorman",
+		New: func() caddy.Module { return new(Matcher) },
+	}
+}
+
+func (m *Matcher) Provision(ctx caddy.Context) error {
+	dm, err := ctx.App("doorman")
+	if err != nil {
+		return err
+	}
+	m.app = dm.(*MiddlewareApp)
+	if _, ok := m.app.namedPolicy(m.Policy); !ok {
+		return fmt.Errorf("unknown policy: %q", m.Policy)
+	}
+	if len(m.Groups) > 0 {
+		m.app.lookupGroups = true
+	}
+	return nil
+}
+
+// Match implements caddyhttp.RequestMatcher.
+func (m *Matcher) Match(r *http.Request) bool {
+	clip := findClientIP(r)
+	if m.app.isBlocked(r, clip) || !m.app.store.isAllowed(clip, m.Policy) {
+		return false
+	}
+	if len(m.Users) == 0 && len(m.Groups) == 0 {
+		return true
+	}
+	ue, ok := m.identity(r, clip)
+	if !ok {
+		m.app.logger.Debug("no user for matcher", zap.String("clientip", clip))
+		return false
+	}
+	if len(m.Groups) > 0 && !containsGroup(m.Groups, ue.Groups) {
+		return false
+	}
+	if len(m.Users) == 0 {
+		return true
+	}
+	for _, u := range m.Users {
+		if u == ue.UID {
+			return true
+		}
+	}
+	return false
+}
+
+// identity returns the user of the grant or of the session cookie.
+func (m *Matcher) identity(r *http.Request, clip string) (*UserEntry, bool) {
+	if g, ok := m.app.store.grantOf(m.app.logger, clip, m.Policy); ok {
+		return &UserEntry{UID: g.UID, Groups: g.Groups}, true
+	}
+	uid, ok := m.app.currentUser(r)
+	if !ok {
+		return nil, false
+	}
+	if len(m.Groups) == 0 {
+		return &UserEntry{UID: uid}, true
+	}
+	ue, err := m.app.userOf(uid)
+	if err != nil {
+		m.app.logger.Debug("cannot find user of session", zap.String("uid", uid), zap.Error(err))
+		return nil, false
+	}
+	return ue, true
+}
+
+// UnmarshalCaddyfile implements caddyfile.Unmarshaler.
+func (m *Matcher) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() {
+		m.Users = append(m.Users, d.RemainingArgs()...)
+		for d.NextBlock(0) {
+			switch d.Val() {
+			case "users":
+				m.Users = append(m.Users, d.RemainingArgs()...)
+			case "groups":
+				m.Groups = append(m.Groups, d.RemainingArgs()...)
+			case "policy":
+				if !d.NextArg() {
+					return d.ArgErr()
+				}
+				m.Policy = d.Val()
+			default:
+				return d.Errf("unknown subdirective %q", d.Val())
+			}
+		}
+	}
+	return nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner        = (*Matcher)(nil)
+	_ caddyhttp.RequestMatcher = (*Matcher)(nil)
+	_ caddyfile.Unmarshaler    = (*Matcher)(nil)
+)
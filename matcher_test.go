@@ -0,0 +1,81 @@
+package doorman
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"go.uber.org/zap"
+)
+
+func Test_Matcher_Match(t *testing.T) {
+	m := newBlockingApp(t, "10.6.6.6", "192.0.2.66")
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "ddk", "192.0.2.10", time.Hour)
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "other", "192.0.2.20", time.Hour)
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "ddk", "192.0.2.66", time.Hour)
+
+	tests := []struct {
+		name   string
+		users  []string
+		ip     string
+		cookie string
+		want   bool
+	}{
+		{name: "whitelisted", ip: "10.1.1.1", want: true},
+		{name: "granted", ip: "192.0.2.10", want: true},
+		{name: "unknown", ip: "203.0.113.1", want: false},
+		{name: "blocked", ip: "10.6.6.6", want: false},
+		{name: "blocked with grant", ip: "192.0.2.66", want: false},
+		{name: "user of grant", users: []string{"ddk"}, ip: "192.0.2.10", want: true},
+		{name: "other user of grant", users: []string{"ddk"}, ip: "192.0.2.20", want: false},
+		{name: "whitelisted without user", users: []string{"ddk"}, ip: "10.1.1.1", want: false},
+		{name: "whitelisted with session", users: []string{"ddk"}, ip: "10.1.1.1", cookie: "ddk", want: true},
+		{name: "session without admission", users: []string{"ddk"}, ip: "203.0.113.1", cookie: "ddk", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mt := &Matcher{Users: tt.users, app: m}
+			r := httptest.NewRequest(http.MethodGet, "https://wiki.example.com/", nil)
+			r.RemoteAddr = tt.ip + ":4711"
+			if tt.cookie != "" {
+				cw := httptest.NewRecorder()
+				m.secCookie.set(cw, cookieData{uidField: tt.cookie, authorizedField: m.clock.Now().Unix()})
+				for _, c := range cw.Result().Cookies() {
+					r.AddCookie(c)
+				}
+			}
+			if got := mt.Match(r); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_Matcher_UnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   string
+		want    []string
+		wantErr bool
+	}{
+		{name: "plain", input: "doorman"},
+		{name: "arguments", input: "doorman ddk admin", want: []string{"ddk", "admin"}},
+		{name: "block", input: "doorman {\n users ddk admin\n}", want: []string{"ddk", "admin"}},
+		{name: "unknown", input: "doorman {\n roles wiki\n}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mt Matcher
+			err := mt.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("UnmarshalCaddyfile() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(mt.Users, tt.want) {
+				t.Errorf("Users = %v, want %v", mt.Users, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package doorman
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	passwordField         = "password"
+	passwordVerifiedField = "pwverified"
+
+	defaultPasswordMaxFailures = 5
+	defaultPasswordLockout     = Duration(15 * time.Minute)
+	toplevelPasswordFailures   = "pwfail:"
+	// a login must finish its second factor within this time after the
+	// password was checked
+	passwordVerifiedDuration = 5 * time.Minute
+)
+
+var (
+	ErrWrongPassword = fmt.Errorf("wrong password")
+)
+
+// PasswordLockout locks the password step of a user after too many failed
+// attempts. The lock ends when the duration after the first failure is over.
+type PasswordLockout struct {
+	MaxFailures int      `json:"max_failures,omitempty"`
+	Duration    Duration `json:"duration,omitempty"`
+}
+
+func (pl PasswordLockout) maxFailures() int64 {
+	if pl.MaxFailures <= 0 {
+		return defaultPasswordMaxFailures
+	}
+	return int64(pl.MaxFailures)
+}
+
+func (pl PasswordLockout) duration() time.Duration {
+	if pl.Duration <= 0 {
+		return time.Duration(defaultPasswordLockout)
+	}
+	return time.Duration(pl.Duration)
+}
+
+// passwordChecker is a backend which checks the password itself, the other
+// backends compare it with the password_hash of the user entry.
+type passwordChecker interface {
+	CheckPassword(log *zap.Logger, uid, password string) error
+}
+
+// CheckPassword checks the password in the first backend which knows the
+// user.
+func (ulb *userBackends) CheckPassword(log *zap.Logger, uid, password string) error {
+	for _, b := range ulb.searchers {
+		var err error
+		if pc, ok := b.(passwordChecker); ok {
+			err = pc.CheckPassword(log, uid, password)
+		} else {
+			var ue *UserEntry
+			if ue, err = b.Search(log, uid); err == nil {
+				err = verifyPasswordHash(ue.PasswordHash, password)
+			}
+		}
+		if !errors.Is(err, ErrNoUser) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrNoUser, uid)
+}
+
+// verifyPasswordHash compares the password with a bcrypt hash or an argon2id
+// hash in the PHC format like $argon2id$v=19$m=65536,t=3,p=4$salt$hash.
+func verifyPasswordHash(hash, password string) error {
+	switch {
+	case password == "" || hash == "":
+		return ErrWrongPassword
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		if err := bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)); err != nil {
+			if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+				return ErrWrongPassword
+			}
+			return fmt.Errorf("illegal bcrypt hash: %w", err)
+		}
+		return nil
+	case strings.HasPrefix(hash, "$argon2id$"):
+		return verifyArgon2(hash, password)
+	}
+	return fmt.Errorf("unknown password hash format")
+}
+
+func verifyArgon2(hash, password string) error {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 {
+		return fmt.Errorf("illegal argon2 hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return fmt.Errorf("unsupported argon2 version: %q", parts[2])
+	}
+	var memory, times uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &times, &threads); err != nil {
+		return fmt.Errorf("illegal argon2 parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return fmt.Errorf("illegal argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return fmt.Errorf("illegal argon2 hash: %w", err)
+	}
+	other := argon2.IDKey([]byte(password), salt, times, memory, threads, uint32(len(key)))
+	if subtle.ConstantTimeCompare(key, other) != 1 {
+		return ErrWrongPassword
+	}
+	return nil
+}
+
+// checkPassword is the password step of sendUser. Every attempt is counted
+// before the password is checked, so a locked user cannot try passwords; a
+// correct password resets the counter. The failures are counted per user and
+// client IP, so others cannot lock out a user.
+func (m *MiddlewareApp) checkPassword(r *http.Request, ue *UserEntry) (string, int) {
+	clip := findClientIP(r)
+	key := toplevelPasswordFailures + ue.UID + ":" + clip
+	n, err := m.store.kvs.Incr(m.logger, key, m.PasswordLockout.duration())
+	if err != nil {
+		m.logger.Error("cannot count password attempts", zap.String("uid", ue.UID), zap.Error(err))
+		return "Unknown error", http.StatusInternalServerError
+	}
+	if n > m.PasswordLockout.maxFailures() {
+		m.audit("password locked", zap.String("uid", ue.UID), zap.String("clientip", clip))
+		return "Too many failed attempts", http.StatusTooManyRequests
+	}
+	err = m.userbackends.CheckPassword(m.logger, ue.UID, r.FormValue(passwordField))
+	if err != nil {
+		if errors.Is(err, ErrWrongPassword) || errors.Is(err, ErrNoUser) {
+			m.audit("wrong password", zap.String("uid", ue.UID), zap.String("clientip", clip), zap.Int64("attempt", n))
+			return "Wrong password", http.StatusForbidden
+		}
+		m.logger.Error("cannot check password", zap.String("uid", ue.UID), zap.Error(err))
+		return "Cannot check password", http.StatusInternalServerError
+	}
+	m.store.kvs.Del(m.logger, key)
+	return "", 0
+}
+
+// passwordVerified checks that the login cookie records a password check
+// which is recent enough. The time to finish the second factor is at least
+// the lifetime of a token.
+func (m *MiddlewareApp) passwordVerified(data cookieData) bool {
+	at, ok := data[passwordVerifiedField].(int64)
+	if !ok {
+		return false
+	}
+	d := passwordVerifiedDuration
+	if td := time.Duration(m.TokenDuration); td > d {
+		d = td
+	}
+	return m.clock.Since(time.Unix(at, 0)) <= d
+}
@@ -0,0 +1,265 @@
+package doorman
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-ldap/ldap"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func bcryptHash(t *testing.T, password string) string {
+	h, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(h)
+}
+
+func argon2Hash(password string) string {
+	salt := []byte("0123456789abcdef")
+	key := argon2.IDKey([]byte(password), salt, 1, 64, 1, 32)
+	return fmt.Sprintf("$argon2id$v=%d$m=64,t=1,p=1$%s$%s", argon2.Version,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key))
+}
+
+func Test_verifyPasswordHash(t *testing.T) {
+	bc := bcryptHash(t, "secret")
+	a2 := argon2Hash("secret")
+	tests := []struct {
+		name     string
+		hash     string
+		password string
+		wantErr  error
+		illegal  bool
+	}{
+		{name: "bcrypt", hash: bc, password: "secret"},
+		{name: "wrong bcrypt", hash: bc, password: "Secret", wantErr: ErrWrongPassword},
+		{name: "argon2id", hash: a2, password: "secret"},
+		{name: "wrong argon2id", hash: a2, password: "secret ", wantErr: ErrWrongPassword},
+		{name: "empty password", hash: bc, password: "", wantErr: ErrWrongPassword},
+		{name: "no hash", password: "secret", wantErr: ErrWrongPassword},
+		{name: "plain text", hash: "secret", password: "secret", illegal: true},
+		{name: "broken argon2id", hash: "$argon2id$v=19$m=64$salt", password: "secret", illegal: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyPasswordHash(tt.hash, tt.password)
+			switch {
+			case tt.illegal:
+				if err == nil || errors.Is(err, ErrWrongPassword) {
+					t.Errorf("verifyPasswordHash() error = %v, want an illegal hash", err)
+				}
+			case !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil):
+				t.Errorf("verifyPasswordHash() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_userBackends_CheckPassword(t *testing.T) {
+	ulb := &userBackends{searchers: []userSearcher{
+		&userlistBackend{{UID: "nohash"}},
+		&userlistBackend{{UID: "ddk", PasswordHash: bcryptHash(t, "secret")}},
+	}}
+	if err := ulb.CheckPassword(zap.NewNop(), "ddk", "secret"); err != nil {
+		t.Errorf("CheckPassword() error = %v", err)
+	}
+	if err := ulb.CheckPassword(zap.NewNop(), "ddk", "wrong"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("CheckPassword() with a wrong password = %v", err)
+	}
+	if err := ulb.CheckPassword(zap.NewNop(), "nohash", "secret"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("CheckPassword() for a user without password = %v", err)
+	}
+	if err := ulb.CheckPassword(zap.NewNop(), "unknown", "secret"); !errors.Is(err, ErrNoUser) {
+		t.Errorf("CheckPassword() for an unknown user = %v", err)
+	}
+	ue, err := ulb.Search(zap.NewNop(), "ddk")
+	if err != nil || ue.PasswordHash != "" {
+		t.Errorf("Search() must not return the password hash: %+v, %v", ue, err)
+	}
+}
+
+// bindconnection accepts the bind of the configured user and of the user
+// with the password secret. With failRebind the configured user cannot bind
+// again after a user.
+type bindconnection struct {
+	dummyconnection
+	binds      []string
+	failRebind bool
+	closed     int
+}
+
+func (bc *bindconnection) Bind(username, password string) error {
+	bc.binds = append(bc.binds, username)
+	if username == "cn=doorman" && bc.failRebind && len(bc.binds) > 1 {
+		return ldap.NewError(ldap.LDAPResultBusy, fmt.Errorf("busy"))
+	}
+	if username == "cn=doorman" || password == "secret" {
+		return nil
+	}
+	return ldap.NewError(ldap.LDAPResultInvalidCredentials, fmt.Errorf("invalid credentials"))
+}
+
+func (bc *bindconnection) Close() {
+	bc.closed++
+}
+
+func Test_ldapConfiguration_CheckPassword(t *testing.T) {
+	res := createLDAPSearchResult(map[string]string{defaultUID: "ddk"}, 1)
+	res.Entries[0].DN = "uid=ddk,ou=people,dc=example,dc=com"
+	con := &bindconnection{dummyconnection: dummyconnection{result: res}}
+	getConnection = func(_ *zap.Logger, cfg *ldapConfiguration) (ldapsearcher, error) {
+		return con, nil
+	}
+	cfg := (&ldapConfiguration{User: "cn=doorman"}).init(caddy.NewReplacer())
+
+	tests := []struct {
+		password string
+		wantErr  error
+		binds    int
+	}{
+		{password: "secret", binds: 2},
+		{password: "wrong", wantErr: ErrWrongPassword, binds: 2},
+		{password: "", wantErr: ErrWrongPassword, binds: 0},
+	}
+	for _, tt := range tests {
+		con.binds = nil
+		err := cfg.CheckPassword(zap.NewNop(), "ddk", tt.password)
+		if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+			t.Errorf("CheckPassword(%q) error = %v, want %v", tt.password, err, tt.wantErr)
+		}
+		if len(con.binds) != tt.binds {
+			t.Fatalf("CheckPassword(%q) binds = %v", tt.password, con.binds)
+		}
+		if tt.binds > 0 && (con.binds[0] != res.Entries[0].DN || con.binds[1] != "cn=doorman") {
+			t.Errorf("binds = %v, want the user and then the configured user", con.binds)
+		}
+	}
+
+	// a wrong password is not tried again on a new connection, but the
+	// connection which is still bound as the user is dropped
+	con.binds, con.failRebind = nil, true
+	if err := cfg.CheckPassword(zap.NewNop(), "ddk", "wrong"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("CheckPassword() with a failed rebind = %v, want ErrWrongPassword", err)
+	}
+	if len(con.binds) != 2 || con.closed != 1 {
+		t.Errorf("binds = %v, closed = %d, want one user bind and a dropped connection", con.binds, con.closed)
+	}
+	// other failures are retried
+	con.binds = nil
+	if err := cfg.CheckPassword(zap.NewNop(), "ddk", "secret"); !errors.Is(err, ErrNoConnection) || len(con.binds) != 4 {
+		t.Errorf("CheckPassword() with a failed rebind = %v, binds = %v", err, con.binds)
+	}
+}
+
+func Test_sendUser_password(t *testing.T) {
+	m := newPolicyApp(t)
+	yes, none := true, captchaNone
+	m.Policies["vpn"] = &Policy{OperationMode: operationsModeLink, CaptchaMode: &none, RequirePassword: &yes}
+	m.PasswordLockout = PasswordLockout{MaxFailures: 2, Duration: Duration(time.Hour)}
+	m.userbackends = &userBackends{searchers: []userSearcher{&userlistBackend{{UID: "ddk", PasswordHash: argon2Hash("secret")}}}}
+	vpn, _ := m.namedPolicy("vpn")
+	_, _ = m.store.allowUserIP(zap.NewNop(), "vpn", "ddk", "192.0.2.10", 24*time.Hour)
+
+	send := func(password string) (result, int) {
+		r := multipartRequest(t, "https://auth.example.com/sendUser", map[string]string{uidField: "ddk", passwordField: password})
+		return m.sendUser(httptest.NewRecorder(), withPolicy(r, vpn))
+	}
+	if rs, rc := send("wrong"); rc != http.StatusForbidden || rs.Reload {
+		t.Errorf("sendUser() with a wrong password = %d, %+v", rc, rs)
+	}
+	if rs, rc := send("secret"); rc != 0 || !rs.Reload {
+		t.Errorf("sendUser() with the password = %d, %+v", rc, rs)
+	}
+	// the success resets the failures
+	for i := 0; i < 2; i++ {
+		if _, rc := send(""); rc != http.StatusForbidden {
+			t.Errorf("sendUser() without a password = %d", rc)
+		}
+	}
+	if rs, rc := send("secret"); rc != http.StatusTooManyRequests {
+		t.Errorf("sendUser() of a locked user = %d, %+v", rc, rs)
+	}
+	// the lockout is bound to the client IP of the failures
+	r := multipartRequest(t, "https://auth.example.com/sendUser", map[string]string{uidField: "ddk", passwordField: "secret"})
+	r.RemoteAddr = "192.0.2.11:4711"
+	_, _ = m.store.allowUserIP(zap.NewNop(), "vpn", "ddk", "192.0.2.11", 24*time.Hour)
+	if rs, rc := m.sendUser(httptest.NewRecorder(), withPolicy(r, vpn)); rc != 0 || !rs.Reload {
+		t.Errorf("sendUser() from another IP = %d, %+v", rc, rs)
+	}
+	m.clock.(*clock.Mock).Add(time.Hour)
+	if rs, rc := send("secret"); rc != 0 || !rs.Reload {
+		t.Errorf("sendUser() after the lockout = %d, %+v", rc, rs)
+	}
+
+	wiki, _ := m.namedPolicy("wiki")
+	if wiki.password {
+		t.Errorf("the password is only required by the policy")
+	}
+}
+
+func Test_checkOTP_withoutPassword(t *testing.T) {
+	m := newPolicyApp(t)
+	m.OperationMode = operationsModeOTP
+	m.RequirePassword = true
+	def, _ := m.namedPolicy("")
+
+	// the cookie of a former grant or of a login which skipped /sendUser
+	for _, data := range []cookieData{
+		{uidField: "ddk", authorizedField: m.clock.Now().Unix()},
+		loginCookie(def, &UserEntry{UID: "ddk"}),
+	} {
+		cw := httptest.NewRecorder()
+		m.secCookie.set(cw, data)
+		r := withCookies(multipartRequest(t, "https://auth.example.com/checkOTP", map[string]string{tokenField: "123456"}), cw)
+		if rs, rc := m.checkOTP(httptest.NewRecorder(), withPolicy(r, def)); rc != http.StatusForbidden || rs.Message != "Password required" {
+			t.Errorf("checkOTP() without a password = %d, %+v", rc, rs)
+		}
+	}
+	if m.store.isAllowed("192.0.2.10", "") {
+		t.Errorf("a login without a password must not grant access")
+	}
+}
+
+func Test_checkToken_passwordVerified(t *testing.T) {
+	t.Setenv("DUMMYTOKEN", "123456")
+	m := newPolicyApp(t)
+	m.CaptchaMode = captchaNone
+	m.RequirePassword = true
+	m.transporters = transporters{"mail": nopTransport{}}
+	m.userbackends = &userBackends{searchers: []userSearcher{&userlistBackend{{UID: "ddk", PasswordHash: argon2Hash("secret")}}}}
+	def, _ := m.namedPolicy("")
+
+	login := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r := multipartRequest(t, "https://auth.example.com/sendUser", map[string]string{uidField: "ddk", passwordField: "secret"})
+		if rs, rc := m.sendUser(w, withPolicy(r, def)); rc/100 != 2 {
+			t.Fatalf("sendUser() = %d, %+v", rc, rs)
+		}
+		return w
+	}
+	check := func(w *httptest.ResponseRecorder) int {
+		r := withCookies(multipartRequest(t, "https://auth.example.com/checkToken", map[string]string{tokenField: "123456"}), w)
+		_, rc := m.checkToken(httptest.NewRecorder(), withPolicy(r, def))
+		return rc
+	}
+
+	w := login()
+	m.clock.(*clock.Mock).Add(passwordVerifiedDuration + time.Second)
+	if rc := check(w); rc != http.StatusForbidden {
+		t.Errorf("checkToken() long after the password check = %d, want %d", rc, http.StatusForbidden)
+	}
+	if rc := check(login()); rc != http.StatusOK {
+		t.Errorf("checkToken() after the password check = %d", rc)
+	}
+}
@@ -0,0 +1,375 @@
+package doorman
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	toplevelPersonalToken  = "pat:"
+	toplevelPersonalTokens = "pats:"
+	personalTokenPrefix    = "dmp_"
+	personalTokenIDLen     = 12
+
+	defaultPersonalTokenDuration    = Duration(30 * 24 * time.Hour)
+	defaultPersonalTokenMaxDuration = Duration(365 * 24 * time.Hour)
+
+	authorizedField = "authorized"
+	nameField       = "name"
+	durationField   = "duration"
+	idField         = "id"
+)
+
+var (
+	ErrNoToken = fmt.Errorf("no valid personal token")
+)
+
+// PersonalTokenConfig enables personal access tokens which can be used by
+// scripts instead of an IP based grant.
+type PersonalTokenConfig struct {
+	// Header is an additional header which can hold the token; the token is
+	// always accepted as a bearer token in the Authorization header.
+	Header          string   `json:"header,omitempty"`
+	DefaultDuration Duration `json:"default_duration,omitempty"`
+	MaxDuration     Duration `json:"max_duration,omitempty"`
+}
+
+type personalToken struct {
+	ID      string `json:"id"`
+	UID     string `json:"uid"`
+	Name    string `json:"name"`
+	Policy  string `json:"policy,omitempty"`
+	Hash    string `json:"hash,omitempty"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"`
+}
+
+func hashPersonalToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+func newPersonalToken() (string, error) {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return personalTokenPrefix + base64.RawURLEncoding.EncodeToString(buf), nil
+}
+
+// personalTokens stores the hashes of the tokens; the plain tokens are only
+// returned once when they are created.
+type personalTokens struct {
+	kvs kvstore
+}
+
+func (pt *personalTokens) list(log *zap.Logger, uid string) ([]personalToken, error) {
+	val, err := pt.kvs.Get(log, toplevelPersonalTokens+uid)
+	if err != nil {
+		if errors.Is(err, ErrNoKey) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var res []personalToken
+	if err := json.Unmarshal([]byte(val), &res); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal personal tokens: %w", err)
+	}
+	return res, nil
+}
+
+func (pt *personalTokens) store(log *zap.Logger, uid string, toks []personalToken) error {
+	data, err := json.Marshal(toks)
+	if err != nil {
+		return fmt.Errorf("cannot marshal personal tokens: %w", err)
+	}
+	pt.kvs.Del(log, toplevelPersonalTokens+uid)
+	if len(toks) == 0 {
+		return nil
+	}
+	return pt.kvs.Put(log, toplevelPersonalTokens+uid, string(data))
+}
+
+func (pt *personalTokens) create(log *zap.Logger, uid, name, policy string, now time.Time, dur time.Duration) (string, *personalToken, error) {
+	token, err := newPersonalToken()
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot create personal token: %w", err)
+	}
+	hash := hashPersonalToken(token)
+	p := personalToken{
+		ID:      hash[:personalTokenIDLen],
+		UID:     uid,
+		Name:    name,
+		Policy:  policy,
+		Created: now.UTC().Unix(),
+		Expires: now.Add(dur).UTC().Unix(),
+	}
+	data, err := json.Marshal(p)
+	if err != nil {
+		return "", nil, fmt.Errorf("cannot marshal personal token: %w", err)
+	}
+	toks, err := pt.list(log, uid)
+	if err != nil {
+		return "", nil, err
+	}
+	if err := pt.kvs.Put(log, toplevelPersonalToken+hash, string(data)); err != nil {
+		return "", nil, fmt.Errorf("cannot store personal token: %w", err)
+	}
+	p.Hash = hash
+	if err := pt.store(log, uid, append(toks, p)); err != nil {
+		return "", nil, err
+	}
+	return token, &p, nil
+}
+
+func (pt *personalTokens) lookup(log *zap.Logger, token string, now time.Time) (*personalToken, error) {
+	if !strings.HasPrefix(token, personalTokenPrefix) {
+		return nil, ErrNoToken
+	}
+	hash := hashPersonalToken(token)
+	val, err := pt.kvs.Get(log, toplevelPersonalToken+hash)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrNoToken, err)
+	}
+	var p personalToken
+	if err := json.Unmarshal([]byte(val), &p); err != nil {
+		return nil, fmt.Errorf("cannot unmarshal personal token: %w", err)
+	}
+	if now.UTC().Unix() >= p.Expires {
+		pt.kvs.Del(log, toplevelPersonalToken+hash)
+		return nil, fmt.Errorf("%w: token %s expired", ErrNoToken, p.ID)
+	}
+	return &p, nil
+}
+
+// revoke removes the token with the given id of the user. Expired tokens are
+// removed too.
+func (pt *personalTokens) revoke(log *zap.Logger, uid, id string, now time.Time) error {
+	toks, err := pt.list(log, uid)
+	if err != nil {
+		return err
+	}
+	var keep []personalToken
+	found := false
+	for _, t := range toks {
+		if t.ID == id || now.UTC().Unix() >= t.Expires {
+			found = found || t.ID == id
+			pt.kvs.Del(log, toplevelPersonalToken+t.Hash)
+			continue
+		}
+		keep = append(keep, t)
+	}
+	if err := pt.store(log, uid, keep); err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("%w: %s", ErrNoToken, id)
+	}
+	return nil
+}
+
+// currentUser returns the user which is authorized by the gate in this
+// browser session.
+func (m *MiddlewareApp) currentUser(r *http.Request) (string, bool) {
+	uid, _, ok := m.currentLogin(r)
+	return uid, ok
+}
+
+// currentLogin returns the user and the name of the policy of the login in
+// this browser session. The login is valid for the access duration of its
+// policy.
+func (m *MiddlewareApp) currentLogin(r *http.Request) (string, string, bool) {
+	data, err := m.secCookie.get(r)
+	if err != nil {
+		return "", "", false
+	}
+	uid, ok := data[uidField].(string)
+	if !ok || uid == "" {
+		return "", "", false
+	}
+	authorized, ok := data[authorizedField].(int64)
+	if !ok {
+		return "", "", false
+	}
+	name, _ := data[policyField].(string)
+	pol, ok := m.namedPolicy(name)
+	if !ok {
+		return "", "", false
+	}
+	until := time.Unix(authorized, 0).Add(pol.access)
+	return uid, name, m.clock.Now().Before(until)
+}
+
+func (m *MiddlewareApp) isAdmin(uid string) bool {
+	for _, a := range m.Admins {
+		if a == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// tokenOwner returns the user whose tokens are managed with this request; an
+// admin may manage the tokens of other users.
+func (m *MiddlewareApp) tokenOwner(r *http.Request) (string, bool) {
+	uid, ok := m.currentUser(r)
+	if !ok {
+		return "", false
+	}
+	if other := r.FormValue(uidField); other != "" && other != uid {
+		if !m.isAdmin(uid) {
+			return "", false
+		}
+		return other, true
+	}
+	return uid, true
+}
+
+func (m *MiddlewareApp) listPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	_ = r.ParseForm()
+	uid, ok := m.tokenOwner(r)
+	if !ok {
+		writeJSON(m.logger, w, http.StatusForbidden, result{Message: "Not authorized"})
+		return
+	}
+	toks, err := m.patokens.list(m.logger, uid)
+	if err != nil {
+		m.logger.Error("cannot list personal tokens", zap.Error(err))
+		writeJSON(m.logger, w, http.StatusInternalServerError, result{Message: "Cannot list tokens"})
+		return
+	}
+	res := make([]personalToken, 0, len(toks))
+	for _, t := range toks {
+		t.Hash = ""
+		res = append(res, t)
+	}
+	writeJSON(m.logger, w, http.StatusOK, res)
+}
+
+func (m *MiddlewareApp) createPersonalToken(w http.ResponseWriter, r *http.Request) (rs result, rc int) {
+	if err := r.ParseMultipartForm(1024); err != nil {
+		m.logger.Error("cannot parse form", zap.Error(err))
+		rc = http.StatusInternalServerError
+		return
+	}
+	uid, polname, ok := m.currentLogin(r)
+	if !ok {
+		rs.Message = "Not authorized"
+		rc = http.StatusForbidden
+		return
+	}
+	name := r.FormValue(nameField)
+	if name == "" {
+		rs.Message = "A token needs a name"
+		rc = http.StatusBadRequest
+		return
+	}
+	dur := time.Duration(m.PersonalTokens.DefaultDuration)
+	if d := r.FormValue(durationField); d != "" {
+		pd, err := time.ParseDuration(d)
+		if err != nil || pd <= 0 {
+			rs.Message = "Illegal duration"
+			rc = http.StatusBadRequest
+			return
+		}
+		dur = pd
+	}
+	if dur > time.Duration(m.PersonalTokens.MaxDuration) {
+		rs.Message = "Duration too long, maximum is " + time.Duration(m.PersonalTokens.MaxDuration).String()
+		rc = http.StatusBadRequest
+		return
+	}
+	token, p, err := m.patokens.create(m.logger, uid, name, polname, m.clock.Now(), dur)
+	if err != nil {
+		m.logger.Error("cannot create personal token", zap.Error(err))
+		rs.Message = "Cannot create token"
+		rc = http.StatusInternalServerError
+		return
+	}
+	m.audit("personal token created", zap.String("uid", uid), zap.String("token", p.ID), zap.String(nameField, name), zap.String("policy", polname), zap.Int64("expires", p.Expires))
+	rs.Data = map[string]string{
+		"token": token,
+		idField: p.ID,
+	}
+	return
+}
+
+func (m *MiddlewareApp) revokePersonalToken(w http.ResponseWriter, r *http.Request) (rs result, rc int) {
+	if err := r.ParseMultipartForm(1024); err != nil {
+		m.logger.Error("cannot parse form", zap.Error(err))
+		rc = http.StatusInternalServerError
+		return
+	}
+	uid, ok := m.tokenOwner(r)
+	if !ok {
+		rs.Message = "Not authorized"
+		rc = http.StatusForbidden
+		return
+	}
+	id := r.FormValue(idField)
+	if err := m.patokens.revoke(m.logger, uid, id, m.clock.Now()); err != nil {
+		m.logger.Info("cannot revoke personal token", zap.Error(err))
+		rs.Message = "Unknown token"
+		rc = http.StatusNotFound
+		return
+	}
+	by, _ := m.currentUser(r)
+	m.audit("personal token revoked", zap.String("uid", uid), zap.String("token", id), zap.String("by", by))
+	return
+}
+
+// personalTokenFromRequest returns the personal token of the request and
+// the header which contains it.
+func (m *MiddlewareApp) personalTokenFromRequest(r *http.Request) (string, string) {
+	if auth := r.Header.Get("Authorization"); len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		if tok := strings.TrimSpace(auth[7:]); strings.HasPrefix(tok, personalTokenPrefix) {
+			return tok, "Authorization"
+		}
+	}
+	if h := m.PersonalTokens.Header; h != "" {
+		if tok := strings.TrimSpace(r.Header.Get(h)); tok != "" {
+			return tok, h
+		}
+	}
+	return "", ""
+}
+
+// checkPersonalToken returns the user of a valid personal token in the
+// request. A token is valid only for the policy of the login which created
+// it and not from a denied location. The token is removed from the request,
+// so it is not visible for the upstream.
+func (m *MiddlewareApp) checkPersonalToken(r *http.Request, clip, policy string) (string, bool) {
+	if m.PersonalTokens == nil {
+		return "", false
+	}
+	tok, header := m.personalTokenFromRequest(r)
+	if tok == "" {
+		return "", false
+	}
+	p, err := m.patokens.lookup(m.logger, tok, m.clock.Now())
+	if err != nil {
+		m.audit("personal token rejected", zap.String("clientip", clip), zap.String("url", r.URL.String()), zap.Error(err))
+		return "", false
+	}
+	if p.Policy != policy {
+		m.audit("personal token rejected", zap.String("uid", p.UID), zap.String("token", p.ID), zap.String("clientip", clip), zap.String("url", r.URL.String()), zap.String("policy", policy), zap.String("token_policy", p.Policy))
+		return "", false
+	}
+	if m.geoDenied(clip) {
+		m.audit("personal token location denied", zap.String("uid", p.UID), zap.String("token", p.ID), zap.String("clientip", clip), zap.String("url", r.URL.String()))
+		return "", false
+	}
+	r.Header.Del(header)
+	m.audit("personal token used", zap.String("uid", p.UID), zap.String("token", p.ID), zap.String("clientip", clip), zap.String("method", r.Method), zap.String("url", r.URL.String()))
+	return p.UID, true
+}
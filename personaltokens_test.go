@@ -0,0 +1,145 @@
+package doorman
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap"
+)
+
+func Test_personalTokens(t *testing.T) {
+	lg := zap.NewNop()
+	mock := clock.NewMock()
+	pt := &personalTokens{kvs: newMemstore(mock, StoreSettings{})}
+
+	tok, p, err := pt.create(lg, "ddk", "backup script", "", mock.Now(), time.Hour)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	tok2, _, err := pt.create(lg, "ddk", "deploy", "", mock.Now(), 2*time.Hour)
+	if err != nil {
+		t.Fatalf("create() error = %v", err)
+	}
+	toks, _ := pt.list(lg, "ddk")
+	if len(toks) != 2 {
+		t.Errorf("list() returned %d tokens, want 2", len(toks))
+	}
+
+	found, err := pt.lookup(lg, tok, mock.Now())
+	if err != nil || found.UID != "ddk" || found.ID != p.ID {
+		t.Errorf("lookup() = %+v, %v", found, err)
+	}
+	if _, err := pt.lookup(lg, personalTokenPrefix+"unknown", mock.Now()); !errors.Is(err, ErrNoToken) {
+		t.Errorf("lookup() of unknown token returned %v", err)
+	}
+	if _, err := pt.lookup(lg, "some-upstream-token", mock.Now()); !errors.Is(err, ErrNoToken) {
+		t.Errorf("lookup() of foreign token returned %v", err)
+	}
+
+	if err := pt.revoke(lg, "ddk", p.ID, mock.Now()); err != nil {
+		t.Errorf("revoke() error = %v", err)
+	}
+	if _, err := pt.lookup(lg, tok, mock.Now()); err == nil {
+		t.Errorf("lookup() of revoked token should fail")
+	}
+	if err := pt.revoke(lg, "ddk", p.ID, mock.Now()); err == nil {
+		t.Errorf("revoke() of revoked token should fail")
+	}
+
+	mock.Add(3 * time.Hour)
+	if _, err := pt.lookup(lg, tok2, mock.Now()); err == nil {
+		t.Errorf("lookup() of expired token should fail")
+	}
+}
+
+func Test_checkPersonalToken(t *testing.T) {
+	m, mock := newDeviceApp(t)
+	m.PersonalTokens = &PersonalTokenConfig{Header: "X-Doorman-Token"}
+	m.patokens = &personalTokens{kvs: m.store.kvs}
+	m.geo = newTestGeoIP(t, GeoIPConfig{DenyCountries: []string{"US"}})
+	tok, _, err := m.patokens.create(zap.NewNop(), "ddk", "test", "wiki", mock.Now(), time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		clip    string
+		policy  string
+		wantUID string
+		wantOK  bool
+	}{
+		{name: "bearer token", header: "Authorization", value: "Bearer " + tok, wantUID: "ddk", wantOK: true},
+		{name: "configured header", header: "X-Doorman-Token", value: tok, wantUID: "ddk", wantOK: true},
+		{name: "foreign bearer token", header: "Authorization", value: "Bearer abc"},
+		{name: "wrong token", header: "X-Doorman-Token", value: tok + "x"},
+		{name: "other policy", header: "X-Doorman-Token", value: tok, policy: "admin"},
+		{name: "default policy", header: "X-Doorman-Token", value: tok, policy: "-"},
+		{name: "denied location", header: "X-Doorman-Token", value: tok, clip: "198.51.100.1"},
+		{name: "no token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "https://wiki.example.com/", nil)
+			if tt.header != "" {
+				r.Header.Set(tt.header, tt.value)
+			}
+			clip, pol := tt.clip, tt.policy
+			if clip == "" {
+				clip = "192.0.2.10"
+			}
+			switch pol {
+			case "":
+				pol = "wiki"
+			case "-":
+				pol = ""
+			}
+			uid, ok := m.checkPersonalToken(r, clip, pol)
+			if uid != tt.wantUID || ok != tt.wantOK {
+				t.Errorf("checkPersonalToken() = %q, %v, want %q, %v", uid, ok, tt.wantUID, tt.wantOK)
+			}
+			if ok && r.Header.Get(tt.header) != "" {
+				t.Errorf("the token must be removed from the request")
+			}
+		})
+	}
+}
+
+func Test_currentLogin(t *testing.T) {
+	m := newPolicyApp(t)
+	mock := m.clock.(*clock.Mock)
+	login := func(pol string) *http.Request {
+		cw := httptest.NewRecorder()
+		m.secCookie.set(cw, cookieData{uidField: "ddk", policyField: pol, authorizedField: mock.Now().Unix()})
+		r := httptest.NewRequest(http.MethodGet, "https://auth.example.com/", nil)
+		for _, c := range cw.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		return r
+	}
+	wiki, admin, def, unknown := login("wiki"), login("admin"), login(""), login("unknown")
+
+	if uid, pol, ok := m.currentLogin(wiki); uid != "ddk" || pol != "wiki" || !ok {
+		t.Errorf("currentLogin() = %q, %q, %v", uid, pol, ok)
+	}
+	if _, _, ok := m.currentLogin(unknown); ok {
+		t.Errorf("a login of an unknown policy must not be valid")
+	}
+	mock.Add(2 * time.Hour)
+	if _, _, ok := m.currentLogin(admin); ok {
+		t.Errorf("the login must expire with the access duration of its policy")
+	}
+	if _, _, ok := m.currentLogin(wiki); !ok {
+		t.Errorf("the login must be valid for the access duration of its policy")
+	}
+	mock.Add(time.Duration(defaultAccessDuration))
+	if _, _, ok := m.currentLogin(def); ok {
+		t.Errorf("the login must expire with the default access duration")
+	}
+}
@@ -0,0 +1,378 @@
+package doorman
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap"
+	"go.uber.org/zap"
+)
+
+const (
+	policyField = "policy"
+)
+
+// Policy overrides the settings of the app for the sites whose handler
+// references it. Empty values are taken from the app. Grants are scoped per
+// policy, so a grant for one policy does not admit the client to the sites
+// of another one.
+type Policy struct {
+	OperationMode  operationMode `json:"operation_mode,omitempty"`
+	CaptchaMode    *captchaMode  `json:"captcha_mode,omitempty"`
+	AccessDuration Duration      `json:"access_duration,omitempty"`
+	Users          []string      `json:"users,omitempty"`
+	AllowGroups    []string      `json:"allow_groups,omitempty"`
+	DenyGroups     []string      `json:"deny_groups,omitempty"`
+	Channels       []string      `json:"channels,omitempty"`
+	// RequirePassword overrides require_password of the app
+	RequirePassword *bool `json:"require_password,omitempty"`
+}
+
+// groupRules allow users by their groups. A member of a denied group is
+// never allowed; with allowed groups the user must be a member of one of
+// them.
+type groupRules struct {
+	allow []string
+	deny  []string
+}
+
+func (gr groupRules) empty() bool {
+	return len(gr.allow) == 0 && len(gr.deny) == 0
+}
+
+func containsGroup(list []string, groups []string) bool {
+	for _, l := range list {
+		for _, g := range groups {
+			if sameGroup(l, g) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameGroup compares the names case insensitive; groups which are DNs are
+// compared by their RDNs, so the spacing of the DN does not matter.
+func sameGroup(a, b string) bool {
+	if strings.EqualFold(a, b) {
+		return true
+	}
+	if !strings.Contains(a, "=") || !strings.Contains(b, "=") {
+		return false
+	}
+	da, err := ldap.ParseDN(a)
+	if err != nil {
+		return false
+	}
+	db, err := ldap.ParseDN(b)
+	if err != nil {
+		return false
+	}
+	if len(da.RDNs) != len(db.RDNs) {
+		return false
+	}
+	for i, ra := range da.RDNs {
+		rb := db.RDNs[i]
+		if len(ra.Attributes) != len(rb.Attributes) {
+			return false
+		}
+		for j, aa := range ra.Attributes {
+			ab := rb.Attributes[j]
+			if !strings.EqualFold(aa.Type, ab.Type) || !strings.EqualFold(aa.Value, ab.Value) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (gr groupRules) allows(groups []string) bool {
+	if containsGroup(gr.deny, groups) {
+		return false
+	}
+	return len(gr.allow) == 0 || containsGroup(gr.allow, groups)
+}
+
+// policy is a policy where the empty values are filled with the settings of
+// the app. The default policy has no name.
+type policy struct {
+	name     string
+	mode     operationMode
+	captcha  captchaMode
+	access   time.Duration
+	users    []string
+	groups   []groupRules
+	channels []string
+	password bool
+}
+
+// allows returns true if the user may be authorized with the policy. The
+// user must be in the list of users, if there is one, and every group rule
+// must allow the groups of the user.
+func (p *policy) allows(ue *UserEntry) bool {
+	if len(p.users) > 0 {
+		found := false
+		for _, u := range p.users {
+			if u == ue.UID {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	for _, gr := range p.groups {
+		if !gr.allows(ue.Groups) {
+			return false
+		}
+	}
+	return true
+}
+
+// withGroups returns a copy of the policy with the additional group rules.
+func (p *policy) withGroups(gr groupRules) *policy {
+	if gr.empty() {
+		return p
+	}
+	np := *p
+	np.groups = append(append([]groupRules{}, p.groups...), gr)
+	return &np
+}
+
+func validatePolicyName(name string) error {
+	if name == "" || strings.ContainsAny(name, ": /") {
+		return fmt.Errorf("illegal policy name: %q", name)
+	}
+	return nil
+}
+
+// validatePolicies checks the named policies like the settings of the app.
+func (m *MiddlewareApp) validatePolicies() error {
+	for name, p := range m.Policies {
+		if err := validatePolicyName(name); err != nil {
+			return err
+		}
+		if p == nil {
+			return fmt.Errorf("policy %q is empty", name)
+		}
+		if p.OperationMode != "" {
+			if _, valid := validOpModes[p.OperationMode]; !valid {
+				return fmt.Errorf("invalid operation mode in policy %q: %s", name, p.OperationMode)
+			}
+			if p.OperationMode.isOTP() && (!m.canDoOTP() || m.Issuer == "") {
+				return fmt.Errorf("policy %q uses OTP, but no OTP transport or issuer is configured", name)
+			}
+		}
+		if p.CaptchaMode != nil && *p.CaptchaMode != captchaNone && *p.CaptchaMode != captchaMath && *p.CaptchaMode != captchaFull {
+			return fmt.Errorf("invalid captcha mode in policy %q: %s", name, *p.CaptchaMode)
+		}
+		if len(p.AllowGroups) > 0 || len(p.DenyGroups) > 0 {
+			m.lookupGroups = true
+		}
+	}
+	return nil
+}
+
+// userOf returns the user for a grant. The user is only searched in the
+// backends if groups are checked somewhere, otherwise only the uid is set.
+func (m *MiddlewareApp) userOf(uid string) (*UserEntry, error) {
+	if !m.lookupGroups {
+		return &UserEntry{UID: uid}, nil
+	}
+	return m.searchUser(uid)
+}
+
+// namedPolicy returns the policy with the given name, the empty name is the
+// default policy of the app.
+func (m *MiddlewareApp) namedPolicy(name string) (*policy, bool) {
+	p := &policy{
+		mode:     m.OperationMode,
+		captcha:  m.CaptchaMode,
+		access:   time.Duration(m.AccessDuration),
+		channels: m.Channels,
+		password: m.RequirePassword,
+	}
+	if p.mode == "" {
+		p.mode = operationsModeToken
+	}
+	if name == "" {
+		return p, true
+	}
+	np, ok := m.Policies[name]
+	if !ok || np == nil {
+		return p, false
+	}
+	p.name = name
+	if np.OperationMode != "" {
+		p.mode = np.OperationMode
+	}
+	if np.CaptchaMode != nil {
+		p.captcha = *np.CaptchaMode
+	}
+	if np.AccessDuration != 0 {
+		p.access = time.Duration(np.AccessDuration)
+	}
+	if len(np.Channels) > 0 {
+		p.channels = np.Channels
+	}
+	if np.RequirePassword != nil {
+		p.password = *np.RequirePassword
+	}
+	p.users = np.Users
+	p = p.withGroups(groupRules{allow: np.AllowGroups, deny: np.DenyGroups})
+	return p, true
+}
+
+type policyCtxKey struct{}
+
+func withPolicy(r *http.Request, p *policy) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), policyCtxKey{}, p))
+}
+
+// policyOf returns the policy of the request, it is the default policy if
+// the request was not routed by a handler.
+func (m *MiddlewareApp) policyOf(r *http.Request) *policy {
+	if p, ok := r.Context().Value(policyCtxKey{}).(*policy); ok {
+		return p
+	}
+	p, _ := m.namedPolicy("")
+	return p
+}
+
+// gatePolicy returns the policy for a call of the gate on the auth host.
+// The gate is shared by all sites. A call for a site carries the signed
+// return_to with the policy and the group rules of the site, a call for a
+// device uses the ones stored with the device. Otherwise the UI sends the
+// name of the policy, which is rejected if every site of the policy has
+// group rules: without them the gate would send a token to a user who is
+// not a member. The client chooses the policy, so /sendUser stores it in the
+// cookie and the later steps are checked with checkLogin.
+func (m *MiddlewareApp) gatePolicy(r *http.Request, handler *policy) (*policy, error) {
+	if rt := r.FormValue(returnToField); rt != "" {
+		gt, err := m.verifyGateTarget(rt)
+		if err != nil {
+			return nil, fmt.Errorf("illegal return_to value: %w", err)
+		}
+		return m.sitePolicy(handler, gt.Policy, gt.Groups)
+	}
+	if uc := r.FormValue(userCodeField); uc != "" {
+		if _, da, err := m.findDevice(uc); err == nil {
+			return m.sitePolicy(handler, da.Policy, da.Groups)
+		}
+	}
+	name := r.URL.Query().Get(policyField)
+	if name == "" || name == handler.name {
+		return handler, nil
+	}
+	p, ok := m.namedPolicy(name)
+	if !ok {
+		return handler, nil
+	}
+	if !m.openPolicies[name] {
+		return nil, fmt.Errorf("policy %q is only used by sites with group rules", name)
+	}
+	return p, nil
+}
+
+// sitePolicy returns the named policy with the group rules of a site.
+func (m *MiddlewareApp) sitePolicy(handler *policy, name string, groups []storedGroupRules) (*policy, error) {
+	p := handler
+	if name != handler.name {
+		np, ok := m.namedPolicy(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown policy: %q", name)
+		}
+		p = np
+	}
+	for _, g := range groups {
+		p = p.withGroups(groupRules{allow: g.Allow, deny: g.Deny})
+	}
+	return p, nil
+}
+
+// storedGroupRules are group rules in the signed return_to or in a device
+// authorization.
+type storedGroupRules struct {
+	Allow []string `json:"allow,omitempty"`
+	Deny  []string `json:"deny,omitempty"`
+}
+
+func storeGroups(p *policy) []storedGroupRules {
+	var res []storedGroupRules
+	for _, gr := range p.groups {
+		res = append(res, storedGroupRules{Allow: gr.allow, Deny: gr.deny})
+	}
+	return res
+}
+
+// openPolicy records that a site uses the policy without group rules of its
+// handler, so the gate can be called with the name of the policy.
+func (m *MiddlewareApp) openPolicy(name string) {
+	if m.openPolicies == nil {
+		m.openPolicies = make(map[string]bool)
+	}
+	m.openPolicies[name] = true
+}
+
+// identityAllowed checks the user of a personal token or a client
+// certificate against the users and group rules of the handler, like the
+// gate checks a user before the grant.
+func (m *Middleware) identityAllowed(uid, clip string) bool {
+	if len(m.policy.users) == 0 && len(m.policy.groups) == 0 {
+		// the identity need not be a user of the backends
+		return true
+	}
+	ue, err := m.app.userOf(uid)
+	if err != nil {
+		m.app.logger.Info("cannot find user of identity", zap.String("uid", uid), zap.Error(err))
+		return false
+	}
+	if !m.policy.allows(ue) {
+		m.app.audit("identity not allowed by policy", zap.String("uid", uid), zap.String("policy", m.policy.name), zap.String("clientip", clip))
+		return false
+	}
+	return true
+}
+
+// grantGroupsAllowed checks the groups of the grant of the client against
+// the group rules of the handler. The grant can be for a policy which is
+// shared with other handlers, so the rules of the handler are checked for
+// every request. A whitelisted client has no grant and is allowed.
+func (m *Middleware) grantGroupsAllowed(clip string) bool {
+	if m.groups.empty() || m.app.store.whs.isAllowed(m.app.logger, clip) {
+		return true
+	}
+	g, ok := m.app.store.grantOf(m.app.logger, clip, m.policy.name)
+	if !ok {
+		return true
+	}
+	return m.groups.allows(g.Groups)
+}
+
+// loginCookie is the cookie of a user who passed /sendUser with the policy.
+func loginCookie(pol *policy, ue *UserEntry) cookieData {
+	return cookieData{
+		uidField:    ue.UID,
+		mailField:   ue.EMail,
+		policyField: pol.name,
+	}
+}
+
+// checkLogin rejects a login which was started with another policy, so the
+// checks of a lax policy cannot be used for the grant of a strict one. A
+// policy with a password needs a recent password check of the login.
+func (m *MiddlewareApp) checkLogin(data cookieData, pol *policy) (string, int) {
+	if name, _ := data[policyField].(string); name != pol.name {
+		m.audit("policy of login changed", zap.Any("uid", data[uidField]), zap.String("login", name), zap.String("policy", pol.name))
+		return "Login was started for another policy", http.StatusForbidden
+	}
+	if pol.password && !m.passwordVerified(data) {
+		m.audit("login without password", zap.Any("uid", data[uidField]), zap.String("policy", pol.name))
+		return "Password required", http.StatusForbidden
+	}
+	return "", 0
+}
@@ -0,0 +1,384 @@
+package doorman
+
+import (
+	"bytes"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+func newPolicyApp(t *testing.T) *MiddlewareApp {
+	m, _ := newDeviceApp(t)
+	none := captchaNone
+	m.OperationMode = operationsModeToken
+	m.CaptchaMode = captchaMath
+	m.Channels = []string{"mail"}
+	m.Policies = map[string]*Policy{
+		"wiki":  {AccessDuration: Duration(24 * time.Hour)},
+		"admin": {OperationMode: operationsModeLink, CaptchaMode: &none, AccessDuration: Duration(time.Hour), Users: []string{"ddk"}, Channels: []string{"sms"}},
+	}
+	m.userbackends = &userBackends{searchers: []userSearcher{&userlistBackend{{UID: "ddk"}, {UID: "other"}}}}
+	return m
+}
+
+func multipartRequest(t *testing.T, target string, values map[string]string) *http.Request {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, v := range values {
+		if err := mw.WriteField(k, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, target, &buf)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.RemoteAddr = "192.0.2.10:4711"
+	return r
+}
+
+func Test_MiddlewareApp_namedPolicy(t *testing.T) {
+	m := newPolicyApp(t)
+	tests := []struct {
+		name string
+		want policy
+		ok   bool
+	}{
+		{name: "", want: policy{mode: operationsModeToken, captcha: captchaMath, access: time.Duration(defaultAccessDuration), channels: []string{"mail"}}, ok: true},
+		{name: "wiki", want: policy{name: "wiki", mode: operationsModeToken, captcha: captchaMath, access: 24 * time.Hour, channels: []string{"mail"}}, ok: true},
+		{name: "admin", want: policy{name: "admin", mode: operationsModeLink, captcha: captchaNone, access: time.Hour, users: []string{"ddk"}, channels: []string{"sms"}}, ok: true},
+		{name: "unknown"},
+	}
+	for _, tt := range tests {
+		got, ok := m.namedPolicy(tt.name)
+		if ok != tt.ok {
+			t.Errorf("namedPolicy(%q) ok = %v, want %v", tt.name, ok, tt.ok)
+			continue
+		}
+		if ok && (got.name != tt.want.name || got.mode != tt.want.mode || got.captcha != tt.want.captcha || got.access != tt.want.access ||
+			strings.Join(got.users, ",") != strings.Join(tt.want.users, ",") || strings.Join(got.channels, ",") != strings.Join(tt.want.channels, ",")) {
+			t.Errorf("namedPolicy(%q) = %+v, want %+v", tt.name, *got, tt.want)
+		}
+	}
+}
+
+func Test_MiddlewareApp_validatePolicies(t *testing.T) {
+	bad := captchaMode("image")
+	tests := []struct {
+		name     string
+		policies map[string]*Policy
+		wantErr  bool
+	}{
+		{name: "valid", policies: map[string]*Policy{"wiki": {OperationMode: operationsModeLink}}},
+		{name: "illegal name", policies: map[string]*Policy{"wiki:admin": {}}, wantErr: true},
+		{name: "empty policy", policies: map[string]*Policy{"wiki": nil}, wantErr: true},
+		{name: "illegal mode", policies: map[string]*Policy{"wiki": {OperationMode: "sms"}}, wantErr: true},
+		{name: "otp without transport", policies: map[string]*Policy{"wiki": {OperationMode: operationsModeOTP}}, wantErr: true},
+		{name: "illegal captcha", policies: map[string]*Policy{"wiki": {CaptchaMode: &bad}}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := &MiddlewareApp{Policies: tt.policies}
+			if err := m.validatePolicies(); (err != nil) != tt.wantErr {
+				t.Errorf("validatePolicies() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_persistentStore_grantsPerPolicy(t *testing.T) {
+	m := newPolicyApp(t)
+	_, _ = m.store.allowUserIP(zap.NewNop(), "wiki", "ddk", "192.0.2.10", time.Hour)
+
+	if !m.store.isAllowed("192.0.2.10", "wiki") {
+		t.Errorf("a grant must be valid for its policy")
+	}
+	if m.store.isAllowed("192.0.2.10", "admin") || m.store.isAllowed("192.0.2.10", "") {
+		t.Errorf("a grant must not be valid for another policy")
+	}
+	if g, ok := m.store.grantOf(zap.NewNop(), "192.0.2.10", "wiki"); !ok || g.UID != "ddk" {
+		t.Errorf("grantOf() = %+v, %v", g, ok)
+	}
+	grants, err := m.store.listGrants(zap.NewNop())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(grants) != 1 || grants[0].Policy != "wiki" || grants[0].Range != "192.0.2.10" {
+		t.Errorf("listGrants() = %+v", grants)
+	}
+}
+
+func Test_MiddlewareApp_gatePolicy(t *testing.T) {
+	m := newPolicyApp(t)
+	m.openPolicy("admin")
+	def, _ := m.namedPolicy("")
+	wiki, _ := m.namedPolicy("wiki")
+	tests := []struct {
+		target  string
+		handler *policy
+		want    string
+		wantErr bool
+	}{
+		{target: "https://auth.example.com/sendUser", handler: def, want: ""},
+		{target: "https://auth.example.com/sendUser?policy=admin", handler: def, want: "admin"},
+		{target: "https://auth.example.com/sendUser?policy=unknown", handler: wiki, want: "wiki"},
+		{target: "https://auth.example.com/sendUser", handler: wiki, want: "wiki"},
+		{target: "https://auth.example.com/sendUser?policy=wiki", handler: def, wantErr: true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(http.MethodPost, tt.target, nil)
+		got, err := m.gatePolicy(r, tt.handler)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("gatePolicy(%s) error = %v, wantErr %v", tt.target, err, tt.wantErr)
+			continue
+		}
+		if !tt.wantErr && got.name != tt.want {
+			t.Errorf("gatePolicy(%s) = %q, want %q", tt.target, got.name, tt.want)
+		}
+	}
+}
+
+func Test_sendUser_policyUsers(t *testing.T) {
+	m := newPolicyApp(t)
+	admin, _ := m.namedPolicy("admin")
+	_, _ = m.store.allowUserIP(zap.NewNop(), "admin", "ddk", "192.0.2.10", time.Hour)
+
+	w := httptest.NewRecorder()
+	rs, rc := m.sendUser(w, withPolicy(multipartRequest(t, "https://auth.example.com/sendUser", map[string]string{uidField: "other"}), admin))
+	if rc != http.StatusForbidden {
+		t.Errorf("sendUser() for a user outside of the policy = %d, %+v", rc, rs)
+	}
+	w = httptest.NewRecorder()
+	rs, rc = m.sendUser(w, withPolicy(multipartRequest(t, "https://auth.example.com/sendUser", map[string]string{uidField: "ddk"}), admin))
+	if rc != 0 || !rs.Reload {
+		t.Errorf("sendUser() for a granted user of the policy = %d, %+v", rc, rs)
+	}
+}
+
+func Test_checkToken_policyMode(t *testing.T) {
+	m := newPolicyApp(t)
+	admin, _ := m.namedPolicy("admin")
+	w := httptest.NewRecorder()
+	if _, rc := m.checkToken(w, withPolicy(multipartRequest(t, "https://auth.example.com/checkToken", map[string]string{tokenField: "123456"}), admin)); rc != http.StatusForbidden {
+		t.Errorf("checkToken() in a link policy = %d, want %d", rc, http.StatusForbidden)
+	}
+}
+
+func Test_gateURL_policy(t *testing.T) {
+	m := newPolicyApp(t)
+	m.ReturnToHosts = []string{"wiki.example.com"}
+	wiki, _ := m.namedPolicy("wiki")
+	r := withPolicy(httptest.NewRequest(http.MethodGet, "https://wiki.example.com/page", nil), wiki)
+	gu, err := m.gateURL(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(gu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := u.Query().Get(policyField); got != "wiki" {
+		t.Errorf("policy of gate url = %q, want %q", got, "wiki")
+	}
+}
+
+func Test_gatePolicy_siteGroups(t *testing.T) {
+	m := newPolicyApp(t)
+	m.ReturnToHosts = []string{"wiki.example.com"}
+	m.lookupGroups = true
+	m.userbackends = &userBackends{searchers: []userSearcher{&userlistBackend{{UID: "ddk", Groups: []string{"admins"}}, {UID: "other"}}}}
+	def, _ := m.namedPolicy("")
+	wiki, _ := m.namedPolicy("wiki")
+	site := wiki.withGroups(groupRules{allow: []string{"admins"}})
+
+	gu, err := m.gateURL(withPolicy(httptest.NewRequest(http.MethodGet, "https://wiki.example.com/page", nil), site))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(gu)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := u.Query().Get(returnToField)
+	request := func(values map[string]string) *http.Request {
+		return multipartRequest(t, "https://auth.example.com/sendUser?policy=wiki", values)
+	}
+	pol, err := m.gatePolicy(request(map[string]string{uidField: "other", returnToField: rt}), def)
+	if err != nil || pol.name != "wiki" || !reflect.DeepEqual(pol.groups, site.groups) {
+		t.Fatalf("gatePolicy() = %+v, %v, want the groups of the site", pol, err)
+	}
+	pol.captcha = captchaNone
+	w := httptest.NewRecorder()
+	if rs, rc := m.sendUser(w, withPolicy(request(map[string]string{uidField: "other", returnToField: rt}), pol)); rc != http.StatusForbidden {
+		t.Errorf("sendUser() for a user outside of the groups of the site = %d, %+v", rc, rs)
+	}
+
+	// the site has group rules, so the gate rejects a call without them
+	if pol, err := m.gatePolicy(request(map[string]string{uidField: "other"}), def); err == nil {
+		t.Errorf("gatePolicy() without return_to = %+v", pol)
+	}
+	if pol, err := m.gatePolicy(request(map[string]string{uidField: "other", returnToField: rt + "x"}), def); err == nil {
+		t.Errorf("gatePolicy() with a forged return_to = %+v", pol)
+	}
+	// a site without group rules may be left with the name of the policy
+	m.openPolicy("wiki")
+	if pol, err := m.gatePolicy(request(map[string]string{uidField: "other"}), def); err != nil || len(pol.groups) != 0 {
+		t.Errorf("gatePolicy() of an open policy = %+v, %v", pol, err)
+	}
+}
+
+func Test_policy_allows(t *testing.T) {
+	tests := []struct {
+		name string
+		pol  *policy
+		ue   UserEntry
+		want bool
+	}{
+		{name: "no rules", pol: &policy{}, ue: UserEntry{UID: "ddk"}, want: true},
+		{name: "listed user", pol: &policy{users: []string{"ddk"}}, ue: UserEntry{UID: "ddk"}, want: true},
+		{name: "other user", pol: &policy{users: []string{"ddk"}}, ue: UserEntry{UID: "other"}, want: false},
+		{name: "allowed group", pol: (&policy{}).withGroups(groupRules{allow: []string{"wiki"}}), ue: UserEntry{UID: "ddk", Groups: []string{"staff", "Wiki"}}, want: true},
+		{name: "no allowed group", pol: (&policy{}).withGroups(groupRules{allow: []string{"wiki"}}), ue: UserEntry{UID: "ddk", Groups: []string{"staff"}}, want: false},
+		{name: "no groups", pol: (&policy{}).withGroups(groupRules{allow: []string{"wiki"}}), ue: UserEntry{UID: "ddk"}, want: false},
+		{name: "denied group", pol: (&policy{}).withGroups(groupRules{allow: []string{"wiki"}, deny: []string{"contractors"}}), ue: UserEntry{UID: "ddk", Groups: []string{"wiki", "contractors"}}, want: false},
+		{name: "allowed dn", pol: (&policy{}).withGroups(groupRules{allow: []string{"cn=admins,ou=it,dc=example,dc=com"}}), ue: UserEntry{UID: "ddk", Groups: []string{"CN=Admins, OU=IT, DC=example, DC=com"}}, want: true},
+		{name: "dn in other ou", pol: (&policy{}).withGroups(groupRules{allow: []string{"cn=admins,ou=it,dc=example,dc=com"}}), ue: UserEntry{UID: "ddk", Groups: []string{"cn=admins,ou=sales,dc=example,dc=com"}}, want: false},
+		{
+			name: "policy and handler rules",
+			pol:  (&policy{}).withGroups(groupRules{allow: []string{"staff"}}).withGroups(groupRules{allow: []string{"wiki"}}),
+			ue:   UserEntry{UID: "ddk", Groups: []string{"staff"}},
+			want: false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.pol.allows(&tt.ue); got != tt.want {
+				t.Errorf("allows() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_sendUser_policyGroups(t *testing.T) {
+	m := newPolicyApp(t)
+	m.Policies["admin"].AllowGroups = []string{"admins"}
+	m.userbackends = &userBackends{searchers: []userSearcher{&userlistBackend{{UID: "ddk", Groups: []string{"staff"}}}}}
+	admin, _ := m.namedPolicy("admin")
+
+	w := httptest.NewRecorder()
+	if rs, rc := m.sendUser(w, withPolicy(multipartRequest(t, "https://auth.example.com/sendUser", map[string]string{uidField: "ddk"}), admin)); rc != http.StatusForbidden {
+		t.Errorf("sendUser() for a user outside of the groups = %d, %+v", rc, rs)
+	}
+}
+
+func Test_Middleware_grantGroupsAllowed(t *testing.T) {
+	m := newBlockingApp(t)
+	m.lookupGroups = true
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "ddk", "192.0.2.10", time.Hour, "wiki")
+	_, _ = m.store.allowUserIP(zap.NewNop(), "", "other", "192.0.2.20", time.Hour, "staff")
+	def, _ := m.namedPolicy("")
+	mw := &Middleware{app: m, policy: def, groups: groupRules{allow: []string{"wiki"}}}
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "192.0.2.10", want: true},
+		{ip: "192.0.2.20", want: false},
+		{ip: "10.1.1.1", want: true},
+	}
+	for _, tt := range tests {
+		if got := mw.grantGroupsAllowed(tt.ip); got != tt.want {
+			t.Errorf("grantGroupsAllowed(%s) = %v, want %v", tt.ip, got, tt.want)
+		}
+	}
+}
+
+// withCookies adds the cookies which were set in the response to the
+// request; like a browser it keeps the last value of a cookie.
+func withCookies(r *http.Request, w *httptest.ResponseRecorder) *http.Request {
+	last := make(map[string]*http.Cookie)
+	for _, c := range w.Result().Cookies() {
+		last[c.Name] = c
+	}
+	for _, c := range last {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+type nopTransport struct{}
+
+func (nopTransport) Send(lg *zap.Logger, a addressable, subject, shortmessage, body string) (string, error) {
+	return "", nil
+}
+
+func Test_checkToken_otherPolicy(t *testing.T) {
+	t.Setenv("DUMMYTOKEN", "123456")
+	m := newPolicyApp(t)
+	none := captchaNone
+	m.Policies["wiki"].CaptchaMode = &none
+	m.Policies["strict"] = &Policy{AccessDuration: Duration(time.Hour)}
+	m.transporters = transporters{"mail": nopTransport{}}
+	wiki, _ := m.namedPolicy("wiki")
+	strict, _ := m.namedPolicy("strict")
+
+	w := httptest.NewRecorder()
+	if rs, rc := m.sendUser(w, withPolicy(multipartRequest(t, "https://auth.example.com/sendUser?policy=wiki", map[string]string{uidField: "ddk"}), wiki)); rc/100 != 2 {
+		t.Fatalf("sendUser() = %d, %+v", rc, rs)
+	}
+	check := func(pol *policy) int {
+		r := withCookies(multipartRequest(t, "https://auth.example.com/checkToken?policy="+pol.name, map[string]string{tokenField: "123456"}), w)
+		_, rc := m.checkToken(httptest.NewRecorder(), withPolicy(r, pol))
+		return rc
+	}
+	if rc := check(strict); rc != http.StatusForbidden {
+		t.Errorf("checkToken() with another policy = %d, want %d", rc, http.StatusForbidden)
+	}
+	if m.store.isAllowed("192.0.2.10", "strict") {
+		t.Errorf("the login of another policy must not grant access")
+	}
+	if rc := check(wiki); rc != http.StatusOK {
+		t.Errorf("checkToken() with the policy of the login = %d", rc)
+	}
+}
+
+func Test_Middleware_identityAllowed(t *testing.T) {
+	m := newPolicyApp(t)
+	m.lookupGroups = true
+	m.userbackends = &userBackends{searchers: []userSearcher{&userlistBackend{
+		{UID: "ddk", Groups: []string{"admins"}},
+		{UID: "other", Groups: []string{"staff"}},
+	}}}
+	admin, _ := m.namedPolicy("admin")
+	def, _ := m.namedPolicy("")
+	tests := []struct {
+		name string
+		mw   *Middleware
+		uid  string
+		want bool
+	}{
+		{name: "listed user", mw: &Middleware{app: m, policy: admin}, uid: "ddk", want: true},
+		{name: "user outside of policy", mw: &Middleware{app: m, policy: admin}, uid: "other", want: false},
+		{name: "member of group", mw: &Middleware{app: m, policy: def.withGroups(groupRules{allow: []string{"admins"}})}, uid: "ddk", want: true},
+		{name: "no member of group", mw: &Middleware{app: m, policy: def.withGroups(groupRules{allow: []string{"admins"}})}, uid: "other", want: false},
+		{name: "unknown identity", mw: &Middleware{app: m, policy: def.withGroups(groupRules{allow: []string{"admins"}})}, uid: "cn=robot", want: false},
+		{name: "no rules", mw: &Middleware{app: m, policy: def}, uid: "other", want: true},
+		{name: "unknown identity without rules", mw: &Middleware{app: m, policy: def}, uid: "cn=robot", want: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.mw.identityAllowed(tt.uid, "192.0.2.10"); got != tt.want {
+				t.Errorf("identityAllowed(%q) = %v, want %v", tt.uid, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,157 @@
+package doorman
+
+import (
+	"math/bits"
+	"net/netip"
+)
+
+// prefixTrie is a path compressed binary trie of IPv4 and IPv6 prefixes. A
+// lookup walks at most one node per prefix bit, so its cost depends on the
+// length of the address and not on the number of entries. Entries which are
+// covered by another entry are merged into the larger one, and two halves of
+// a prefix are merged into the prefix itself.
+type prefixTrie struct {
+	v4 *trieNode
+	v6 *trieNode
+}
+
+type trieNode struct {
+	prefix   netip.Prefix
+	terminal bool
+	child    [2]*trieNode
+}
+
+// bitAt returns the bit of the address at the given position, 0 is the
+// most significant bit.
+func bitAt(a netip.Addr, i int) int {
+	if a.Is4() {
+		b := a.As4()
+		return int(b[i/8]>>(7-uint(i%8))) & 1
+	}
+	b := a.As16()
+	return int(b[i/8]>>(7-uint(i%8))) & 1
+}
+
+// commonBits returns the number of leading bits which are equal in both
+// addresses of the same family.
+func commonBits(a, b netip.Addr) int {
+	var x, y []byte
+	if a.Is4() {
+		a4, b4 := a.As4(), b.As4()
+		x, y = a4[:], b4[:]
+	} else {
+		a16, b16 := a.As16(), b.As16()
+		x, y = a16[:], b16[:]
+	}
+	for i := range x {
+		if d := x[i] ^ y[i]; d != 0 {
+			return i*8 + bits.LeadingZeros8(d)
+		}
+	}
+	return len(x) * 8
+}
+
+func (t *prefixTrie) root(a netip.Addr) **trieNode {
+	if a.Is4() {
+		return &t.v4
+	}
+	return &t.v6
+}
+
+// insert adds the prefix to the trie. Single addresses are inserted as a
+// prefix with all bits set.
+func (t *prefixTrie) insert(p netip.Prefix) {
+	if p.Addr().Is4In6() && p.Bits() >= 96 {
+		p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+	}
+	p = p.Masked()
+	insertPrefix(t.root(p.Addr()), p)
+}
+
+func insertPrefix(np **trieNode, p netip.Prefix) {
+	n := *np
+	if n == nil {
+		*np = &trieNode{prefix: p, terminal: true}
+		return
+	}
+	common := commonBits(n.prefix.Addr(), p.Addr())
+	if nb := n.prefix.Bits(); common > nb {
+		common = nb
+	}
+	if pb := p.Bits(); common > pb {
+		common = pb
+	}
+	switch {
+	case common == n.prefix.Bits():
+		// the node contains the new prefix
+		if n.terminal {
+			return
+		}
+		if p.Bits() == n.prefix.Bits() {
+			n.terminal = true
+			n.child = [2]*trieNode{}
+			return
+		}
+		insertPrefix(&n.child[bitAt(p.Addr(), n.prefix.Bits())], p)
+		n.mergeChildren()
+	case common == p.Bits():
+		// the new prefix contains the node and replaces it
+		*np = &trieNode{prefix: p, terminal: true}
+	default:
+		parent := &trieNode{prefix: netip.PrefixFrom(p.Addr(), common).Masked()}
+		parent.child[bitAt(n.prefix.Addr(), common)] = n
+		parent.child[bitAt(p.Addr(), common)] = &trieNode{prefix: p, terminal: true}
+		parent.mergeChildren()
+		*np = parent
+	}
+}
+
+// mergeChildren turns the node into an entry if both halves are entries.
+func (n *trieNode) mergeChildren() {
+	for _, c := range n.child {
+		if c == nil || !c.terminal || c.prefix.Bits() != n.prefix.Bits()+1 {
+			return
+		}
+	}
+	n.terminal = true
+	n.child = [2]*trieNode{}
+}
+
+// lookup returns the entry which contains the address.
+func (t *prefixTrie) lookup(a netip.Addr) (netip.Prefix, bool) {
+	if t == nil {
+		return netip.Prefix{}, false
+	}
+	a = a.Unmap().WithZone("")
+	n := *t.root(a)
+	for n != nil {
+		if !n.prefix.Contains(a) {
+			return netip.Prefix{}, false
+		}
+		if n.terminal {
+			return n.prefix, true
+		}
+		n = n.child[bitAt(a, n.prefix.Bits())]
+	}
+	return netip.Prefix{}, false
+}
+
+// prefixes returns all entries in ascending order, IPv4 first.
+func (t *prefixTrie) prefixes() []netip.Prefix {
+	var res []netip.Prefix
+	var walk func(n *trieNode)
+	walk = func(n *trieNode) {
+		if n == nil {
+			return
+		}
+		if n.terminal {
+			res = append(res, n.prefix)
+			return
+		}
+		walk(n.child[0])
+		walk(n.child[1])
+	}
+	walk(t.v4)
+	walk(t.v6)
+	return res
+}
@@ -0,0 +1,152 @@
+package doorman
+
+import (
+	"fmt"
+	"math/rand"
+	"net/netip"
+	"reflect"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func newTestTrie(t testing.TB, entries ...string) *prefixTrie {
+	pt, err := parseStaticList(entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pt
+}
+
+func Test_prefixTrie_insert(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []string
+		want    []string
+	}{
+		{name: "empty", want: []string{}},
+		{name: "disjoint", entries: []string{"10.0.0.0/8", "192.168.0.0/16"}, want: []string{"10.0.0.0/8", "192.168.0.0/16"}},
+		{name: "covered entry", entries: []string{"10.0.0.0/8", "10.1.0.0/16"}, want: []string{"10.0.0.0/8"}},
+		{name: "covering entry", entries: []string{"10.1.0.0/16", "10.2.3.4", "10.0.0.0/8"}, want: []string{"10.0.0.0/8"}},
+		{name: "duplicate", entries: []string{"10.1.0.0/16", "10.1.0.0/16"}, want: []string{"10.1.0.0/16"}},
+		{name: "halves", entries: []string{"10.0.0.0/25", "10.0.0.128/25"}, want: []string{"10.0.0.0/24"}},
+		{name: "quarters", entries: []string{"10.0.0.0/26", "10.0.0.192/26", "10.0.0.64/26", "10.0.0.128/26"}, want: []string{"10.0.0.0/24"}},
+		{name: "not aligned halves", entries: []string{"10.0.0.128/25", "10.0.1.0/25"}, want: []string{"10.0.0.128/25", "10.0.1.0/25"}},
+		{name: "ipv6", entries: []string{"2001:db8:1::/48", "2001:db8::/32", "fd00::1"}, want: []string{"2001:db8::/32", "fd00::1/128"}},
+		{name: "whole space", entries: []string{"10.0.0.0/8", "0.0.0.0/0", "::/0"}, want: []string{"0.0.0.0/0", "::/0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prefixStrings(newTestTrie(t, tt.entries...)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("prefixes() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_prefixTrie_lookup(t *testing.T) {
+	pt := newTestTrie(t, "10.0.0.0/8", "192.168.1.0/24", "192.168.2.7", "2001:db8::/32", "fe80::1")
+	tests := []struct {
+		ip   string
+		want string
+	}{
+		{ip: "10.200.1.1", want: "10.0.0.0/8"},
+		{ip: "11.0.0.1"},
+		{ip: "192.168.1.255", want: "192.168.1.0/24"},
+		{ip: "192.168.2.7", want: "192.168.2.7/32"},
+		{ip: "192.168.2.8"},
+		{ip: "::ffff:10.1.1.1", want: "10.0.0.0/8"},
+		{ip: "2001:db8:ffff::1", want: "2001:db8::/32"},
+		{ip: "2001:db9::1"},
+		{ip: "fe80::1%eth0", want: "fe80::1/128"},
+	}
+	for _, tt := range tests {
+		got, ok := pt.lookup(netip.MustParseAddr(tt.ip))
+		if ok != (tt.want != "") || (ok && got.String() != tt.want) {
+			t.Errorf("lookup(%s) = %v, %v, want %q", tt.ip, got, ok, tt.want)
+		}
+	}
+	var empty *prefixTrie
+	if _, ok := empty.lookup(netip.MustParseAddr("10.0.0.1")); ok {
+		t.Errorf("lookup() in a nil trie must fail")
+	}
+}
+
+func randomPrefixes(rnd *rand.Rand, n int) []string {
+	res := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if i%4 == 3 {
+			res = append(res, fmt.Sprintf("2001:db8:%x:%x::/64", rnd.Intn(0x10000), rnd.Intn(0x10000)))
+			continue
+		}
+		res = append(res, fmt.Sprintf("%d.%d.%d.0/%d", rnd.Intn(224), rnd.Intn(256), rnd.Intn(256), 16+rnd.Intn(9)))
+	}
+	return res
+}
+
+func Test_prefixTrie_matchesLinearScan(t *testing.T) {
+	rnd := rand.New(rand.NewSource(42))
+	entries := randomPrefixes(rnd, 2000)
+	pt := newTestTrie(t, entries...)
+	var nets []netip.Prefix
+	for _, e := range entries {
+		nets = append(nets, netip.MustParsePrefix(e).Masked())
+	}
+	for i := 0; i < 20000; i++ {
+		ip := netip.AddrFrom4([4]byte{byte(rnd.Intn(224)), byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256))})
+		want := false
+		for _, n := range nets {
+			if n.Contains(ip) {
+				want = true
+				break
+			}
+		}
+		if _, got := pt.lookup(ip); got != want {
+			t.Fatalf("lookup(%s) = %v, linear scan = %v", ip, got, want)
+		}
+	}
+}
+
+func BenchmarkWhitelist_IsAllowed(b *testing.B) {
+	for _, size := range []int{10, 1000, 100000} {
+		rnd := rand.New(rand.NewSource(42))
+		wl := &Whitelist{nets: newTestTrie(b, randomPrefixes(rnd, size)...)}
+		ips := make([]string, 1024)
+		for i := range ips {
+			ips[i] = fmt.Sprintf("%d.%d.%d.%d", rnd.Intn(224), rnd.Intn(256), rnd.Intn(256), rnd.Intn(256))
+		}
+		lg := zap.NewNop()
+		b.Run(fmt.Sprintf("entries=%d", size), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				wl.IsAllowed(lg, ips[i%len(ips)])
+			}
+		})
+	}
+}
+
+// BenchmarkLinearScan is the lookup of the former list of networks for
+// comparison.
+func BenchmarkLinearScan(b *testing.B) {
+	for _, size := range []int{10, 1000, 100000} {
+		rnd := rand.New(rand.NewSource(42))
+		var nets []netip.Prefix
+		for _, e := range randomPrefixes(rnd, size) {
+			nets = append(nets, netip.MustParsePrefix(e).Masked())
+		}
+		ips := make([]netip.Addr, 1024)
+		for i := range ips {
+			ips[i] = netip.AddrFrom4([4]byte{byte(rnd.Intn(224)), byte(rnd.Intn(256)), byte(rnd.Intn(256)), byte(rnd.Intn(256))})
+		}
+		b.Run(fmt.Sprintf("entries=%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				ip := ips[i%len(ips)]
+				for _, n := range nets {
+					if n.Contains(ip) {
+						break
+					}
+				}
+			}
+		})
+	}
+}
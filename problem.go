@@ -0,0 +1,102 @@
+package doorman
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	problemContentType = "application/problem+json"
+)
+
+// problem is a problem document as described in RFC 7807.
+type problem struct {
+	Type     string `json:"type"`
+	Title    string `json:"title"`
+	Status   int    `json:"status"`
+	Detail   string `json:"detail,omitempty"`
+	Instance string `json:"instance,omitempty"`
+	Gate     string `json:"gate,omitempty"`
+}
+
+// isBrowserRequest returns true if the request looks like a navigation of a
+// browser which can display the gate.
+func isBrowserRequest(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	if strings.EqualFold(r.Header.Get("X-Requested-With"), "XMLHttpRequest") {
+		return false
+	}
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+// isGateRequest returns true if the request must be answered by the gate
+// itself: calls of the gate UI and the static assets of the UI.
+func (m *MiddlewareApp) isGateRequest(r *http.Request) bool {
+	if r.URL.Query().Get(dmrequest) != "" {
+		return true
+	}
+	if r.Method != http.MethodGet || r.URL.Path == "/" {
+		return false
+	}
+	f, err := m.assetsDir.Open(r.URL.Path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	return err == nil && !st.IsDir()
+}
+
+func (m *MiddlewareApp) gateLocation(r *http.Request) string {
+	if m.isReturnHostAllowed(r.Host) {
+		if gu, err := m.gateURL(r); err == nil {
+			return gu
+		}
+	}
+	return strings.TrimSuffix(m.IssuerBase, "/") + "/"
+}
+
+// serveProblem answers a non browser request with a problem document which
+// points to the gate.
+func (m *MiddlewareApp) serveProblem(w http.ResponseWriter, r *http.Request) {
+	status := m.NonBrowserStatus
+	if status == 0 {
+		status = http.StatusUnauthorized
+	}
+	pb := problem{
+		Type:     "about:blank",
+		Title:    http.StatusText(status),
+		Status:   status,
+		Detail:   "access to this resource must be authorized with the gate",
+		Instance: r.URL.RequestURI(),
+		Gate:     m.gateLocation(r),
+	}
+	if status == http.StatusUnauthorized {
+		w.Header().Set("WWW-Authenticate", m.wwwAuthenticate())
+	}
+	w.Header().Set("Content-Type", problemContentType)
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(pb); err != nil {
+		m.logger.Error("cannot write problem to stream", zap.Error(err))
+	}
+}
+
+func (m *MiddlewareApp) wwwAuthenticate() string {
+	if m.WWWAuthenticate != "" {
+		return m.WWWAuthenticate
+	}
+	realm := m.Issuer
+	if realm == "" {
+		realm = m.authHost
+	}
+	return fmt.Sprintf("Doorman realm=%q", realm)
+}
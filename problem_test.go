@@ -0,0 +1,118 @@
+package doorman
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func Test_isBrowserRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    bool
+	}{
+		{
+			name:    "browser navigation",
+			method:  http.MethodGet,
+			headers: map[string]string{"Accept": "text/html,application/xhtml+xml,*/*;q=0.8"},
+			want:    true,
+		},
+		{
+			name:    "curl",
+			method:  http.MethodGet,
+			headers: map[string]string{"Accept": "*/*"},
+			want:    false,
+		},
+		{
+			name:    "json client",
+			method:  http.MethodGet,
+			headers: map[string]string{"Accept": "application/json"},
+			want:    false,
+		},
+		{
+			name:    "xhr",
+			method:  http.MethodGet,
+			headers: map[string]string{"Accept": "text/html", "X-Requested-With": "XMLHttpRequest"},
+			want:    false,
+		},
+		{
+			name:    "post",
+			method:  http.MethodPost,
+			headers: map[string]string{"Accept": "text/html"},
+			want:    false,
+		},
+		{
+			name:    "websocket",
+			method:  http.MethodGet,
+			headers: map[string]string{"Accept": "text/html", "Upgrade": "websocket"},
+			want:    false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "http://wiki.example.com/", nil)
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := isBrowserRequest(r); got != tt.want {
+				t.Errorf("isBrowserRequest() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_serveProblem(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		auth     string
+		wantAuth string
+	}{
+		{
+			name:     "default status and header",
+			wantAuth: `Doorman realm="auth.example.com"`,
+		},
+		{
+			name:     "configured header",
+			auth:     `Bearer realm="example"`,
+			wantAuth: `Bearer realm="example"`,
+		},
+		{
+			name:   "forbidden has no authenticate header",
+			status: http.StatusForbidden,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newReturnToApp()
+			m.NonBrowserStatus = tt.status
+			m.WWWAuthenticate = tt.auth
+			w := httptest.NewRecorder()
+			m.serveProblem(w, httptest.NewRequest(http.MethodGet, "http://wiki.example.com/api", nil))
+
+			want := tt.status
+			if want == 0 {
+				want = http.StatusUnauthorized
+			}
+			if w.Code != want {
+				t.Errorf("status = %d, want %d", w.Code, want)
+			}
+			if got := w.Header().Get("WWW-Authenticate"); got != tt.wantAuth {
+				t.Errorf("WWW-Authenticate = %q, want %q", got, tt.wantAuth)
+			}
+			if got := w.Header().Get("Content-Type"); got != problemContentType {
+				t.Errorf("Content-Type = %q, want %q", got, problemContentType)
+			}
+			var pb problem
+			if err := json.NewDecoder(w.Body).Decode(&pb); err != nil {
+				t.Fatal(err)
+			}
+			if pb.Status != want || pb.Gate != "https://auth.example.com/" || pb.Instance != "/api" {
+				t.Errorf("unexpected problem document: %+v", pb)
+			}
+		})
+	}
+}
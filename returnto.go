@@ -0,0 +1,150 @@
+package doorman
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+const (
+	returnToField = "return_to"
+)
+
+// originalURL reconstructs the URL the client requested before it was
+// intercepted by the gate.
+func originalURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil || strings.EqualFold(r.Header.Get("X-Forwarded-Proto"), "https") {
+		scheme = "https"
+	}
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     r.URL.Path,
+		RawPath:  r.URL.RawPath,
+		RawQuery: r.URL.RawQuery,
+	}
+	return u.String()
+}
+
+func hostMatches(pattern, host string) bool {
+	pattern = strings.ToLower(pattern)
+	host = strings.ToLower(host)
+	if strings.HasPrefix(pattern, "*.") {
+		return strings.HasSuffix(host, pattern[1:])
+	}
+	return pattern == host
+}
+
+// isReturnHostAllowed checks if the given host (with an optional port) is a
+// legal target for a redirect after a successful authorization.
+func (m *MiddlewareApp) isReturnHostAllowed(host string) bool {
+	if host == "" {
+		return false
+	}
+	if host == m.authHost {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, p := range m.ReturnToHosts {
+		if hostMatches(p, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MiddlewareApp) checkReturnURL(target string) (*url.URL, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse return url: %w", err)
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return nil, fmt.Errorf("illegal scheme in return url: %q", u.Scheme)
+	}
+	if u.User != nil {
+		return nil, fmt.Errorf("return url must not contain user info")
+	}
+	if !m.isReturnHostAllowed(u.Host) {
+		return nil, fmt.Errorf("host of return url not allowed: %q", u.Host)
+	}
+	return u, nil
+}
+
+// gateTarget is the signed return_to value. Besides the URL it carries the
+// policy and the group rules of the site, so the gate checks the user with
+// them before a token is sent.
+type gateTarget struct {
+	URL    string             `json:"url"`
+	Policy string             `json:"policy,omitempty"`
+	Groups []storedGroupRules `json:"groups,omitempty"`
+}
+
+func (m *MiddlewareApp) signReturnTo(target string, pol *policy) (string, error) {
+	if _, err := m.checkReturnURL(target); err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(gateTarget{URL: target, Policy: pol.name, Groups: storeGroups(pol)})
+	if err != nil {
+		return "", err
+	}
+	return m.secCookie.sign(returnToField, string(data))
+}
+
+// verifyGateTarget decodes a signed return_to value and checks the contained
+// URL against the allow-list again, so a leaked signing key or a changed
+// configuration cannot be abused as an open redirect.
+func (m *MiddlewareApp) verifyGateTarget(signed string) (*gateTarget, error) {
+	data, err := m.secCookie.verify(returnToField, signed)
+	if err != nil {
+		return nil, err
+	}
+	var gt gateTarget
+	if err := json.Unmarshal([]byte(data), &gt); err != nil {
+		return nil, fmt.Errorf("cannot parse return_to: %w", err)
+	}
+	u, err := m.checkReturnURL(gt.URL)
+	if err != nil {
+		return nil, err
+	}
+	gt.URL = u.String()
+	return &gt, nil
+}
+
+// gateURL returns the URL of the gate on the auth host which redirects
+// back to the original request after the user was authorized. The gate
+// uses the policy and the group rules of the request.
+func (m *MiddlewareApp) gateURL(r *http.Request) (string, error) {
+	pol := m.policyOf(r)
+	rt, err := m.signReturnTo(originalURL(r), pol)
+	if err != nil {
+		return "", err
+	}
+	gu := fmt.Sprintf("%s/?%s=%s&%s=1", strings.TrimSuffix(m.IssuerBase, "/"), returnToField, url.QueryEscape(rt), dmrequest)
+	if pol.name != "" {
+		gu += fmt.Sprintf("&%s=%s", policyField, url.QueryEscape(pol.name))
+	}
+	return gu, nil
+}
+
+// setReturnTo fills the redirect of the result, if the request contains a
+// valid return_to value.
+func (m *MiddlewareApp) setReturnTo(r *http.Request, rs *result) {
+	rt := r.FormValue(returnToField)
+	if rt == "" {
+		return
+	}
+	gt, err := m.verifyGateTarget(rt)
+	if err != nil {
+		m.logger.Warn("illegal return_to value", zap.Error(err))
+		return
+	}
+	rs.Redirect = gt.URL
+}
@@ -0,0 +1,107 @@
+package doorman
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+func newReturnToApp(hosts ...string) *MiddlewareApp {
+	return &MiddlewareApp{
+		IssuerBase:    "https://auth.example.com",
+		ReturnToHosts: hosts,
+		authHost:      "auth.example.com",
+		logger:        zap.NewNop(),
+		secCookie:     newCookie(zap.NewNop(), newRandomKey(64), newRandomKey(32), false, ""),
+	}
+}
+
+func Test_returnTo_signAndVerify(t *testing.T) {
+	tests := []struct {
+		name    string
+		hosts   []string
+		target  string
+		wantErr bool
+	}{
+		{
+			name:   "auth host is always allowed",
+			target: "https://auth.example.com/some/path",
+		},
+		{
+			name:   "exact host in allow list",
+			hosts:  []string{"wiki.example.com"},
+			target: "https://wiki.example.com/page?id=1",
+		},
+		{
+			name:   "wildcard host in allow list",
+			hosts:  []string{"*.example.com"},
+			target: "https://wiki.example.com:8443/page",
+		},
+		{
+			name:    "host not in allow list",
+			hosts:   []string{"*.example.com"},
+			target:  "https://evil.com/",
+			wantErr: true,
+		},
+		{
+			name:    "suffix is not a subdomain",
+			hosts:   []string{"*.example.com"},
+			target:  "https://evilexample.com/",
+			wantErr: true,
+		},
+		{
+			name:    "illegal scheme",
+			hosts:   []string{"*.example.com"},
+			target:  "javascript://wiki.example.com/%0aalert(1)",
+			wantErr: true,
+		},
+		{
+			name:    "user info not allowed",
+			hosts:   []string{"*.example.com"},
+			target:  "https://wiki.example.com@evil.com/",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := newReturnToApp(tt.hosts...)
+			signed, err := m.signReturnTo(tt.target, &policy{})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("signReturnTo() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				return
+			}
+			got, err := m.verifyGateTarget(signed)
+			if err != nil {
+				t.Errorf("verifyGateTarget() error = %v", err)
+				return
+			}
+			if got.URL != tt.target {
+				t.Errorf("verifyGateTarget() = %v, want %v", got.URL, tt.target)
+			}
+		})
+	}
+}
+
+func Test_returnTo_rejectsUnsigned(t *testing.T) {
+	m := newReturnToApp("*.example.com")
+	if _, err := m.verifyGateTarget("https://wiki.example.com/"); err == nil {
+		t.Errorf("verifyGateTarget() accepted an unsigned value")
+	}
+	other := newReturnToApp("*.example.com")
+	signed, _ := other.signReturnTo("https://wiki.example.com/", &policy{})
+	if _, err := m.verifyGateTarget(signed); err == nil {
+		t.Errorf("verifyGateTarget() accepted a value signed with another key")
+	}
+}
+
+func Test_originalURL(t *testing.T) {
+	r := httptest.NewRequest("GET", "http://wiki.example.com/page?id=1", nil)
+	r.Header.Set("X-Forwarded-Proto", "https")
+	if got, want := originalURL(r), "https://wiki.example.com/page?id=1"; got != want {
+		t.Errorf("originalURL() = %v, want %v", got, want)
+	}
+}
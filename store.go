@@ -3,6 +3,7 @@ package doorman
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 	"time"
 
 	"github.com/benbjohnson/clock"
@@ -15,7 +16,11 @@ const (
 )
 
 type persistentStore struct {
+	clock    clock.Clock
 	whs      *whitelister
+	bls      *whitelister
+	geo      *geoIP
+	grants   GrantPrefixes
 	users    ttlstore
 	tokensrv *tokenservice
 	log      *zap.Logger
@@ -27,7 +32,7 @@ type blockinfo struct {
 	IP   string `json:"ip"`
 }
 
-func newStore(log *zap.Logger, cl clock.Clock, sst StoreSettings, whs *whitelister) (*persistentStore, error) {
+func newStore(log *zap.Logger, cl clock.Clock, sst StoreSettings, whs, bls *whitelister) (*persistentStore, error) {
 	var kvs kvstore
 	switch sst.PersistentType {
 	case storageMemory:
@@ -38,7 +43,9 @@ func newStore(log *zap.Logger, cl clock.Clock, sst StoreSettings, whs *whitelist
 		return nil, fmt.Errorf("illegal persistent_type: %s", sst.PersistentType)
 	}
 	return &persistentStore{
+		clock:    cl,
 		whs:      whs,
+		bls:      bls,
 		users:    kvs,
 		tokensrv: newOTP(kvs, sst),
 		log:      log,
@@ -46,25 +53,87 @@ func newStore(log *zap.Logger, cl clock.Clock, sst StoreSettings, whs *whitelist
 	}, nil
 }
 
-func (s *persistentStore) isAllowed(clientip string) bool {
+// isAllowed returns true if the client is whitelisted or has a grant for the
+// policy.
+func (s *persistentStore) isAllowed(clientip, pol string) bool {
+	if s.bls != nil && s.bls.isAllowed(s.log, clientip) {
+		s.log.Debug("ip is blocked", zap.String("ip", clientip))
+		return false
+	}
 	if !s.whs.isAllowed(s.log, clientip) {
+		if s.geo != nil && !s.geo.allowed(s.geo.locate(s.log, clientip)) {
+			// grants are not valid for a denied location
+			return false
+		}
 		// if no whitelisting, check if user is allowed
-		return s.isIPAllowed(s.log, clientip)
+		return s.isIPAllowed(s.log, clientip, pol)
 	}
 	s.log.Debug("ip is whitelisted", zap.String("ip", clientip))
 	// ip is whitelisted
 	return true
 }
 
-func (s *persistentStore) isIPAllowed(log *zap.Logger, clientip string) bool {
-	key := userKey("user", clientip)
+func (s *persistentStore) isIPAllowed(log *zap.Logger, clientip, pol string) bool {
+	key := grantKey(pol, s.grants.grantRange(clientip))
 	v, err := s.users.GetTTL(log, key)
 	s.log.Debug("ip entry", zap.String("key", key), zap.String("value", v))
 	return err == nil
 }
 
-func (s *persistentStore) allowUserIP(log *zap.Logger, clip string, ttl time.Duration) error {
-	return s.users.PutTTL(log, userKey("user", clip), "", ttl)
+// allowUserIP grants the range of the client ip to the user for the policy
+// and returns the granted range.
+func (s *persistentStore) allowUserIP(log *zap.Logger, pol, uid, clip string, ttl time.Duration, groups ...string) (string, error) {
+	rng := s.grants.grantRange(clip)
+	data, err := json.Marshal(grant{UID: uid, Range: rng, Policy: pol, Groups: groups, Until: s.clock.Now().Add(ttl).Unix()})
+	if err != nil {
+		return rng, fmt.Errorf("cannot marshal grant: %w", err)
+	}
+	// redis does not overwrite a key, so a new grant of the range would keep
+	// the user and the groups of the former one
+	key := grantKey(pol, rng)
+	s.kvs.Del(log, key)
+	return rng, s.users.PutTTL(log, key, string(data), ttl)
+}
+
+// grantOf returns the grant for the policy which covers the client ip.
+func (s *persistentStore) grantOf(log *zap.Logger, clip, pol string) (*grant, bool) {
+	v, err := s.users.GetTTL(log, grantKey(pol, s.grants.grantRange(clip)))
+	if err != nil {
+		return nil, false
+	}
+	var g grant
+	if err := json.Unmarshal([]byte(v), &g); err != nil || g.UID == "" {
+		return nil, false
+	}
+	return &g, true
+}
+
+// listGrants returns all active grants, the grants of the default policy
+// first.
+func (s *persistentStore) listGrants(log *zap.Logger) ([]grant, error) {
+	keys, err := s.kvs.Keys(log, userKey("user", ""))
+	if err != nil {
+		return nil, err
+	}
+	pkeys, err := s.kvs.Keys(log, userKey("policy", ""))
+	if err != nil {
+		return nil, err
+	}
+	keys = append(keys, pkeys...)
+	res := make([]grant, 0, len(keys))
+	for _, k := range keys {
+		v, err := s.kvs.GetTTL(log, k)
+		if err != nil {
+			continue
+		}
+		var g grant
+		if err := json.Unmarshal([]byte(v), &g); err != nil {
+			// a grant of an older version without data
+			g = grant{Range: strings.TrimPrefix(k, userKey("user", ""))}
+		}
+		res = append(res, g)
+	}
+	return res, nil
 }
 
 func (s *persistentStore) blockinfo(log *zap.Logger, key string) (string, string, error) {
@@ -98,3 +167,12 @@ func (s *persistentStore) unblock(log *zap.Logger, key string, val yesno, ttl ti
 func userKey(user, clip string) string {
 	return fmt.Sprintf("allow:%s:%s", user, clip)
 }
+
+// grantKey returns the key of a grant for the range. Grants of the default
+// policy keep the key of earlier versions.
+func grantKey(pol, rng string) string {
+	if pol == "" {
+		return userKey("user", rng)
+	}
+	return userKey("policy:"+pol, rng)
+}
@@ -1 +1,46 @@
 package doorman
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap"
+)
+
+// setnxStore does not overwrite an existing key, like the redis store.
+type setnxStore struct {
+	*memstore
+}
+
+func (s setnxStore) PutTTL(log *zap.Logger, key, value string, ttl time.Duration) error {
+	if _, err := s.GetTTL(log, key); err == nil {
+		return nil
+	}
+	return s.memstore.PutTTL(log, key, value, ttl)
+}
+
+func Test_persistentStore_allowUserIP_again(t *testing.T) {
+	mock := clock.NewMock()
+	kvs := setnxStore{newMemstore(mock, StoreSettings{})}
+	s := &persistentStore{clock: mock, whs: &whitelister{}, users: kvs, kvs: kvs, log: zap.NewNop()}
+
+	if _, err := s.allowUserIP(zap.NewNop(), "wiki", "ddk", "192.0.2.10", time.Hour, "admins"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.allowUserIP(zap.NewNop(), "wiki", "other", "192.0.2.10", 2*time.Hour, "users"); err != nil {
+		t.Fatal(err)
+	}
+	g, ok := s.grantOf(zap.NewNop(), "192.0.2.10", "wiki")
+	if !ok {
+		t.Fatalf("grantOf() found no grant")
+	}
+	if g.UID != "other" || !reflect.DeepEqual(g.Groups, []string{"users"}) {
+		t.Errorf("grantOf() = %+v, want the user and groups of the second grant", g)
+	}
+	mock.Add(90 * time.Minute)
+	if !s.isIPAllowed(zap.NewNop(), "192.0.2.10", "wiki") {
+		t.Errorf("the second grant must have its own duration")
+	}
+}
@@ -0,0 +1,181 @@
+package doorman
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	aliasEMail  = "email"
+	aliasMobile = "mobile"
+)
+
+// UIDNormalization is applied to the entered uid before the user is
+// searched. Domains restricts the stripped domains and NetBIOS names, without
+// domains every suffix or prefix is stripped.
+type UIDNormalization struct {
+	Trim         bool     `json:"trim,omitempty"`
+	NFKC         bool     `json:"nfkc,omitempty"`
+	CaseFold     bool     `json:"case_fold,omitempty"`
+	StripDomain  bool     `json:"strip_domain,omitempty"`
+	StripNetBIOS bool     `json:"strip_netbios,omitempty"`
+	Domains      []string `json:"domains,omitempty"`
+}
+
+// clean trims the uid and normalizes its unicode form.
+func (un *UIDNormalization) clean(uid string) string {
+	if un == nil {
+		return uid
+	}
+	if un.NFKC {
+		uid = norm.NFKC.String(uid)
+	}
+	if un.Trim {
+		uid = strings.TrimSpace(uid)
+	}
+	return uid
+}
+
+// normalize returns the uid which is searched in the backends, for example
+// "jdoe" for "CORP\JDoe" or "jdoe@corp.example".
+func (un *UIDNormalization) normalize(uid string) string {
+	if un == nil {
+		return uid
+	}
+	uid = un.clean(uid)
+	if un.StripNetBIOS {
+		if dom, user, ok := strings.Cut(uid, `\`); ok && un.strips(dom) {
+			uid = user
+		}
+	}
+	if un.StripDomain {
+		if i := strings.LastIndex(uid, "@"); i > 0 && un.strips(uid[i+1:]) {
+			uid = uid[:i]
+		}
+	}
+	if un.CaseFold {
+		uid = cases.Fold().String(uid)
+	}
+	return uid
+}
+
+func (un *UIDNormalization) strips(domain string) bool {
+	if len(un.Domains) == 0 {
+		return domain != ""
+	}
+	for _, d := range un.Domains {
+		if strings.EqualFold(d, domain) {
+			return true
+		}
+	}
+	return false
+}
+
+func validateAliases(aliases []string) error {
+	for _, a := range aliases {
+		if a != aliasEMail && a != aliasMobile {
+			return fmt.Errorf("unknown user alias: %q", a)
+		}
+	}
+	return nil
+}
+
+// aliasSearcher is a backend which finds a user by an alias, the email or
+// the mobile number.
+type aliasSearcher interface {
+	SearchAlias(log *zap.Logger, alias, value string) (*UserEntry, error)
+}
+
+// userMatcher is a backend which has all users at hand.
+type userMatcher interface {
+	match(fn func(ue *UserEntry) bool) []*UserEntry
+}
+
+// matchAlias returns the only user with the alias. An email is compared
+// case insensitive, a mobile number by its digits.
+func matchAlias(um userMatcher, alias, value string) (*UserEntry, error) {
+	var res []*UserEntry
+	switch alias {
+	case aliasEMail:
+		res = um.match(func(ue *UserEntry) bool { return ue.EMail != "" && strings.EqualFold(ue.EMail, value) })
+	case aliasMobile:
+		num := phoneDigits(value)
+		res = um.match(func(ue *UserEntry) bool { return num != "" && phoneDigits(ue.Mobile) == num })
+	}
+	if len(res) != 1 {
+		return nil, fmt.Errorf("%w: %d users with %s %q", ErrNoUser, len(res), alias, value)
+	}
+	return res[0], nil
+}
+
+func phoneDigits(s string) string {
+	return onlynum.ReplaceAllString(strings.ReplaceAll(s, "+", "00"), "")
+}
+
+// normalizedBackend compares the normalized uids of the users of a backend,
+// so "JDoe" in the backend is found as "jdoe".
+type normalizedBackend struct {
+	backend interface {
+		userSearcher
+		userMatcher
+	}
+	norm *UIDNormalization
+}
+
+// Search returns the only user whose uid normalizes to the uid. Users like
+// "JDoe" and "jdoe" are ambiguous with case folding and are not found.
+func (nb *normalizedBackend) Search(log *zap.Logger, uid string) (*UserEntry, error) {
+	uid = nb.norm.normalize(uid)
+	res := nb.backend.match(func(ue *UserEntry) bool { return nb.norm.normalize(ue.UID) == uid })
+	if len(res) != 1 {
+		if len(res) > 1 {
+			log.Warn("normalized uid is ambiguous", zap.String("uid", uid), zap.Int("users", len(res)))
+		}
+		return nil, fmt.Errorf("%w: %d users with uid %s", ErrNoUser, len(res), uid)
+	}
+	return res[0], nil
+}
+
+func (nb *normalizedBackend) SearchAlias(log *zap.Logger, alias, value string) (*UserEntry, error) {
+	return matchAlias(nb.backend, alias, value)
+}
+
+// normalizeWith compares the normalized uids in the backends which have
+// all users at hand; the other backends get the normalized uid.
+func (ulb *userBackends) normalizeWith(un *UIDNormalization) {
+	if un == nil {
+		return
+	}
+	for i, s := range ulb.searchers {
+		if b, ok := s.(interface {
+			userSearcher
+			userMatcher
+		}); ok {
+			ulb.searchers[i] = &normalizedBackend{backend: b, norm: un}
+		}
+	}
+}
+
+// searchAlias returns the uid of the user with the alias in the first backend
+// which knows it.
+func (ulb *userBackends) searchAlias(log *zap.Logger, alias, value string) (string, error) {
+	for _, b := range ulb.searchers {
+		as, ok := b.(aliasSearcher)
+		if !ok {
+			continue
+		}
+		ue, err := as.SearchAlias(log, alias, value)
+		if err == nil {
+			return ue.UID, nil
+		}
+		if !errors.Is(err, ErrNoUser) {
+			return "", err
+		}
+	}
+	return "", fmt.Errorf("%w: %s %q", ErrNoUser, alias, value)
+}
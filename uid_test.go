@@ -0,0 +1,161 @@
+package doorman
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/go-ldap/ldap"
+	"go.uber.org/zap"
+)
+
+func Test_UIDNormalization_normalize(t *testing.T) {
+	all := &UIDNormalization{Trim: true, NFKC: true, CaseFold: true, StripDomain: true, StripNetBIOS: true}
+	corp := &UIDNormalization{StripDomain: true, StripNetBIOS: true, Domains: []string{"corp.example", "CORP"}}
+	tests := []struct {
+		name string
+		un   *UIDNormalization
+		uid  string
+		want string
+	}{
+		{name: "none", un: nil, uid: " JDoe ", want: " JDoe "},
+		{name: "case", un: all, uid: "JDoe", want: "jdoe"},
+		{name: "trim", un: all, uid: "  jdoe\t", want: "jdoe"},
+		{name: "domain", un: all, uid: "JDoe@Corp.Example", want: "jdoe"},
+		{name: "netbios", un: all, uid: `CORP\jdoe`, want: "jdoe"},
+		{name: "nfkc", un: all, uid: "ｊｄｏｅ", want: "jdoe"},
+		{name: "fold", un: all, uid: "Straße", want: "strasse"},
+		{name: "only at", un: all, uid: "@jdoe", want: "@jdoe"},
+		{name: "known domain", un: corp, uid: "JDoe@corp.example", want: "JDoe"},
+		{name: "unknown domain", un: corp, uid: "jdoe@other.example", want: "jdoe@other.example"},
+		{name: "known netbios", un: corp, uid: `corp\jdoe`, want: "jdoe"},
+		{name: "unknown netbios", un: corp, uid: `OTHER\jdoe`, want: `OTHER\jdoe`},
+		{name: "no trim", un: &UIDNormalization{CaseFold: true}, uid: " JDoe", want: " jdoe"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.un.normalize(tt.uid); got != tt.want {
+				t.Errorf("normalize(%q) = %q, want %q", tt.uid, got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_matchAlias(t *testing.T) {
+	ulb := &userlistBackend{
+		{UID: "jdoe", EMail: "John.Doe@corp.example", Mobile: "+49 171 1234"},
+		{UID: "shared1", EMail: "team@corp.example"},
+		{UID: "shared2", EMail: "team@corp.example"},
+		{UID: "nomail"},
+	}
+	tests := []struct {
+		alias   string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{alias: aliasEMail, value: "john.doe@CORP.example", want: "jdoe"},
+		{alias: aliasMobile, value: "0049-171-1234", want: "jdoe"},
+		{alias: aliasMobile, value: "+491711234", want: "jdoe"},
+		{alias: aliasEMail, value: "team@corp.example", wantErr: true},
+		{alias: aliasEMail, value: "", wantErr: true},
+		{alias: aliasMobile, value: "", wantErr: true},
+		{alias: "uid", value: "jdoe", wantErr: true},
+	}
+	for _, tt := range tests {
+		ue, err := ulb.SearchAlias(zap.NewNop(), tt.alias, tt.value)
+		if tt.wantErr {
+			if !errors.Is(err, ErrNoUser) {
+				t.Errorf("SearchAlias(%s, %q) error = %v, want ErrNoUser", tt.alias, tt.value, err)
+			}
+			continue
+		}
+		if err != nil || ue.UID != tt.want {
+			t.Errorf("SearchAlias(%s, %q) = %+v, %v, want %q", tt.alias, tt.value, ue, err, tt.want)
+		}
+	}
+}
+
+func Test_searchUser_normalized(t *testing.T) {
+	m := newPolicyApp(t)
+	m.UIDNormalization = &UIDNormalization{Trim: true, CaseFold: true, StripDomain: true, StripNetBIOS: true}
+	m.UserAliases = []string{aliasEMail, aliasMobile}
+	m.userbackends = &userBackends{searchers: []userSearcher{
+		&userlistBackend{{UID: "JDoe", EMail: "john.doe@example.com", Mobile: "0049171"}},
+	}}
+	m.userbackends.normalizeWith(m.UIDNormalization)
+
+	for _, uid := range []string{"JDoe", "jdoe", " jdoe ", "jdoe@corp.example", `CORP\jdoe`, "John.Doe@example.com", "+49171"} {
+		ue, err := m.searchUser(uid)
+		if err != nil || ue.UID != "JDoe" {
+			t.Errorf("searchUser(%q) = %+v, %v, want the canonical uid", uid, ue, err)
+		}
+	}
+	if _, err := m.searchUser("other"); !errors.Is(err, ErrNoUser) {
+		t.Errorf("searchUser(other) = %v", err)
+	}
+	if err := m.userbackends.CheckPassword(zap.NewNop(), "JDoe", "secret"); !errors.Is(err, ErrWrongPassword) {
+		t.Errorf("CheckPassword() of the canonical uid = %v", err)
+	}
+}
+
+func Test_normalizedBackend_ambiguous(t *testing.T) {
+	nb := &normalizedBackend{
+		backend: &userlistBackend{{UID: "JDoe"}, {UID: "jdoe"}, {UID: "ddk"}},
+		norm:    &UIDNormalization{CaseFold: true},
+	}
+	if ue, err := nb.Search(zap.NewNop(), "JDOE"); !errors.Is(err, ErrNoUser) {
+		t.Errorf("Search() of an ambiguous uid = %+v, %v, want ErrNoUser", ue, err)
+	}
+	if ue, err := nb.Search(zap.NewNop(), "DDK"); err != nil || ue.UID != "ddk" {
+		t.Errorf("Search() = %+v, %v", ue, err)
+	}
+}
+
+func Test_validateAliases(t *testing.T) {
+	if err := validateAliases([]string{aliasEMail, aliasMobile}); err != nil {
+		t.Errorf("validateAliases() = %v", err)
+	}
+	if err := validateAliases([]string{"phone"}); err == nil {
+		t.Errorf("an unknown alias must be rejected")
+	}
+}
+
+// filterconnection records the filters of the searches.
+type filterconnection struct {
+	dummyconnection
+	filters []string
+}
+
+func (fc *filterconnection) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	fc.filters = append(fc.filters, req.Filter)
+	return fc.dummyconnection.Search(req)
+}
+
+func (fc *filterconnection) SearchWithPaging(req *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	return fc.Search(req)
+}
+
+func Test_ldapConfiguration_SearchAlias(t *testing.T) {
+	con := &filterconnection{dummyconnection: dummyconnection{result: createLDAPSearchResult(map[string]string{defaultUID: "jdoe"}, 1)}}
+	getConnection = func(_ *zap.Logger, cfg *ldapConfiguration) (ldapsearcher, error) {
+		return con, nil
+	}
+	cfg := (&ldapConfiguration{}).init(caddy.NewReplacer())
+
+	ue, err := cfg.SearchAlias(zap.NewNop(), aliasEMail, "j*@example.com")
+	if err != nil || ue.UID != "jdoe" {
+		t.Fatalf("SearchAlias() = %+v, %v", ue, err)
+	}
+	if want := "(mail=j\\2a@example.com)"; con.filters[0] != want {
+		t.Errorf("filter = %q, want %q", con.filters[0], want)
+	}
+	if _, err := cfg.SearchAlias(zap.NewNop(), aliasMobile, "0049171"); err != nil || con.filters[1] != "(mobile=0049171)" {
+		t.Errorf("SearchAlias(mobile) = %v, filters %v", err, con.filters)
+	}
+
+	con.result = createLDAPSearchResult(map[string]string{defaultUID: "jdoe"}, 2)
+	if _, err := cfg.SearchAlias(zap.NewNop(), aliasEMail, "team@example.com"); !errors.Is(err, ErrNoUser) {
+		t.Errorf("SearchAlias() of an ambiguous email = %v", err)
+	}
+}
@@ -1,6 +1,8 @@
 package doorman
 
 import (
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -28,11 +30,15 @@ var (
 )
 
 type UserEntry struct {
-	Name      string `json:"name,omitempty"`
-	UID       string `json:"uid"`
-	Mobile    string `json:"mobile"`
-	Telephone string `json:"telephone"`
-	EMail     string `json:"email"`
+	Name      string   `json:"name,omitempty"`
+	UID       string   `json:"uid"`
+	Mobile    string   `json:"mobile"`
+	Telephone string   `json:"telephone"`
+	EMail     string   `json:"email"`
+	Groups    []string `json:"groups,omitempty"`
+	// PasswordHash is a bcrypt or argon2id hash for the password step, it is
+	// only used by the list, file and command backends
+	PasswordHash string `json:"password_hash,omitempty"`
 }
 
 func (ue *UserEntry) SMSNumber() string {
@@ -49,12 +55,25 @@ type userSearcher interface {
 type userlistBackend []UserEntry
 
 func (ulb *userlistBackend) Search(log *zap.Logger, uid string) (*UserEntry, error) {
+	if res := ulb.match(func(ue *UserEntry) bool { return ue.UID == uid }); len(res) > 0 {
+		return res[0], nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoUser, uid)
+}
+
+func (ulb *userlistBackend) SearchAlias(log *zap.Logger, alias, value string) (*UserEntry, error) {
+	return matchAlias(ulb, alias, value)
+}
+
+func (ulb *userlistBackend) match(fn func(ue *UserEntry) bool) []*UserEntry {
+	var res []*UserEntry
 	for _, u := range *ulb {
-		if u.UID == uid {
-			return &u, nil
+		u := u
+		if fn(&u) {
+			res = append(res, &u)
 		}
 	}
-	return nil, fmt.Errorf("%w: %s", ErrNoUser, uid)
+	return res
 }
 
 type userSearchCommand struct {
@@ -155,6 +174,17 @@ func (ufb *userfileBackend) Search(log *zap.Logger, uid string) (*UserEntry, err
 	return ufb.data.Search(log, uid)
 }
 
+func (ufb *userfileBackend) SearchAlias(log *zap.Logger, alias, value string) (*UserEntry, error) {
+	return matchAlias(ufb, alias, value)
+}
+
+func (ufb *userfileBackend) match(fn func(ue *UserEntry) bool) []*UserEntry {
+	ufb.lock.RLock()
+	defer ufb.lock.RUnlock()
+
+	return ufb.data.match(fn)
+}
+
 func (ufb *userfileBackend) load() error {
 	f, err := os.Open(ufb.Path)
 	if err != nil {
@@ -170,12 +200,26 @@ func (ufb *userfileBackend) load() error {
 
 type userBackends struct {
 	searchers []userSearcher
+	// names are the names of the searchers, the type if they have no name
+	names []string
+	merge *UserMerge
+}
+
+// close releases the resources of the backends, like the connections of
+// an ldap backend.
+func (ulb *userBackends) close() {
+	for _, s := range ulb.searchers {
+		if c, ok := s.(interface{ close() }); ok {
+			c.close()
+		}
+	}
 }
 
-func fromUserSpecs(log *zap.Logger, bks Plugins) (*userBackends, error) {
+func fromUserSpecs(log *zap.Logger, bks Plugins, merge *UserMerge) (*userBackends, error) {
 	r := caddy.NewReplacer()
 	res := userBackends{}
 	for _, b := range bks {
+		res.names = append(res.names, setdefault(b.Name, b.Type))
 		switch b.Type {
 		case valueCommandSearcher:
 			var d userSearchCommand
@@ -203,18 +247,69 @@ func fromUserSpecs(log *zap.Logger, bks Plugins) (*userBackends, error) {
 			if err := json.Unmarshal(b.Spec, &d); err != nil {
 				return nil, fmt.Errorf("cannot unmarshal ldap config: %w", err)
 			}
-			res.searchers = append(res.searchers, d.init(r))
+			if err := d.init(r).start(); err != nil {
+				return nil, fmt.Errorf("cannot start ldap backend: %w", err)
+			}
+			res.searchers = append(res.searchers, &d)
+		case valueHTTPSearcher:
+			var d httpUserBackend
+			if err := json.Unmarshal(b.Spec, &d); err != nil {
+				return nil, fmt.Errorf("cannot unmarshal http user backend: %w", err)
+			}
+			hb, err := newHTTPUserBackend(&d, r)
+			if err != nil {
+				return nil, err
+			}
+			res.searchers = append(res.searchers, hb)
 		default:
 			return nil, fmt.Errorf("unknown user backend: %q", b.Type)
 		}
 	}
+	if merge != nil {
+		if err := merge.init(res.names); err != nil {
+			return nil, err
+		}
+		res.merge = merge
+	}
 	return &res, nil
 }
 
+// newTLSConfig returns the TLS settings of a backend with an optional CA
+// bundle and client certificate.
+func newTLSConfig(caFile, certFile, keyFile string, insecure bool) (*tls.Config, error) {
+	tc := &tls.Config{InsecureSkipVerify: insecure}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in ca file %q", caFile)
+		}
+		tc.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+	return tc, nil
+}
+
 func (ulb *userBackends) Search(log *zap.Logger, uid string) (*UserEntry, error) {
+	if ulb.merge != nil {
+		// the merged entry has no password hash
+		return ulb.searchMerged(log, uid)
+	}
 	for _, b := range ulb.searchers {
 		u, err := b.Search(log, uid)
 		if err == nil {
+			// the hash is only needed to check the password and must not be
+			// logged with the user
+			u.PasswordHash = ""
 			return u, nil
 		}
 		if !errors.Is(err, ErrNoUser) {
@@ -0,0 +1,193 @@
+package doorman
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap"
+)
+
+var (
+	_ userSearcher = (*userCache)(nil)
+)
+
+const (
+	userCacheMemory = "memory"
+	userCacheShared = "shared"
+
+	toplevelUserCache = "usercache:"
+
+	defaultUserCacheTTL         = Duration(5 * time.Minute)
+	defaultUserCacheNegativeTTL = Duration(time.Minute)
+	defaultUserCacheStaleTTL    = Duration(time.Hour)
+)
+
+// UserCache caches the answers of the user backends. Found users are fresh
+// for the ttl, unknown users for the negative_ttl. When the backends cannot be
+// reached, a user which is not older than ttl+stale_ttl is still used.
+type UserCache struct {
+	Store       string   `json:"store,omitempty"`
+	TTL         Duration `json:"ttl,omitempty"`
+	NegativeTTL Duration `json:"negative_ttl,omitempty"`
+	StaleTTL    Duration `json:"stale_ttl,omitempty"`
+}
+
+// cachedUser is a cache entry; an entry without user is a negative entry.
+type cachedUser struct {
+	User    *UserEntry `json:"user,omitempty"`
+	Fetched int64      `json:"fetched"`
+}
+
+type userCache struct {
+	next  userSearcher
+	kvs   kvstore
+	clock clock.Clock
+	cfg   UserCache
+}
+
+func newUserCache(cfg UserCache, next userSearcher, cl clock.Clock, sst StoreSettings, shared kvstore) (*userCache, error) {
+	uc := &userCache{next: next, clock: cl, cfg: cfg}
+	switch cfg.Store {
+	case "", userCacheMemory:
+		uc.kvs = newMemstore(cl, sst)
+	case userCacheShared:
+		uc.kvs = shared
+	default:
+		return nil, fmt.Errorf("illegal store of the user cache: %q", cfg.Store)
+	}
+	if uc.cfg.TTL == 0 {
+		uc.cfg.TTL = defaultUserCacheTTL
+	}
+	if uc.cfg.NegativeTTL == 0 {
+		uc.cfg.NegativeTTL = defaultUserCacheNegativeTTL
+	}
+	if uc.cfg.StaleTTL == 0 {
+		uc.cfg.StaleTTL = defaultUserCacheStaleTTL
+	}
+	return uc, nil
+}
+
+func (uc *userCache) Search(log *zap.Logger, uid string) (*UserEntry, error) {
+	now := uc.clock.Now()
+	cu, cached := uc.get(log, uid)
+	if cached {
+		age := now.Sub(time.Unix(cu.Fetched, 0))
+		if cu.User == nil && age < time.Duration(uc.cfg.NegativeTTL) {
+			return nil, fmt.Errorf("%w: %s", ErrNoUser, uid)
+		}
+		if cu.User != nil && age < time.Duration(uc.cfg.TTL) {
+			return cu.User, nil
+		}
+	}
+	ue, err := uc.next.Search(log, uid)
+	switch {
+	case err == nil:
+		uc.put(log, uid, cachedUser{User: ue, Fetched: now.Unix()}, time.Duration(uc.cfg.TTL+uc.cfg.StaleTTL))
+	case errors.Is(err, ErrNoUser):
+		uc.put(log, uid, cachedUser{Fetched: now.Unix()}, time.Duration(uc.cfg.NegativeTTL))
+	case errors.Is(err, ErrNoConnection) && cached && cu.User != nil:
+		log.Warn("user backend not reachable, use cached user", zap.String("uid", uid), zap.Int64("fetched", cu.Fetched), zap.Error(err))
+		return cu.User, nil
+	}
+	return ue, err
+}
+
+func (uc *userCache) get(log *zap.Logger, uid string) (*cachedUser, bool) {
+	v, err := uc.kvs.GetTTL(log, toplevelUserCache+uid)
+	if err != nil {
+		return nil, false
+	}
+	var cu cachedUser
+	if err := json.Unmarshal([]byte(v), &cu); err != nil {
+		log.Error("cannot parse cached user", zap.String("uid", uid), zap.Error(err))
+		return nil, false
+	}
+	return &cu, true
+}
+
+// put replaces the entry of the user; the stores do not overwrite keys, so
+// the old entry is deleted first.
+func (uc *userCache) put(log *zap.Logger, uid string, cu cachedUser, ttl time.Duration) {
+	data, err := json.Marshal(cu)
+	if err != nil {
+		log.Error("cannot marshal cached user", zap.String("uid", uid), zap.Error(err))
+		return
+	}
+	key := toplevelUserCache + uid
+	uc.kvs.Del(log, key)
+	if err := uc.kvs.PutTTL(log, key, string(data), ttl); err != nil {
+		log.Error("cannot cache user", zap.String("uid", uid), zap.Error(err))
+	}
+}
+
+// invalidate removes the entry of the user, or all entries when the uid is
+// empty. It returns the number of removed entries.
+func (uc *userCache) invalidate(log *zap.Logger, uid string) (int, error) {
+	if uid != "" {
+		key := toplevelUserCache + uid
+		if _, err := uc.kvs.GetTTL(log, key); err != nil {
+			return 0, nil
+		}
+		uc.kvs.Del(log, key)
+		return 1, nil
+	}
+	keys, err := uc.kvs.Keys(log, toplevelUserCache)
+	if err != nil {
+		return 0, fmt.Errorf("cannot list cached users: %w", err)
+	}
+	for _, k := range keys {
+		uc.kvs.Del(log, k)
+	}
+	return len(keys), nil
+}
+
+// invalidateUserCache lets an admin remove a user from the cache, so changes
+// in the backends are used at once. Without a uid the whole cache is removed.
+func (m *MiddlewareApp) invalidateUserCache(w http.ResponseWriter, r *http.Request) (rs result, rc int) {
+	if r.Method != http.MethodPost {
+		rc = http.StatusMethodNotAllowed
+		return
+	}
+	uid, ok := m.currentUser(r)
+	if !ok || !m.isAdmin(uid) {
+		rs.Message = "Not authorized"
+		rc = http.StatusForbidden
+		return
+	}
+	if m.usercache == nil {
+		rs.Message = "No user cache configured"
+		rc = http.StatusNotFound
+		return
+	}
+	if err := r.ParseMultipartForm(1024); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+		m.logger.Error("cannot parse form", zap.Error(err))
+		rc = http.StatusBadRequest
+		return
+	}
+	// the users are cached by their normalized uid, a user found by an
+	// alias by the uid of the backend
+	user := strings.TrimSpace(r.FormValue(uidField))
+	keys := []string{m.UIDNormalization.normalize(user)}
+	if user != keys[0] {
+		keys = append(keys, user)
+	}
+	n := 0
+	for _, k := range keys {
+		removed, err := m.usercache.invalidate(m.logger, k)
+		if err != nil {
+			m.logger.Error("cannot invalidate user cache", zap.Error(err))
+			rs.Message = "Cannot invalidate user cache"
+			rc = http.StatusInternalServerError
+			return
+		}
+		n += removed
+	}
+	m.audit("user cache invalidated", zap.String("uid", user), zap.Int("entries", n), zap.String("by", uid))
+	rs.Message = fmt.Sprintf("%d entries removed", n)
+	return
+}
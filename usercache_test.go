@@ -0,0 +1,183 @@
+package doorman
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap"
+)
+
+// countingBackend counts the searches and fails with ErrNoConnection when it
+// is down.
+type countingBackend struct {
+	users    userlistBackend
+	searches int
+	down     bool
+}
+
+func (cb *countingBackend) Search(log *zap.Logger, uid string) (*UserEntry, error) {
+	cb.searches++
+	if cb.down {
+		return nil, fmt.Errorf("%w: backend is down", ErrNoConnection)
+	}
+	return cb.users.Search(log, uid)
+}
+
+func newTestUserCache(t *testing.T) (*userCache, *countingBackend, *clock.Mock) {
+	mock := clock.NewMock()
+	cb := &countingBackend{users: userlistBackend{{UID: "ddk", Name: "Dagobert Duck"}}}
+	uc, err := newUserCache(UserCache{}, cb, mock, StoreSettings{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return uc, cb, mock
+}
+
+func Test_userCache_Search(t *testing.T) {
+	uc, cb, mock := newTestUserCache(t)
+	search := func(uid string, searches int) (*UserEntry, error) {
+		t.Helper()
+		ue, err := uc.Search(zap.NewNop(), uid)
+		if cb.searches != searches {
+			t.Errorf("Search(%q): backend searches = %d, want %d", uid, cb.searches, searches)
+		}
+		return ue, err
+	}
+
+	if ue, err := search("ddk", 1); err != nil || ue.Name != "Dagobert Duck" {
+		t.Fatalf("Search() = %+v, %v", ue, err)
+	}
+	if ue, err := search("ddk", 1); err != nil || ue.Name != "Dagobert Duck" {
+		t.Errorf("cached Search() = %+v, %v", ue, err)
+	}
+	if _, err := search("unknown", 2); !errors.Is(err, ErrNoUser) {
+		t.Errorf("Search() of an unknown user = %v", err)
+	}
+	if _, err := search("unknown", 2); !errors.Is(err, ErrNoUser) {
+		t.Errorf("negative cached Search() = %v", err)
+	}
+
+	// the negative entry expires before the positive one
+	mock.Add(time.Duration(defaultUserCacheNegativeTTL))
+	if _, err := search("unknown", 3); !errors.Is(err, ErrNoUser) {
+		t.Errorf("Search() after the negative ttl = %v", err)
+	}
+	if _, err := search("ddk", 3); err != nil {
+		t.Errorf("cached Search() = %v", err)
+	}
+
+	// a stale user is used while the backend is down
+	mock.Add(time.Duration(defaultUserCacheTTL))
+	cb.down = true
+	if ue, err := search("ddk", 4); err != nil || ue.Name != "Dagobert Duck" {
+		t.Errorf("stale Search() = %+v, %v", ue, err)
+	}
+	if _, err := search("unknown", 5); !errors.Is(err, ErrNoConnection) {
+		t.Errorf("negative entries are not used when stale: %v", err)
+	}
+	cb.down = false
+	cb.users[0].Name = "Donald Duck"
+	if ue, err := search("ddk", 6); err != nil || ue.Name != "Donald Duck" {
+		t.Errorf("revalidated Search() = %+v, %v", ue, err)
+	}
+
+	// after the stale ttl the user is gone
+	mock.Add(time.Duration(defaultUserCacheTTL + defaultUserCacheStaleTTL))
+	cb.down = true
+	if _, err := search("ddk", 7); !errors.Is(err, ErrNoConnection) {
+		t.Errorf("Search() after the stale ttl = %v", err)
+	}
+}
+
+func Test_userCache_invalidate(t *testing.T) {
+	uc, cb, _ := newTestUserCache(t)
+	_, _ = uc.Search(zap.NewNop(), "ddk")
+	_, _ = uc.Search(zap.NewNop(), "unknown")
+
+	if n, err := uc.invalidate(zap.NewNop(), "ddk"); n != 1 || err != nil {
+		t.Errorf("invalidate(ddk) = %d, %v", n, err)
+	}
+	if n, _ := uc.invalidate(zap.NewNop(), "ddk"); n != 0 {
+		t.Errorf("invalidate(ddk) again = %d", n)
+	}
+	_, _ = uc.Search(zap.NewNop(), "ddk")
+	if cb.searches != 3 {
+		t.Errorf("an invalidated user must be searched again: %d", cb.searches)
+	}
+	if n, err := uc.invalidate(zap.NewNop(), ""); n != 2 || err != nil {
+		t.Errorf("invalidate() of all = %d, %v", n, err)
+	}
+}
+
+func Test_userCache_negativeEntriesExpire(t *testing.T) {
+	uc, _, mock := newTestUserCache(t)
+	for i := 0; i < 100; i++ {
+		_, _ = uc.Search(zap.NewNop(), fmt.Sprintf("unknown%d", i))
+	}
+	ms := uc.kvs.(*memstore)
+	if len(ms.data) != 100 {
+		t.Fatalf("%d cached entries, want 100", len(ms.data))
+	}
+	mock.Add(time.Duration(uc.cfg.NegativeTTL) + memstoreSweepInterval)
+	_, _ = uc.Search(zap.NewNop(), "ddk")
+	if len(ms.data) != 1 {
+		t.Errorf("the expired negative entries must be swept, %d entries left", len(ms.data))
+	}
+}
+
+func Test_newUserCache(t *testing.T) {
+	shared := newMemstore(clock.NewMock(), StoreSettings{})
+	uc, err := newUserCache(UserCache{Store: userCacheShared, TTL: Duration(time.Second)}, &userlistBackend{}, clock.NewMock(), StoreSettings{}, shared)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uc.kvs != shared || uc.cfg.TTL != Duration(time.Second) || uc.cfg.NegativeTTL != defaultUserCacheNegativeTTL {
+		t.Errorf("newUserCache() = %+v", uc)
+	}
+	if _, err := newUserCache(UserCache{Store: "disk"}, &userlistBackend{}, clock.NewMock(), StoreSettings{}, shared); err == nil {
+		t.Errorf("an unknown store must be rejected")
+	}
+}
+
+func Test_invalidateUserCache(t *testing.T) {
+	m, _ := newDeviceApp(t)
+	m.Admins = []string{"admin"}
+	uc, cb, _ := newTestUserCache(t)
+	m.usercache = uc
+	_, _ = m.searchUser("ddk")
+
+	request := func(uid string, values ...string) (result, int) {
+		cw := httptest.NewRecorder()
+		m.secCookie.set(cw, cookieData{uidField: uid, authorizedField: m.clock.Now().Unix()})
+		form := "ddk"
+		if len(values) > 0 {
+			form = values[0]
+		}
+		r := multipartRequest(t, "https://auth.example.com/admin/usercache/invalidate", map[string]string{uidField: form})
+		for _, c := range cw.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		return m.invalidateUserCache(httptest.NewRecorder(), r)
+	}
+	if _, rc := request("ddk"); rc != http.StatusForbidden {
+		t.Errorf("invalidateUserCache() for a user = %d", rc)
+	}
+	if rs, rc := request("admin"); rc != 0 || rs.Message != "1 entries removed" {
+		t.Errorf("invalidateUserCache() for an admin = %d, %+v", rc, rs)
+	}
+	_, _ = m.searchUser("ddk")
+	if cb.searches != 2 {
+		t.Errorf("the user must be searched again: %d", cb.searches)
+	}
+
+	// the entered uid is normalized like at the gate
+	m.UIDNormalization = &UIDNormalization{Trim: true, CaseFold: true, StripDomain: true}
+	if rs, rc := request("admin", " DDK@corp.example"); rc != 0 || rs.Message != "1 entries removed" {
+		t.Errorf("invalidateUserCache() of a not normalized uid = %d, %+v", rc, rs)
+	}
+}
@@ -0,0 +1,181 @@
+package doorman
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+var (
+	_ userSearcher = (*httpUserBackend)(nil)
+
+	valueHTTPSearcher = "http"
+)
+
+const (
+	defaultHTTPUserTimeout = Duration(10 * time.Second)
+	defaultHTTPUserMaxSize = 1 * megabyte
+)
+
+// httpUserFields are the JSON paths of the fields of a user entry in the
+// answer. The defaults are the names of the fields of a user entry.
+type httpUserFields struct {
+	UID          string `json:"uid,omitempty"`
+	Name         string `json:"name,omitempty"`
+	Mobile       string `json:"mobile,omitempty"`
+	Telephone    string `json:"telephone,omitempty"`
+	EMail        string `json:"email,omitempty"`
+	Groups       string `json:"groups,omitempty"`
+	PasswordHash string `json:"password_hash,omitempty"`
+}
+
+type httpBasicAuth struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// httpUserBackend searches a user with a GET request to a REST service. The
+// placeholder {uid} in the url is replaced with the escaped uid.
+type httpUserBackend struct {
+	URL         string         `json:"url"`
+	Headers     http.Header    `json:"headers,omitempty"`
+	BearerToken string         `json:"bearer_token,omitempty"`
+	BasicAuth   *httpBasicAuth `json:"basic_auth,omitempty"`
+	Fields      httpUserFields `json:"fields,omitempty"`
+	Timeout     Duration       `json:"timeout,omitempty"`
+	MaxSize     int64          `json:"max_size,omitempty"`
+	Insecure    bool           `json:"insecure,omitempty"`
+	CAFile      string         `json:"ca_file,omitempty"`
+	CertFile    string         `json:"cert_file,omitempty"`
+	KeyFile     string         `json:"key_file,omitempty"`
+
+	client *http.Client
+}
+
+func newHTTPUserBackend(cfg *httpUserBackend, rpl *caddy.Replacer) (*httpUserBackend, error) {
+	cfg.URL = rpl.ReplaceKnown(cfg.URL, "")
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("the http user backend needs an url")
+	}
+	if !strings.Contains(cfg.URL, "{uid}") {
+		return nil, fmt.Errorf("the url of the http user backend needs a {uid} placeholder")
+	}
+	for k, vs := range cfg.Headers {
+		for i, v := range vs {
+			vs[i] = rpl.ReplaceKnown(v, "")
+		}
+		cfg.Headers[k] = vs
+	}
+	cfg.BearerToken = rpl.ReplaceKnown(cfg.BearerToken, "")
+	if cfg.BasicAuth != nil {
+		cfg.BasicAuth.Username = rpl.ReplaceKnown(cfg.BasicAuth.Username, "")
+		cfg.BasicAuth.Password = rpl.ReplaceKnown(cfg.BasicAuth.Password, "")
+	}
+	f := &cfg.Fields
+	f.UID = setdefault(f.UID, "uid")
+	f.Name = setdefault(f.Name, "name")
+	f.Mobile = setdefault(f.Mobile, "mobile")
+	f.Telephone = setdefault(f.Telephone, "telephone")
+	f.EMail = setdefault(f.EMail, "email")
+	f.Groups = setdefault(f.Groups, "groups")
+	f.PasswordHash = setdefault(f.PasswordHash, "password_hash")
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultHTTPUserTimeout
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = defaultHTTPUserMaxSize
+	}
+	tc, err := newTLSConfig(rpl.ReplaceKnown(cfg.CAFile, ""), rpl.ReplaceKnown(cfg.CertFile, ""), rpl.ReplaceKnown(cfg.KeyFile, ""), cfg.Insecure)
+	if err != nil {
+		return nil, fmt.Errorf("http user backend: %w", err)
+	}
+	cfg.client = &http.Client{
+		Timeout: time.Duration(cfg.Timeout),
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: tc,
+		},
+	}
+	return cfg, nil
+}
+
+// userURL returns the url of the user. The uid is escaped as a path segment
+// or as a query value, so it cannot add a path or parameters.
+func (hb *httpUserBackend) userURL(uid string) string {
+	path, query, hasQuery := strings.Cut(hb.URL, "?")
+	res := strings.ReplaceAll(path, "{uid}", url.PathEscape(uid))
+	if hasQuery {
+		res += "?" + strings.ReplaceAll(query, "{uid}", url.QueryEscape(uid))
+	}
+	return res
+}
+
+func (hb *httpUserBackend) Search(log *zap.Logger, uid string) (*UserEntry, error) {
+	rq, err := http.NewRequest(http.MethodGet, hb.userURL(uid), nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot create request: %v", ErrNoConnection, err)
+	}
+	for k, v := range hb.Headers {
+		rq.Header[k] = v
+	}
+	rq.Header.Set("Accept", "application/json")
+	if hb.BearerToken != "" {
+		rq.Header.Set("Authorization", "Bearer "+hb.BearerToken)
+	} else if hb.BasicAuth != nil {
+		rq.SetBasicAuth(hb.BasicAuth.Username, hb.BasicAuth.Password)
+	}
+	rsp, err := hb.client.Do(rq)
+	if err != nil {
+		log.Error("cannot query user service", zap.Error(err))
+		return nil, fmt.Errorf("%w: cannot query user service: %v", ErrNoConnection, err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%w: %s", ErrNoUser, uid)
+	}
+	if rsp.StatusCode/100 != 2 {
+		log.Error("user service failed", zap.Int("status", rsp.StatusCode))
+		return nil, fmt.Errorf("%w: user service status: %d", ErrNoConnection, rsp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, hb.MaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: cannot read user: %v", ErrNoConnection, err)
+	}
+	if int64(len(data)) > hb.MaxSize {
+		return nil, fmt.Errorf("%w: user is larger than %d bytes", ErrNoConnection, hb.MaxSize)
+	}
+	var doc interface{}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("%w: cannot parse user: %v", ErrNoConnection, err)
+	}
+	return hb.userEntry(doc, uid)
+}
+
+// userEntry maps the document to a user. A document without a value at the
+// uid path, like {} or null, is no user.
+func (hb *httpUserBackend) userEntry(doc interface{}, uid string) (*UserEntry, error) {
+	f := hb.Fields
+	found := jsonPathString(doc, f.UID)
+	if found == "" {
+		return nil, fmt.Errorf("%w: %s has no %s", ErrNoUser, uid, f.UID)
+	}
+	ue := &UserEntry{
+		UID:          found,
+		Name:         jsonPathString(doc, f.Name),
+		Mobile:       jsonPathString(doc, f.Mobile),
+		Telephone:    jsonPathString(doc, f.Telephone),
+		EMail:        jsonPathString(doc, f.EMail),
+		PasswordHash: jsonPathString(doc, f.PasswordHash),
+	}
+	for _, g := range jsonPathStrings(doc, f.Groups) {
+		ue.Groups = appendGroup(ue.Groups, g)
+	}
+	return ue, nil
+}
@@ -0,0 +1,177 @@
+package doorman
+
+import (
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func Test_httpUserBackend_Search(t *testing.T) {
+	users := map[string]string{
+		"/users/ddk":     `{"uid":"ddk","name":"Dagobert Duck","mobile":"0049171","email":"ddk@example.com","groups":["wiki","staff"]}`,
+		"/users/a b":     `{"uid":"a b"}`,
+		"/users/broken":  `{"uid":`,
+		"/users/empty":   `{}`,
+		"/users/list":    `[]`,
+		"/users/null":    `null`,
+		"/users/nouid":   `{"name":"No Uid"}`,
+		"/people/nested": `{"data":{"login":"nested","contact":{"phone":4989123,"mail":"n@example.com"},"memberships":[{"name":"ops"},{"name":"dev"}]}}`,
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if strings.HasSuffix(r.URL.Path, "/fail") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		body, ok := users[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		fields   httpUserFields
+		uid      string
+		want     *UserEntry
+		wantErr  error
+		maxSize  int64
+		noBearer bool
+	}{
+		{
+			name: "default fields",
+			path: "/users/{uid}",
+			uid:  "ddk",
+			want: &UserEntry{UID: "ddk", Name: "Dagobert Duck", Mobile: "0049171", EMail: "ddk@example.com", Groups: []string{"wiki", "staff"}},
+		},
+		{name: "escaped uid", path: "/users/{uid}", uid: "a b", want: &UserEntry{UID: "a b"}},
+		{name: "no path traversal", path: "/users/{uid}", uid: "../users/ddk", wantErr: ErrNoUser},
+		{
+			name:   "json paths",
+			path:   "/people/{uid}",
+			uid:    "nested",
+			fields: httpUserFields{UID: "data.login", Telephone: "data.contact.phone", EMail: "$.data.contact.mail", Groups: "data.memberships.name"},
+			want:   &UserEntry{UID: "nested", Telephone: "4989123", EMail: "n@example.com", Groups: []string{"ops", "dev"}},
+		},
+		{name: "not found", path: "/users/{uid}", uid: "unknown", wantErr: ErrNoUser},
+		{name: "server error", path: "/users/{uid}", uid: "fail", wantErr: ErrNoConnection},
+		{name: "broken json", path: "/users/{uid}", uid: "broken", wantErr: ErrNoConnection},
+		{name: "empty object", path: "/users/{uid}", uid: "empty", wantErr: ErrNoUser},
+		{name: "empty list", path: "/users/{uid}", uid: "list", wantErr: ErrNoUser},
+		{name: "null", path: "/users/{uid}", uid: "null", wantErr: ErrNoUser},
+		{name: "no uid", path: "/users/{uid}", uid: "nouid", wantErr: ErrNoUser},
+		{name: "too large", path: "/users/{uid}", uid: "ddk", maxSize: 10, wantErr: ErrNoConnection},
+		{name: "unauthorized", path: "/users/{uid}", uid: "ddk", noBearer: true, wantErr: ErrNoConnection},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &httpUserBackend{URL: srv.URL + tt.path, BearerToken: "s3cret", Fields: tt.fields, MaxSize: tt.maxSize}
+			if tt.noBearer {
+				cfg.BearerToken = ""
+			}
+			hb, err := newHTTPUserBackend(cfg, caddy.NewReplacer())
+			if err != nil {
+				t.Fatal(err)
+			}
+			ue, err := hb.Search(zap.NewNop(), tt.uid)
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("Search() error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+			if !reflect.DeepEqual(ue, tt.want) {
+				t.Errorf("Search() = %+v, want %+v", ue, tt.want)
+			}
+		})
+	}
+}
+
+func Test_httpUserBackend_userURL(t *testing.T) {
+	tests := []struct {
+		url  string
+		uid  string
+		want string
+	}{
+		{url: "https://users/api/{uid}", uid: "ddk", want: "https://users/api/ddk"},
+		{url: "https://users/api/{uid}", uid: "a/b?c", want: "https://users/api/a%2Fb%3Fc"},
+		{url: "https://users/api?id={uid}&full=1", uid: "a&admin=1", want: "https://users/api?id=a%26admin%3D1&full=1"},
+	}
+	for _, tt := range tests {
+		hb := &httpUserBackend{URL: tt.url}
+		if got := hb.userURL(tt.uid); got != tt.want {
+			t.Errorf("userURL(%q) = %q, want %q", tt.uid, got, tt.want)
+		}
+	}
+}
+
+func Test_httpUserBackend_auth(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, ok := r.BasicAuth(); !ok || u != "doorman" || p != "pw" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("X-Tenant") != "main" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"uid":"ddk"}`))
+	}))
+	defer srv.Close()
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	newBackend := func(ca string) *httpUserBackend {
+		hb, err := newHTTPUserBackend(&httpUserBackend{
+			URL:       srv.URL + "/{uid}",
+			BasicAuth: &httpBasicAuth{Username: "doorman", Password: "pw"},
+			Headers:   http.Header{"X-Tenant": {"main"}},
+			CAFile:    ca,
+			Timeout:   Duration(time.Second),
+		}, caddy.NewReplacer())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hb
+	}
+	if ue, err := newBackend(caFile).Search(zap.NewNop(), "ddk"); err != nil || ue.UID != "ddk" {
+		t.Errorf("Search() with the ca of the server = %+v, %v", ue, err)
+	}
+	if _, err := newBackend("").Search(zap.NewNop(), "ddk"); !errors.Is(err, ErrNoConnection) {
+		t.Errorf("Search() with an unknown ca = %v, want ErrNoConnection", err)
+	}
+}
+
+func Test_newHTTPUserBackend(t *testing.T) {
+	if _, err := newHTTPUserBackend(&httpUserBackend{}, caddy.NewReplacer()); err == nil {
+		t.Errorf("a backend without url must be rejected")
+	}
+	if _, err := newHTTPUserBackend(&httpUserBackend{URL: "https://users/api"}, caddy.NewReplacer()); err == nil {
+		t.Errorf("a backend without {uid} must be rejected")
+	}
+	if _, err := newHTTPUserBackend(&httpUserBackend{URL: "https://users/{uid}", CAFile: "/does/not/exist"}, caddy.NewReplacer()); err == nil {
+		t.Errorf("a backend with a missing ca file must be rejected")
+	}
+}
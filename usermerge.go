@@ -0,0 +1,210 @@
+package doorman
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultUserMergeTimeout = Duration(5 * time.Second)
+)
+
+// userMergeFields are the fields of a user entry which can be merged.
+var userMergeFields = map[string]func(ue *UserEntry) *string{
+	"name":      func(ue *UserEntry) *string { return &ue.Name },
+	"mobile":    func(ue *UserEntry) *string { return &ue.Mobile },
+	"telephone": func(ue *UserEntry) *string { return &ue.Telephone },
+	"email":     func(ue *UserEntry) *string { return &ue.EMail },
+}
+
+const userMergeGroups = "groups"
+
+// UserMerge searches the user in all backends and merges the entries. A
+// field is taken from the first backend in its precedence list which has a
+// value; backends which are not listed follow in their configured order. The
+// groups are the union of the groups of all backends, unless they have a
+// precedence. A backend which fails or does not answer in time is skipped.
+type UserMerge struct {
+	Parallel   bool                `json:"parallel,omitempty"`
+	Timeout    Duration            `json:"timeout,omitempty"`
+	Precedence map[string][]string `json:"precedence,omitempty"`
+
+	// order contains the indexes of the backends for every field
+	order map[string][]int
+}
+
+// init checks the precedence against the names of the backends.
+func (um *UserMerge) init(names []string) error {
+	if um.Timeout == 0 {
+		um.Timeout = defaultUserMergeTimeout
+	}
+	um.order = make(map[string][]int)
+	for f, pr := range um.Precedence {
+		if _, ok := userMergeFields[f]; !ok && f != userMergeGroups {
+			return fmt.Errorf("unknown user field in precedence: %q", f)
+		}
+		var order []int
+		for _, n := range pr {
+			idx := -1
+			for i, bn := range names {
+				if bn != n {
+					continue
+				}
+				if idx >= 0 {
+					return fmt.Errorf("the name of the user backend %q is not unique", n)
+				}
+				idx = i
+			}
+			if idx < 0 {
+				return fmt.Errorf("unknown user backend in precedence of %q: %q", f, n)
+			}
+			order = append(order, idx)
+		}
+		um.order[f] = order
+	}
+	return nil
+}
+
+// fieldOrder returns the indexes of the backends in the precedence of the
+// field.
+func (um *UserMerge) fieldOrder(field string, backends int) []int {
+	res := append([]int{}, um.order[field]...)
+	for i := 0; i < backends; i++ {
+		listed := false
+		for _, o := range res {
+			listed = listed || o == i
+		}
+		if !listed {
+			res = append(res, i)
+		}
+	}
+	return res
+}
+
+// merge merges the entries of the backends, a nil entry is a backend which
+// does not know the user. Different values of a field are logged.
+func (um *UserMerge) merge(log *zap.Logger, names []string, entries []*UserEntry) *UserEntry {
+	var res UserEntry
+	for _, e := range entries {
+		if e != nil {
+			res.UID = e.UID
+			break
+		}
+	}
+	conflict := func(field string, from, other int) {
+		log.Warn("conflicting user field", zap.String("uid", res.UID), zap.String("field", field),
+			zap.String("backend", names[from]), zap.String("other", names[other]))
+	}
+	for f, get := range userMergeFields {
+		from := -1
+		for _, i := range um.fieldOrder(f, len(entries)) {
+			e := entries[i]
+			if e == nil || *get(e) == "" {
+				continue
+			}
+			if from < 0 {
+				from = i
+				*get(&res) = *get(e)
+			} else if *get(e) != *get(&res) {
+				conflict(f, from, i)
+			}
+		}
+	}
+	if _, ok := um.order[userMergeGroups]; !ok {
+		for _, e := range entries {
+			if e == nil {
+				continue
+			}
+			for _, g := range e.Groups {
+				res.Groups = appendGroup(res.Groups, g)
+			}
+		}
+		return &res
+	}
+	from := -1
+	for _, i := range um.fieldOrder(userMergeGroups, len(entries)) {
+		e := entries[i]
+		if e == nil || len(e.Groups) == 0 {
+			continue
+		}
+		if from < 0 {
+			from = i
+			res.Groups = e.Groups
+		} else if !reflect.DeepEqual(e.Groups, res.Groups) {
+			conflict(userMergeGroups, from, i)
+		}
+	}
+	return &res
+}
+
+// searchAll searches the user in all backends. The entries are in the order
+// of the backends, a backend which does not know the user has a nil entry.
+// A backend which fails or does not answer in time is logged and has a nil
+// entry; the error is the last failure.
+func (ulb *userBackends) searchAll(log *zap.Logger, uid string) ([]*UserEntry, error) {
+	type answer struct {
+		idx int
+		ue  *UserEntry
+		err error
+	}
+	res := make([]*UserEntry, len(ulb.searchers))
+	answers := make(chan answer, len(ulb.searchers))
+	search := func(i int) {
+		ue, err := ulb.searchers[i].Search(log, uid)
+		answers <- answer{idx: i, ue: ue, err: err}
+	}
+	var timeout <-chan time.Time
+	if ulb.merge.Parallel {
+		for i := range ulb.searchers {
+			go search(i)
+		}
+		t := time.NewTimer(time.Duration(ulb.merge.Timeout))
+		defer t.Stop()
+		timeout = t.C
+	}
+	var failed error
+	answered := make([]bool, len(ulb.searchers))
+	for i := range ulb.searchers {
+		if !ulb.merge.Parallel {
+			search(i)
+		}
+		select {
+		case a := <-answers:
+			answered[a.idx] = true
+			if a.err != nil && !errors.Is(a.err, ErrNoUser) {
+				log.Warn("user backend failed, skip it", zap.String("uid", uid), zap.String("backend", ulb.names[a.idx]), zap.Error(a.err))
+				failed = fmt.Errorf("user backend %q: %w", ulb.names[a.idx], a.err)
+				continue
+			}
+			res[a.idx] = a.ue
+		case <-timeout:
+			for j, ok := range answered {
+				if !ok {
+					log.Warn("user backend did not answer in time, skip it", zap.String("uid", uid), zap.String("backend", ulb.names[j]), zap.Duration("timeout", time.Duration(ulb.merge.Timeout)))
+				}
+			}
+			return res, fmt.Errorf("%w: the user backends did not answer in %s", ErrNoConnection, time.Duration(ulb.merge.Timeout))
+		}
+	}
+	return res, failed
+}
+
+// searchMerged returns the merged entries of all backends which know the
+// user. The failure of a backend is only returned if no other backend knows
+// the user, so an unknown user is not reported while a backend is down.
+func (ulb *userBackends) searchMerged(log *zap.Logger, uid string) (*UserEntry, error) {
+	entries, err := ulb.searchAll(log, uid)
+	for _, e := range entries {
+		if e != nil {
+			return ulb.merge.merge(log, ulb.names, entries), nil
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("%w: %s", ErrNoUser, uid)
+}
@@ -0,0 +1,192 @@
+package doorman
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// slowBackend answers after the release channel is closed.
+type slowBackend struct {
+	userlistBackend
+	release chan struct{}
+}
+
+func (sb *slowBackend) Search(log *zap.Logger, uid string) (*UserEntry, error) {
+	<-sb.release
+	return sb.userlistBackend.Search(log, uid)
+}
+
+func newMergedBackends(t *testing.T, merge *UserMerge, searchers ...userSearcher) *userBackends {
+	names := []string{"ldap", "helpdesk", "extra"}[:len(searchers)]
+	if err := merge.init(names); err != nil {
+		t.Fatal(err)
+	}
+	return &userBackends{searchers: searchers, names: names, merge: merge}
+}
+
+func Test_userBackends_searchMerged(t *testing.T) {
+	ldap := &userlistBackend{
+		{UID: "ddk", Name: "Dagobert Duck", EMail: "ddk@example.com", Mobile: "0049171", Groups: []string{"staff"}},
+		{UID: "ldaponly", EMail: "lo@example.com"},
+	}
+	helpdesk := &userlistBackend{
+		{UID: "ddk", Mobile: "0049172", Telephone: "004989", PasswordHash: "$2a$secret"},
+		{UID: "helpdeskonly", Mobile: "0049173"},
+	}
+	tests := []struct {
+		name       string
+		precedence map[string][]string
+		parallel   bool
+		uid        string
+		want       *UserEntry
+		conflicts  int
+	}{
+		{
+			name:      "backend order",
+			uid:       "ddk",
+			want:      &UserEntry{UID: "ddk", Name: "Dagobert Duck", EMail: "ddk@example.com", Mobile: "0049171", Telephone: "004989", Groups: []string{"staff"}},
+			conflicts: 1,
+		},
+		{
+			name:       "mobile from helpdesk",
+			precedence: map[string][]string{"mobile": {"helpdesk"}},
+			parallel:   true,
+			uid:        "ddk",
+			want:       &UserEntry{UID: "ddk", Name: "Dagobert Duck", EMail: "ddk@example.com", Mobile: "0049172", Telephone: "004989", Groups: []string{"staff"}},
+			conflicts:  1,
+		},
+		{name: "only in one backend", uid: "helpdeskonly", want: &UserEntry{UID: "helpdeskonly", Mobile: "0049173"}},
+		{name: "only in first backend", uid: "ldaponly", parallel: true, want: &UserEntry{UID: "ldaponly", EMail: "lo@example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			core, logs := observer.New(zap.WarnLevel)
+			ulb := newMergedBackends(t, &UserMerge{Precedence: tt.precedence, Parallel: tt.parallel}, ldap, helpdesk)
+			ue, err := ulb.Search(zap.New(core), tt.uid)
+			if err != nil {
+				t.Fatalf("Search() error = %v", err)
+			}
+			if !reflect.DeepEqual(ue, tt.want) {
+				t.Errorf("Search() = %+v, want %+v", ue, tt.want)
+			}
+			if logs.FilterMessage("conflicting user field").Len() != tt.conflicts {
+				t.Errorf("conflicts = %v, want %d", logs.All(), tt.conflicts)
+			}
+		})
+	}
+
+	ulb := newMergedBackends(t, &UserMerge{}, ldap, helpdesk)
+	if _, err := ulb.Search(zap.NewNop(), "unknown"); !errors.Is(err, ErrNoUser) {
+		t.Errorf("Search() of an unknown user = %v", err)
+	}
+}
+
+func Test_userBackends_searchMerged_failures(t *testing.T) {
+	ok := &userlistBackend{{UID: "ddk", EMail: "ddk@example.com"}}
+	down := &countingBackend{down: true}
+
+	core, logs := observer.New(zap.WarnLevel)
+	ulb := newMergedBackends(t, &UserMerge{}, ok, down)
+	if ue, err := ulb.Search(zap.New(core), "ddk"); err != nil || ue.EMail != "ddk@example.com" {
+		t.Errorf("Search() with a failing backend = %+v, %v", ue, err)
+	}
+	if logs.FilterMessage("user backend failed, skip it").Len() != 1 {
+		t.Errorf("a failing backend must be logged: %v", logs.All())
+	}
+	if _, err := ulb.Search(zap.NewNop(), "unknown"); !errors.Is(err, ErrNoConnection) {
+		t.Errorf("Search() of an unknown user with a failing backend = %v, want ErrNoConnection", err)
+	}
+	ulb = newMergedBackends(t, &UserMerge{Parallel: true}, down, &countingBackend{down: true})
+	if _, err := ulb.Search(zap.NewNop(), "ddk"); !errors.Is(err, ErrNoConnection) {
+		t.Errorf("Search() with failing backends only = %v", err)
+	}
+
+	slow := &slowBackend{userlistBackend: userlistBackend{{UID: "ddk", Mobile: "0049171"}}, release: make(chan struct{})}
+	defer close(slow.release)
+	core, logs = observer.New(zap.WarnLevel)
+	ulb = newMergedBackends(t, &UserMerge{Parallel: true, Timeout: Duration(10 * time.Millisecond)}, ok, slow)
+	if ue, err := ulb.Search(zap.New(core), "ddk"); err != nil || ue.EMail != "ddk@example.com" || ue.Mobile != "" {
+		t.Errorf("Search() with a slow backend = %+v, %v", ue, err)
+	}
+	if logs.FilterMessage("user backend did not answer in time, skip it").Len() != 1 {
+		t.Errorf("a slow backend must be logged: %v", logs.All())
+	}
+}
+
+func Test_UserMerge_groups(t *testing.T) {
+	ldap := &userlistBackend{{UID: "ddk", Groups: []string{"staff", "wiki"}}}
+	helpdesk := &userlistBackend{{UID: "ddk", Groups: []string{"Wiki", "helpdesk"}}}
+
+	ulb := newMergedBackends(t, &UserMerge{}, ldap, helpdesk)
+	ue, err := ulb.Search(zap.NewNop(), "ddk")
+	if err != nil || !reflect.DeepEqual(ue.Groups, []string{"staff", "wiki", "helpdesk"}) {
+		t.Errorf("Search() = %+v, %v, want the union of the groups", ue, err)
+	}
+
+	ulb = newMergedBackends(t, &UserMerge{Precedence: map[string][]string{"groups": {"helpdesk"}}}, ldap, helpdesk)
+	ue, err = ulb.Search(zap.NewNop(), "ddk")
+	if err != nil || !reflect.DeepEqual(ue.Groups, []string{"Wiki", "helpdesk"}) {
+		t.Errorf("Search() = %+v, %v, want the groups of the precedence", ue, err)
+	}
+}
+
+func Test_UserMerge_init(t *testing.T) {
+	tests := []struct {
+		name       string
+		precedence string
+		wantErr    bool
+		wantOrder  map[string][]int
+	}{
+		{name: "empty", precedence: `{}`, wantOrder: map[string][]int{}},
+		{name: "fields", precedence: `{"mobile": ["helpdesk", "ldap"], "groups": ["file"]}`, wantOrder: map[string][]int{"mobile": {1, 0}, "groups": {2}}},
+		{name: "unknown field", precedence: `{"uid": ["ldap"]}`, wantErr: true},
+		{name: "unknown backend", precedence: `{"mobile": ["crm"]}`, wantErr: true},
+		{name: "ambiguous backend", precedence: `{"mobile": ["list"]}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var um UserMerge
+			if err := json.Unmarshal([]byte(tt.precedence), &um.Precedence); err != nil {
+				t.Fatal(err)
+			}
+			err := um.init([]string{"ldap", "helpdesk", "file", "list", "list"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("init() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(um.order, tt.wantOrder) {
+				t.Errorf("init() order = %v, want %v", um.order, tt.wantOrder)
+			}
+			if !tt.wantErr && um.Timeout != defaultUserMergeTimeout {
+				t.Errorf("init() timeout = %v", um.Timeout)
+			}
+		})
+	}
+	um := UserMerge{order: map[string][]int{"mobile": {2}}}
+	if got := um.fieldOrder("mobile", 3); !reflect.DeepEqual(got, []int{2, 0, 1}) {
+		t.Errorf("fieldOrder() = %v", got)
+	}
+}
+
+func Test_fromUserSpecs_merge(t *testing.T) {
+	bks := Plugins{
+		{Type: "list", Name: "ldap", Spec: json.RawMessage(`[{"uid":"ddk","email":"ddk@example.com"}]`)},
+		{Type: "list", Name: "helpdesk", Spec: json.RawMessage(`[{"uid":"ddk","mobile":"0049171"}]`)},
+	}
+	ulb, err := fromUserSpecs(zap.NewNop(), bks, &UserMerge{Precedence: map[string][]string{"mobile": {"helpdesk"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ue, err := ulb.Search(zap.NewNop(), "ddk")
+	if err != nil || ue.EMail != "ddk@example.com" || ue.Mobile != "0049171" {
+		t.Errorf("Search() = %+v, %v", ue, err)
+	}
+	if _, err := fromUserSpecs(zap.NewNop(), bks, &UserMerge{Precedence: map[string][]string{"mobile": {"crm"}}}); err == nil {
+		t.Errorf("an unknown backend in the precedence must be rejected")
+	}
+}
@@ -8,6 +8,8 @@ import { RegisterUser } from './RegisterUser';
 import { RemoteApi } from './RemoteApi';
 import { Signup } from './Signup';
 import { TokenEnter } from './TokenEnter';
+import { Tokens } from './Tokens';
+import { Grants } from './Grants';
 import { User } from './User';
 import { WaitForPermission } from './WaitForPermission';
 
@@ -30,6 +32,9 @@ export const App = (props) => {
     const [showError, setShowError] = React.useState(false);
     const [passthrough, setPassthrough] = React.useState(null);
     const [captchaMode, setCaptchaMode] = React.useState("");
+    const [deviceCode, setDeviceCode] = React.useState("");
+    const [requirePassword, setRequirePassword] = React.useState(false);
+    const [password, setPassword] = React.useState("");
 
     React.useEffect(() => {
         remoteAPI.uisettings().then(s => {
@@ -38,10 +43,15 @@ export const App = (props) => {
             setOPMode(s.operation_mode);
             setWaitSecs(s.duration_secs);
             setCaptchaMode(s.captcha_mode);
+            setRequirePassword(s.require_password);
         })
     }, []);
 
-    const reloadWindow = () => {
+    const reloadWindow = (redirect?: string) => {
+        if (redirect) {
+            window.location.assign(redirect);
+            return
+        }
         window.history.replaceState(null, null, window.location.pathname + window.location.search)
         window.location.reload();
     }
@@ -75,9 +85,14 @@ export const App = (props) => {
         setSolution(""); // clear the solution in the UI
         setShowError(false);
         setToken("");
-        let u = await remoteAPI.sendUser(uid, solution);
+        let u;
+        try {
+            u = await remoteAPI.sendUser(uid, solution, password);
+        } finally {
+            setPassword(""); // the password is checked only once
+        }
         if (u.reload) {
-            location.reload();
+            reloadWindow(u.redirect);
             return
         }
         switch (opmode) {
@@ -110,14 +125,23 @@ export const App = (props) => {
     });
 
     const checkToken = handleRemoteError(async () => {
-        await remoteAPI.checkToken(token);
+        let r = await remoteAPI.checkToken(token);
         setPassthrough(<div></div>);
-        reloadWindow()
+        reloadWindow(r.redirect)
     });
     const checkOTP = handleRemoteError(async () => {
-        await remoteAPI.checkOTP(token);
+        let r = await remoteAPI.checkOTP(token);
         setPassthrough(<div></div>);
-        reloadWindow()
+        reloadWindow(r.redirect)
+    });
+
+    const deviceEntered = handleRemoteError(async () => {
+        await remoteAPI.verifyDevice(deviceCode);
+        // restart the gate with the user code, so it is sent with every request
+        const params = new URLSearchParams(window.location.search);
+        params.set("user_code", deviceCode);
+        params.set("__dm_request__", "1");
+        window.location.assign(window.location.pathname + "?" + params.toString());
     });
 
     const userChanged = (u) => setUid(u);
@@ -192,13 +216,45 @@ export const App = (props) => {
             component: <WaitForPermission
                 userid={uid}
                 waitkey={waitKey}
-                onWaitReady={() => reloadWindow()}
+                onWaitReady={(redirect) => reloadWindow(redirect)}
                 onNoUser={() => navigate("/", { replace: true })} />,
             title: "Wait",
             valid: () => uid != "",
             nextLabel: "",
             submit: () => { },
         },
+        {
+            path: "/device",
+            exact: true,
+            component: <User
+                placeholder="Device code"
+                value={deviceCode}
+                onUserChange={(c) => setDeviceCode(c)}
+                onUserSubmit={deviceEntered}
+            />,
+            title: "Authorize a device",
+            nextLabel: "Next",
+            valid: () => deviceCode != "",
+            submit: deviceEntered,
+        },
+        {
+            path: "/tokens",
+            exact: true,
+            component: <Tokens />,
+            title: "Personal tokens",
+            nextLabel: "",
+            valid: () => true,
+            submit: () => { },
+        },
+        {
+            path: "/admin/grants",
+            exact: true,
+            component: <Grants />,
+            title: "Active grants",
+            nextLabel: "",
+            valid: () => true,
+            submit: () => { },
+        },
         {
             path: "/captcha",
             exact: true,
@@ -223,10 +279,12 @@ export const App = (props) => {
                 value={uid}
                 onUserChange={userChanged}
                 onUserSubmit={userEntered}
+                password={requirePassword ? password : undefined}
+                onPasswordChange={(p) => setPassword(p)}
             />,
             title: "Enter User ID",
             nextLabel: "Next",
-            valid: () => uid != "",
+            valid: () => uid != "" && (!requirePassword || password != ""),
             submit: userEntered,
         },
     ];
@@ -0,0 +1,41 @@
+import { Box, List, ListItem, Typography } from '@mui/joy';
+import * as React from 'react';
+import { RemoteApi } from './RemoteApi';
+
+
+const remoteAPI = new RemoteApi(location.origin);
+
+interface Grant {
+    uid: string
+    range: string
+    policy?: string
+    until: number
+}
+
+export const Grants = () => {
+    const [grants, setGrants] = React.useState<Grant[]>([]);
+    const [message, setMessage] = React.useState("");
+
+    React.useEffect(() => {
+        (async () => {
+            try {
+                setGrants(await remoteAPI.listGrants());
+            } catch (e) {
+                setMessage(e.message);
+            }
+        })();
+    }, []);
+
+    return (
+        <Box sx={{ fontFamily: 'Roboto' }}>
+            {message && <Typography color="danger">{message}</Typography>}
+            <List>
+                {grants.map(g => (
+                    <ListItem key={(g.policy || "") + g.range}>
+                        <b>{g.range}</b>&nbsp;{g.uid}{g.policy && ` [${g.policy}]`} ({g.until ? new Date(g.until * 1000).toLocaleString() : "-"})
+                    </ListItem>
+                ))}
+            </List>
+        </Box>
+    );
+}
@@ -6,6 +6,30 @@ const handleResponse = (response => {
 })
 
 const dmrequest = "__dm_request__";
+const returnTo = "return_to";
+const userCode = "user_code";
+const policy = "policy";
+
+// the gate can be called with a signed return_to parameter or with the user
+// code of a device; they must be sent back to the server when the
+// authorization is done
+const withGateParams = (fd: FormData) => {
+    const params = new URLSearchParams(window.location.search);
+    for (const p of [returnTo, userCode]) {
+        const v = params.get(p);
+        if (v) fd.append(p, v);
+    }
+    return fd;
+}
+
+// the gate is shared by all sites, so every call carries the policy of the
+// site which redirected to the gate
+const apiURL = (base: string, path: string) => {
+    let u = base + `${path}?${dmrequest}=1`;
+    const p = new URLSearchParams(window.location.search).get(policy);
+    if (p) u += `&${policy}=${encodeURIComponent(p)}`;
+    return u;
+}
 
 export class RemoteApi {
     base: string
@@ -13,16 +37,17 @@ export class RemoteApi {
         this.base = base;
     }
 
-    async sendUser(uid, captcha) {
+    async sendUser(uid, captcha, password) {
         let fd = new FormData();
         fd.append("uid", uid);
         fd.append("captcha", captcha);
+        if (password) fd.append("password", password);
         fd.append(dmrequest, "1");
 
-        return fetch(this.base + `/sendUser?${dmrequest}=1`, {
+        return fetch(apiURL(this.base, "/sendUser"), {
             method: 'POST',
             cache: 'no-cache',
-            body: fd,
+            body: withGateParams(fd),
         }).then(handleResponse)
     }
 
@@ -30,7 +55,7 @@ export class RemoteApi {
         let fd = new FormData();
         fd.append("uid", uid);
 
-        return fetch(this.base + `/register?${dmrequest}=1`, {
+        return fetch(apiURL(this.base, "/register"), {
             method: 'POST',
             cache: 'no-cache',
             body: fd,
@@ -42,7 +67,7 @@ export class RemoteApi {
         fd.append("uid", uid);
         fd.append("key", key);
 
-        return fetch(this.base + `/fetchTempRegister?${dmrequest}=1`, {
+        return fetch(apiURL(this.base, "/fetchTempRegister"), {
             method: 'POST',
             cache: 'no-cache',
             body: fd,
@@ -52,7 +77,7 @@ export class RemoteApi {
     async createCaptcha() {
         let fd = new FormData();
 
-        return fetch(this.base + `/createCaptcha?${dmrequest}=1`, {
+        return fetch(apiURL(this.base, "/createCaptcha"), {
             method: 'POST',
             cache: 'no-cache',
             body: fd,
@@ -65,7 +90,7 @@ export class RemoteApi {
         fd.append("key", key);
         fd.append("token", token);
 
-        return fetch(this.base + `/validateTempRegister?${dmrequest}=1`, {
+        return fetch(apiURL(this.base, "/validateTempRegister"), {
             method: 'POST',
             cache: 'no-cache',
             body: fd,
@@ -76,10 +101,10 @@ export class RemoteApi {
         let fd = new FormData();
         fd.append("token", token);
 
-        return fetch(this.base + `/checkToken?${dmrequest}=1`, {
+        return fetch(apiURL(this.base, "/checkToken"), {
             method: 'POST',
             cache: 'no-cache',
-            body: fd
+            body: withGateParams(fd)
         }).then(handleResponse);
     }
 
@@ -87,10 +112,10 @@ export class RemoteApi {
         let fd = new FormData();
         fd.append("token", token);
 
-        return fetch(this.base + `/checkOTP?${dmrequest}=1`, {
+        return fetch(apiURL(this.base, "/checkOTP"), {
             method: 'POST',
             cache: 'no-cache',
-            body: fd
+            body: withGateParams(fd)
         }).then(handleResponse);
     }
 
@@ -98,7 +123,52 @@ export class RemoteApi {
         let fd = new FormData();
         fd.append("token", token);
 
-        return fetch(this.base + `/waitFor?${dmrequest}=1`, {
+        return fetch(apiURL(this.base, "/waitFor"), {
+            method: 'POST',
+            cache: 'no-cache',
+            body: withGateParams(fd)
+        }).then(handleResponse);
+    }
+
+    async verifyDevice(code) {
+        let fd = new FormData();
+        fd.append(userCode, code);
+
+        return fetch(apiURL(this.base, "/device/verify"), {
+            method: 'POST',
+            cache: 'no-cache',
+            body: fd
+        }).then(handleResponse);
+    }
+
+    async listGrants() {
+        return fetch(apiURL(this.base, "/admin/grants"), {
+            cache: 'no-cache',
+        }).then(handleResponse);
+    }
+
+    async listTokens() {
+        return fetch(apiURL(this.base, "/tokens/list"), {
+            cache: 'no-cache',
+        }).then(handleResponse);
+    }
+
+    async createToken(name) {
+        let fd = new FormData();
+        fd.append("name", name);
+
+        return fetch(apiURL(this.base, "/tokens/create"), {
+            method: 'POST',
+            cache: 'no-cache',
+            body: fd
+        }).then(handleResponse);
+    }
+
+    async revokeToken(id) {
+        let fd = new FormData();
+        fd.append("id", id);
+
+        return fetch(apiURL(this.base, "/tokens/revoke"), {
             method: 'POST',
             cache: 'no-cache',
             body: fd
@@ -106,7 +176,7 @@ export class RemoteApi {
     }
 
     async uisettings() {
-        return fetch(this.base + `/uisettings?${dmrequest}=1`).then(handleResponse)
+        return fetch(apiURL(this.base, "/uisettings")).then(handleResponse)
     }
 
 }
\ No newline at end of file
@@ -0,0 +1,74 @@
+import { Box, Button, FormControl, Input, List, ListItem, Typography } from '@mui/joy';
+import * as React from 'react';
+import { RemoteApi } from './RemoteApi';
+
+
+const remoteAPI = new RemoteApi(location.origin);
+
+interface PersonalToken {
+    id: string
+    name: string
+    expires: number
+}
+
+export const Tokens = () => {
+    const [tokens, setTokens] = React.useState<PersonalToken[]>([]);
+    const [name, setName] = React.useState("");
+    const [created, setCreated] = React.useState("");
+    const [message, setMessage] = React.useState("");
+
+    const reload = async () => {
+        try {
+            setTokens(await remoteAPI.listTokens());
+        } catch (e) {
+            setMessage(e.message);
+        }
+    }
+
+    React.useEffect(() => {
+        reload();
+    }, []);
+
+    const create = async () => {
+        try {
+            let r = await remoteAPI.createToken(name);
+            setCreated(r.data.token);
+            setName("");
+        } catch (e) {
+            setMessage(e.message);
+        }
+        await reload();
+    }
+
+    const revoke = async (id: string) => {
+        try {
+            await remoteAPI.revokeToken(id);
+        } catch (e) {
+            setMessage(e.message);
+        }
+        await reload();
+    }
+
+    return (
+        <Box sx={{ fontFamily: 'Roboto' }}>
+            {message && <Typography color="danger">{message}</Typography>}
+            {created && <Box sx={{ wordBreak: "break-all", marginBottom: "10px" }}>
+                Your new token, it will not be shown again: <b>{created}</b>
+            </Box>}
+            <List>
+                {tokens.map(t => (
+                    <ListItem key={t.id} endAction={<Button size="sm" variant="outlined" onClick={() => revoke(t.id)}>Revoke</Button>}>
+                        {t.name} ({new Date(t.expires * 1000).toLocaleDateString()})
+                    </ListItem>
+                ))}
+            </List>
+            <FormControl>
+                <Input
+                    placeholder="Token name"
+                    value={name}
+                    onChange={(evt) => setName(evt.target.value)}
+                    endDecorator={<Button disabled={name == ""} onClick={create}>Create</Button>} />
+            </FormControl>
+        </Box>
+    );
+}
@@ -6,9 +6,12 @@ interface UserProps {
     value: string
     onUserChange: (s: string) => void
     onUserSubmit: () => void
+    // the password field is only shown if a password is given
+    password?: string
+    onPasswordChange?: (s: string) => void
 }
 
-export const User = ({ placeholder, value, onUserChange, onUserSubmit }: UserProps) => {
+export const User = ({ placeholder, value, onUserChange, onUserSubmit, password, onPasswordChange }: UserProps) => {
 
     const checkEnter = (evt: React.KeyboardEvent) => {
         if (evt.key === "Enter") {
@@ -27,6 +30,14 @@ export const User = ({ placeholder, value, onUserChange, onUserSubmit }: UserPro
                 onKeyDown={(evt) => checkEnter(evt)}
                 onChange={(evt) => onUserChange(evt.target.value)} />
         </FormControl>
+        {password !== undefined && <FormControl sx={{ marginTop: "4px" }}>
+            <Input
+                placeholder="Password"
+                type="password"
+                value={password}
+                onKeyDown={(evt) => checkEnter(evt)}
+                onChange={(evt) => onPasswordChange(evt.target.value)} />
+        </FormControl>}
         </Box>
     );
 }
\ No newline at end of file
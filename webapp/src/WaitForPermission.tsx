@@ -9,7 +9,7 @@ interface WaitForPermissionProps {
     waitkey: string
     userid: string
     onNoUser: () => void
-    onWaitReady: () => void
+    onWaitReady: (redirect?: string) => void
 }
 export const WaitForPermission = ({ waitkey, userid, onNoUser, onWaitReady }: WaitForPermissionProps) => {
 
@@ -17,12 +17,14 @@ export const WaitForPermission = ({ waitkey, userid, onNoUser, onWaitReady }: Wa
 
     React.useEffect(() => {
         const waitfor = async () => {
+            let redirect;
             try {
-                await remoteAPI.waitFor(waitkey);
+                let r = await remoteAPI.waitFor(waitkey);
+                redirect = r.redirect;
             } catch (err) {
                 console.error(err);
             }
-            onWaitReady();
+            onWaitReady(redirect);
 
         }
         waitfor()
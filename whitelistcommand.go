@@ -0,0 +1,79 @@
+package doorman
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+var (
+	_ whitelistLoader  = (*commandWhitelist)(nil)
+	_ refreshingLoader = (*commandWhitelist)(nil)
+
+	valueWhiteListCommandLoader = "command"
+)
+
+const (
+	defaultCommandWhitelistTimeout = Duration(30 * time.Second)
+)
+
+// commandWhitelist runs a program which prints the IPs and CIDRs to stdout,
+// one or more per line or as a JSON array.
+type commandWhitelist struct {
+	Command  string   `json:"command"`
+	Args     []string `json:"args,omitempty"`
+	Timeout  Duration `json:"timeout,omitempty"`
+	Interval Duration `json:"interval,omitempty"`
+}
+
+func newCommandWhitelist(cfg commandWhitelist, rpl *caddy.Replacer) (*commandWhitelist, error) {
+	cfg.Command = rpl.ReplaceKnown(cfg.Command, "")
+	if cfg.Command == "" {
+		return nil, fmt.Errorf("the command whitelister needs a command")
+	}
+	for i, a := range cfg.Args {
+		cfg.Args[i] = rpl.ReplaceKnown(a, "")
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultCommandWhitelistTimeout
+	}
+	return &cfg, nil
+}
+
+func (cw *commandWhitelist) refreshInterval() time.Duration {
+	return time.Duration(cw.Interval)
+}
+
+func (cw *commandWhitelist) Fetch(log *zap.Logger) (*Whitelist, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cw.Timeout))
+	defer cancel()
+
+	var stderr bytes.Buffer
+	c := exec.CommandContext(ctx, cw.Command, cw.Args...)
+	c.Stderr = &stderr
+	// children of the command may keep stdout open after a timeout
+	c.WaitDelay = time.Second
+	out, err := c.Output()
+	if ctx.Err() != nil {
+		return nil, fmt.Errorf("whitelist command %q timed out after %s", cw.Command, time.Duration(cw.Timeout))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("whitelist command %q failed (%s): %w", cw.Command, strings.TrimSpace(stderr.String()), err)
+	}
+	format := formatText
+	if bytes.HasPrefix(bytes.TrimSpace(out), []byte("[")) {
+		format = formatJSON
+	}
+	entries, err := parseWhitelistData(format, out)
+	if err != nil {
+		return nil, fmt.Errorf("whitelist command %q: %w", cw.Command, err)
+	}
+	sw := staticWhiteList(entries)
+	return sw.Fetch(log)
+}
@@ -0,0 +1,44 @@
+package doorman
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func Test_commandWhitelist_Fetch(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		allowed string
+		wantErr bool
+	}{
+		{name: "lines", script: "echo 1.2.3.4; echo 10.0.0.0/8", allowed: "10.1.1.1"},
+		{name: "json array", script: `echo '["1.2.3.4", "10.0.0.0/8"]'`, allowed: "1.2.3.4"},
+		{name: "failing command", script: "echo 1.2.3.4; echo broken >&2; exit 1", wantErr: true},
+		{name: "illegal output", script: "echo no ip", wantErr: true},
+		{name: "timeout", script: "sleep 5", timeout: 100 * time.Millisecond, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cw, err := newCommandWhitelist(commandWhitelist{
+				Command: "/bin/sh",
+				Args:    []string{"-c", tt.script},
+				Timeout: Duration(tt.timeout),
+			}, caddy.NewReplacer())
+			if err != nil {
+				t.Fatal(err)
+			}
+			wl, err := cw.Fetch(zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !wl.IsAllowed(zap.NewNop(), tt.allowed) {
+				t.Errorf("Fetch() list does not allow %s", tt.allowed)
+			}
+		})
+	}
+}
@@ -0,0 +1,233 @@
+package doorman
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+var (
+	_ whitelistLoader  = (*dnsWhitelist)(nil)
+	_ refreshingLoader = (*dnsWhitelist)(nil)
+	_ hostResolver     = (*dnsResolver)(nil)
+
+	valueWhiteListDNSLoader = "dns"
+)
+
+const (
+	defaultDNSMinTTL  = Duration(30 * time.Second)
+	defaultDNSMaxTTL  = Duration(1 * time.Hour)
+	defaultDNSGrace   = Duration(1 * time.Hour)
+	defaultDNSTimeout = Duration(5 * time.Second)
+	resolvConf        = "/etc/resolv.conf"
+)
+
+// resolvedIP is an address of a host together with the TTL of its record.
+type resolvedIP struct {
+	IP  net.IP
+	TTL time.Duration
+}
+
+// hostResolver resolves the A and AAAA records of a host.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]resolvedIP, error)
+}
+
+// dnsResolver queries the given nameservers directly, because the resolver
+// of the standard library does not return the TTL of the records.
+type dnsResolver struct {
+	servers []string
+	client  *dns.Client
+}
+
+func newDNSResolver(servers []string) *dnsResolver {
+	if len(servers) == 0 {
+		if cfg, err := dns.ClientConfigFromFile(resolvConf); err == nil {
+			for _, s := range cfg.Servers {
+				servers = append(servers, net.JoinHostPort(s, cfg.Port))
+			}
+		}
+	}
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:53"}
+	}
+	return &dnsResolver{servers: servers, client: &dns.Client{}}
+}
+
+func (r *dnsResolver) query(ctx context.Context, server, host string, qtype uint16) ([]resolvedIP, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(host), qtype)
+	rsp, _, err := r.client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return nil, err
+	}
+	if rsp.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("cannot resolve %q: %s", host, dns.RcodeToString[rsp.Rcode])
+	}
+	var res []resolvedIP
+	for _, rr := range rsp.Answer {
+		ttl := time.Duration(rr.Header().Ttl) * time.Second
+		switch a := rr.(type) {
+		case *dns.A:
+			res = append(res, resolvedIP{IP: a.A, TTL: ttl})
+		case *dns.AAAA:
+			res = append(res, resolvedIP{IP: a.AAAA, TTL: ttl})
+		}
+	}
+	return res, nil
+}
+
+func (r *dnsResolver) LookupHost(ctx context.Context, host string) ([]resolvedIP, error) {
+	var lastErr error
+	for _, s := range r.servers {
+		var res []resolvedIP
+		lastErr = nil
+		for _, qt := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			ips, err := r.query(ctx, s, host, qt)
+			if err != nil {
+				lastErr = err
+				break
+			}
+			res = append(res, ips...)
+		}
+		if lastErr != nil {
+			continue
+		}
+		if len(res) == 0 {
+			return nil, fmt.Errorf("no addresses for %q", host)
+		}
+		return res, nil
+	}
+	return nil, fmt.Errorf("cannot resolve %q: %w", host, lastErr)
+}
+
+// resolvedHost are the last known addresses of a host.
+type resolvedHost struct {
+	ips      []net.IP
+	resolved time.Time
+}
+
+// dnsWhitelist whitelists the addresses of hostnames, for example dynamic
+// DNS names of home offices. The names are resolved again when the shortest
+// TTL expires, bounded by MinTTL and MaxTTL. If a name cannot be resolved,
+// its last addresses stay valid for the Grace duration.
+type dnsWhitelist struct {
+	Hosts   []string `json:"hosts"`
+	Servers []string `json:"servers,omitempty"`
+	MinTTL  Duration `json:"min_ttl,omitempty"`
+	MaxTTL  Duration `json:"max_ttl,omitempty"`
+	Grace   Duration `json:"grace,omitempty"`
+	Timeout Duration `json:"timeout,omitempty"`
+
+	resolver hostResolver
+	clock    clock.Clock
+	lock     sync.Mutex
+	known    map[string]*resolvedHost
+	next     time.Duration
+}
+
+func newDNSWhitelist(cfg *dnsWhitelist, cl clock.Clock, res hostResolver) (*dnsWhitelist, error) {
+	if len(cfg.Hosts) == 0 {
+		return nil, fmt.Errorf("the dns whitelister needs at least one host")
+	}
+	if cfg.MinTTL == 0 {
+		cfg.MinTTL = defaultDNSMinTTL
+	}
+	if cfg.MaxTTL == 0 {
+		cfg.MaxTTL = defaultDNSMaxTTL
+	}
+	if cfg.MaxTTL < cfg.MinTTL {
+		return nil, fmt.Errorf("max_ttl must not be smaller than min_ttl")
+	}
+	if cfg.Grace == 0 {
+		cfg.Grace = defaultDNSGrace
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultDNSTimeout
+	}
+	if res == nil {
+		res = newDNSResolver(cfg.Servers)
+	}
+	cfg.resolver = res
+	cfg.clock = cl
+	cfg.known = make(map[string]*resolvedHost)
+	return cfg, nil
+}
+
+func (dw *dnsWhitelist) clampTTL(ttl time.Duration) time.Duration {
+	if ttl < time.Duration(dw.MinTTL) {
+		return time.Duration(dw.MinTTL)
+	}
+	if ttl > time.Duration(dw.MaxTTL) {
+		return time.Duration(dw.MaxTTL)
+	}
+	return ttl
+}
+
+func (dw *dnsWhitelist) refreshInterval() time.Duration {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+	if dw.next == 0 {
+		return time.Duration(dw.MinTTL)
+	}
+	return dw.next
+}
+
+func (dw *dnsWhitelist) resolve(log *zap.Logger, host string, now time.Time) time.Duration {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(dw.Timeout))
+	defer cancel()
+	addrs, err := dw.resolver.LookupHost(ctx, host)
+	if err != nil {
+		kh := dw.known[host]
+		if kh != nil && now.Sub(kh.resolved) <= time.Duration(dw.Grace) {
+			log.Warn("cannot resolve whitelisted host, keep last addresses", zap.String("host", host), zap.Error(err))
+		} else {
+			delete(dw.known, host)
+			log.Error("cannot resolve whitelisted host", zap.String("host", host), zap.Error(err))
+		}
+		return time.Duration(dw.MinTTL)
+	}
+	ttl := time.Duration(dw.MaxTTL)
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+		if a.TTL < ttl {
+			ttl = a.TTL
+		}
+	}
+	dw.known[host] = &resolvedHost{ips: ips, resolved: now}
+	return dw.clampTTL(ttl)
+}
+
+func (dw *dnsWhitelist) Fetch(log *zap.Logger) (*Whitelist, error) {
+	dw.lock.Lock()
+	defer dw.lock.Unlock()
+
+	now := dw.clock.Now()
+	next := time.Duration(dw.MaxTTL)
+	for _, h := range dw.Hosts {
+		if ttl := dw.resolve(log, strings.TrimSpace(h), now); ttl < next {
+			next = ttl
+		}
+	}
+	dw.next = next
+
+	var entries []string
+	for _, kh := range dw.known {
+		for _, ip := range kh.ips {
+			entries = append(entries, ip.String())
+		}
+	}
+	sort.Strings(entries)
+	log.Debug("resolved whitelisted hosts", zap.Strings("ips", entries), zap.Duration("next", next))
+	sw := staticWhiteList(entries)
+	return sw.Fetch(log)
+}
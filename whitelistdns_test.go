@@ -0,0 +1,163 @@
+package doorman
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"github.com/miekg/dns"
+	"go.uber.org/zap"
+)
+
+type fakeResolver struct {
+	lock  sync.Mutex
+	hosts map[string][]resolvedIP
+}
+
+func (fr *fakeResolver) set(host string, ips ...resolvedIP) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	if ips == nil {
+		delete(fr.hosts, host)
+		return
+	}
+	fr.hosts[host] = ips
+}
+
+func (fr *fakeResolver) LookupHost(ctx context.Context, host string) ([]resolvedIP, error) {
+	fr.lock.Lock()
+	defer fr.lock.Unlock()
+	ips, ok := fr.hosts[host]
+	if !ok {
+		return nil, fmt.Errorf("no such host: %s", host)
+	}
+	return ips, nil
+}
+
+func rip(ip string, ttl time.Duration) resolvedIP {
+	return resolvedIP{IP: net.ParseIP(ip), TTL: ttl}
+}
+
+func Test_dnsWhitelist_Fetch(t *testing.T) {
+	lg := zap.NewNop()
+	mock := clock.NewMock()
+	fr := &fakeResolver{hosts: make(map[string][]resolvedIP)}
+	fr.set("home.dyndns.example", rip("1.2.3.4", 5*time.Minute), rip("2001:db8::1", 2*time.Minute))
+	fr.set("partner.example.com", rip("5.6.7.8", 10*time.Second))
+
+	dw, err := newDNSWhitelist(&dnsWhitelist{
+		Hosts: []string{"home.dyndns.example", "partner.example.com"},
+		Grace: Duration(time.Hour),
+	}, mock, fr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wl, err := dw.Fetch(lg)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	for _, ip := range []string{"1.2.3.4", "2001:db8::1", "5.6.7.8"} {
+		if !wl.IsAllowed(lg, ip) {
+			t.Errorf("Fetch() list does not allow %s", ip)
+		}
+	}
+	if got := dw.refreshInterval(); got != time.Duration(defaultDNSMinTTL) {
+		t.Errorf("refreshInterval() = %v, want the min ttl", got)
+	}
+
+	// a changed address replaces the old one
+	fr.set("partner.example.com", rip("5.6.7.9", 2*time.Hour))
+	wl, _ = dw.Fetch(lg)
+	if wl.IsAllowed(lg, "5.6.7.8") || !wl.IsAllowed(lg, "5.6.7.9") {
+		t.Errorf("Fetch() did not replace the changed address")
+	}
+	if got := dw.refreshInterval(); got != 2*time.Minute {
+		t.Errorf("refreshInterval() = %v, want the shortest ttl", got)
+	}
+
+	// failures keep the last addresses for the grace period
+	fr.set("home.dyndns.example")
+	mock.Add(30 * time.Minute)
+	wl, _ = dw.Fetch(lg)
+	if !wl.IsAllowed(lg, "1.2.3.4") {
+		t.Errorf("Fetch() dropped the addresses within the grace period")
+	}
+	mock.Add(31 * time.Minute)
+	wl, _ = dw.Fetch(lg)
+	if wl.IsAllowed(lg, "1.2.3.4") {
+		t.Errorf("Fetch() kept the addresses after the grace period")
+	}
+	if !wl.IsAllowed(lg, "5.6.7.9") {
+		t.Errorf("Fetch() dropped the addresses of a resolvable host")
+	}
+}
+
+func Test_dnsWhitelist_clampTTL(t *testing.T) {
+	dw, err := newDNSWhitelist(&dnsWhitelist{
+		Hosts:  []string{"home.dyndns.example"},
+		MinTTL: Duration(time.Minute),
+		MaxTTL: Duration(time.Hour),
+	}, clock.NewMock(), &fakeResolver{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		ttl  time.Duration
+		want time.Duration
+	}{
+		{ttl: time.Second, want: time.Minute},
+		{ttl: 10 * time.Minute, want: 10 * time.Minute},
+		{ttl: 24 * time.Hour, want: time.Hour},
+	}
+	for _, tt := range tests {
+		if got := dw.clampTTL(tt.ttl); got != tt.want {
+			t.Errorf("clampTTL(%v) = %v, want %v", tt.ttl, got, tt.want)
+		}
+	}
+	if _, err := newDNSWhitelist(&dnsWhitelist{Hosts: []string{"a"}, MinTTL: Duration(time.Hour), MaxTTL: Duration(time.Minute)}, clock.NewMock(), nil); err == nil {
+		t.Errorf("a max_ttl below the min_ttl must be rejected")
+	}
+}
+
+func Test_dnsResolver_LookupHost(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		q := r.Question[0]
+		if q.Name != "home.dyndns.example." {
+			m.Rcode = dns.RcodeNameError
+			_ = w.WriteMsg(m)
+			return
+		}
+		hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP("1.2.3.4")})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP("2001:db8::1")})
+		}
+		_ = w.WriteMsg(m)
+	})}
+	go func() { _ = srv.ActivateAndServe() }()
+	defer func() { _ = srv.Shutdown() }()
+
+	res := newDNSResolver([]string{pc.LocalAddr().String()})
+	ips, err := res.LookupHost(context.Background(), "home.dyndns.example")
+	if err != nil {
+		t.Fatalf("LookupHost() error = %v", err)
+	}
+	if len(ips) != 2 || !ips[0].IP.Equal(net.ParseIP("1.2.3.4")) || !ips[1].IP.Equal(net.ParseIP("2001:db8::1")) || ips[0].TTL != time.Minute {
+		t.Errorf("LookupHost() = %v", ips)
+	}
+	if _, err := res.LookupHost(context.Background(), "unknown.example"); err == nil {
+		t.Errorf("LookupHost() of an unknown host should fail")
+	}
+}
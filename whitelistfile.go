@@ -0,0 +1,193 @@
+package doorman
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/fsnotify.v1"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	_ whitelistLoader = (*fileWhitelist)(nil)
+	_ watchingLoader  = (*fileWhitelist)(nil)
+
+	valueWhiteListFileLoader = "file"
+)
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+	formatYAML = "yaml"
+
+	// kubernetes swaps the content of a mounted ConfigMap by replacing this
+	// symlink
+	k8sDataDir = "..data"
+
+	// a file is reloaded when there was no further change for this time, a
+	// save truncates the file first and writes it in several steps
+	fileWatchDebounce = 100 * time.Millisecond
+)
+
+// fileWhitelist loads IPs and CIDRs from a file. The file can be a text
+// file with one or more entries per line, a JSON array or a YAML list. Text
+// and JSON files may contain lines with comments starting with '#'.
+type fileWhitelist struct {
+	Path   string `json:"path"`
+	Format string `json:"format,omitempty"`
+	Watch  bool   `json:"watch"`
+}
+
+func (fw *fileWhitelist) format() string {
+	if fw.Format != "" {
+		return strings.ToLower(fw.Format)
+	}
+	switch strings.ToLower(filepath.Ext(fw.Path)) {
+	case ".json":
+		return formatJSON
+	case ".yaml", ".yml":
+		return formatYAML
+	default:
+		return formatText
+	}
+}
+
+// stripComments removes everything after a '#' in every line.
+func stripComments(data []byte) []string {
+	var res []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		l := sc.Text()
+		if i := strings.Index(l, "#"); i >= 0 {
+			l = l[:i]
+		}
+		res = append(res, l)
+	}
+	return res
+}
+
+// parseTextList parses entries which are separated by whitespace, commas
+// or newlines.
+func parseTextList(data []byte) []string {
+	var res []string
+	for _, l := range stripComments(data) {
+		res = append(res, strings.FieldsFunc(l, func(r rune) bool {
+			return r == ',' || r == ' ' || r == '\t' || r == ';'
+		})...)
+	}
+	return res
+}
+
+func parseWhitelistData(format string, data []byte) ([]string, error) {
+	switch format {
+	case formatText:
+		return parseTextList(data), nil
+	case formatJSON:
+		var res []string
+		if err := json.Unmarshal([]byte(strings.Join(stripComments(data), "\n")), &res); err != nil {
+			return nil, fmt.Errorf("cannot parse json whitelist: %w", err)
+		}
+		return res, nil
+	case formatYAML:
+		var res []string
+		if err := yaml.Unmarshal(data, &res); err != nil {
+			return nil, fmt.Errorf("cannot parse yaml whitelist: %w", err)
+		}
+		return res, nil
+	default:
+		return nil, fmt.Errorf("unknown whitelist format: %q", format)
+	}
+}
+
+// Fetch reads the file. An empty file is an error, so the last list is kept
+// when the file is read while it is saved; a file with only comments is an
+// empty list.
+func (fw *fileWhitelist) Fetch(log *zap.Logger) (*Whitelist, error) {
+	data, err := os.ReadFile(fw.Path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read whitelist file: %w", err)
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		return nil, fmt.Errorf("whitelist file is empty: %s", fw.Path)
+	}
+	entries, err := parseWhitelistData(fw.format(), data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", fw.Path, err)
+	}
+	sw := staticWhiteList(entries)
+	return sw.Fetch(log)
+}
+
+func (fw *fileWhitelist) watch(log *zap.Logger, stop <-chan struct{}, changed func()) error {
+	if !fw.Watch {
+		return nil
+	}
+	return watchFile(log, fw.Path, stop, changed)
+}
+
+// watchFile observes the directory of the file and not the file itself.
+// Editors and kubernetes replace the file with a rename or a symlink swap,
+// and a watch on the old inode would not see any further change. The events
+// are debounced, so a file which is written in several steps is read once.
+func watchFile(log *zap.Logger, path string, stop <-chan struct{}, changed func()) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dir, base := filepath.Split(path)
+	if dir == "" {
+		dir = "."
+	}
+	if err := watcher.Add(dir); err != nil {
+		watcher.Close()
+		return err
+	}
+	go func() {
+		defer watcher.Close()
+		log.Info("start file watcher", zap.String("path", path))
+		debounce := time.NewTimer(fileWatchDebounce)
+		debounce.Stop()
+		defer debounce.Stop()
+		for {
+			select {
+			case <-stop:
+				log.Info("stop file watcher", zap.String("path", path))
+				return
+			case <-debounce.C:
+				changed()
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				name := filepath.Base(event.Name)
+				if name != base && name != k8sDataDir {
+					continue
+				}
+				if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename) == 0 {
+					continue
+				}
+				log.Info("file changed", zap.String("path", path), zap.String("op", event.Op.String()))
+				if !debounce.Stop() {
+					select {
+					case <-debounce.C:
+					default:
+					}
+				}
+				debounce.Reset(fileWatchDebounce)
+			case err, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				log.Error("watch error occurred", zap.Error(err))
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,231 @@
+package doorman
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/benbjohnson/clock"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_parseWhitelistData(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		data    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name:   "text with comments",
+			format: formatText,
+			data:   "# office\n1.2.3.4 # gateway\n\n10.0.0.0/8, 2001:db8::/32\n",
+			want:   []string{"1.2.3.4", "10.0.0.0/8", "2001:db8::/32"},
+		},
+		{
+			name:   "json with comments",
+			format: formatJSON,
+			data:   "# vpn\n[\"1.2.3.4\",\n \"10.0.0.0/8\"]",
+			want:   []string{"1.2.3.4", "10.0.0.0/8"},
+		},
+		{
+			name:   "yaml",
+			format: formatYAML,
+			data:   "# vpn\n- 1.2.3.4\n- 10.0.0.0/8 # net\n",
+			want:   []string{"1.2.3.4", "10.0.0.0/8"},
+		},
+		{
+			name:    "illegal json",
+			format:  formatJSON,
+			data:    "{\"1.2.3.4\"}",
+			wantErr: true,
+		},
+		{
+			name:    "unknown format",
+			format:  "xml",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseWhitelistData(tt.format, []byte(tt.data))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseWhitelistData() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseWhitelistData() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func waitForAllowed(t *testing.T, wl *whitelister, ip string, want bool) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if wl.isAllowed(zap.NewNop(), ip) == want {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("isAllowed(%s) did not change to %v", ip, want)
+}
+
+// waitForReload waits until the slot finished a refresh after the given
+// number of loads.
+func waitForReload(t *testing.T, slot *whitelistSlot, loads int64) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if slot.loads.Load() > loads {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("the whitelist was not reloaded")
+}
+
+func writeFile(t *testing.T, path, content string) {
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func Test_fileWhitelist_watchRename(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "whitelist.txt")
+	writeFile(t, path, "1.2.3.4\n")
+
+	wl := newWhitelister()
+	defer wl.stop()
+	if err := wl.add(zap.NewNop(), "file", &fileWhitelist{Path: path, Watch: true}); err != nil {
+		t.Fatal(err)
+	}
+	waitForAllowed(t, wl, "1.2.3.4", true)
+
+	// atomic replace like an editor does it
+	tmp := filepath.Join(dir, "whitelist.tmp")
+	writeFile(t, tmp, "5.6.7.8\n")
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	waitForAllowed(t, wl, "5.6.7.8", true)
+	waitForAllowed(t, wl, "1.2.3.4", false)
+
+	// a broken file keeps the last good list
+	slot := wl.slots[0]
+	loads := slot.loads.Load()
+	writeFile(t, path, "not an ip\n")
+	waitForReload(t, slot, loads)
+	if !wl.isAllowed(zap.NewNop(), "5.6.7.8") {
+		t.Errorf("a broken file must keep the last good list")
+	}
+
+	// a truncated file, like in the middle of a save, keeps it, too
+	loads = slot.loads.Load()
+	writeFile(t, path, "")
+	waitForReload(t, slot, loads)
+	if !wl.isAllowed(zap.NewNop(), "5.6.7.8") {
+		t.Errorf("an empty file must keep the last good list")
+	}
+
+	// a file with comments only clears the list
+	writeFile(t, path, "# nobody\n")
+	waitForAllowed(t, wl, "5.6.7.8", false)
+}
+
+func Test_fileWhitelist_watchConfigMap(t *testing.T) {
+	dir := t.TempDir()
+	v1 := filepath.Join(dir, "..v1")
+	v2 := filepath.Join(dir, "..v2")
+	for _, d := range []string{v1, v2} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeFile(t, filepath.Join(v1, "whitelist.yaml"), "- 1.2.3.4\n")
+	writeFile(t, filepath.Join(v2, "whitelist.yaml"), "- 5.6.7.8\n")
+	data := filepath.Join(dir, k8sDataDir)
+	if err := os.Symlink("..v1", data); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "whitelist.yaml")
+	if err := os.Symlink(filepath.Join(k8sDataDir, "whitelist.yaml"), path); err != nil {
+		t.Fatal(err)
+	}
+
+	wl := newWhitelister()
+	defer wl.stop()
+	if err := wl.add(zap.NewNop(), "configmap", &fileWhitelist{Path: path, Watch: true}); err != nil {
+		t.Fatal(err)
+	}
+	waitForAllowed(t, wl, "1.2.3.4", true)
+
+	// swap the data symlink the same way the kubelet does
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink("..v2", tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, data); err != nil {
+		t.Fatal(err)
+	}
+	waitForAllowed(t, wl, "5.6.7.8", true)
+	waitForAllowed(t, wl, "1.2.3.4", false)
+}
+
+// waitForStoppedWatchers waits until n file watchers logged their stop.
+func waitForStoppedWatchers(t *testing.T, logs *observer.ObservedLogs, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if logs.FilterMessage("stop file watcher").Len() >= n {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatalf("%d file watchers were not stopped", n)
+}
+
+func Test_fromWhitelistSpecs_stopOnError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.txt")
+	writeFile(t, path, "1.2.3.4\n")
+	spec, _ := json.Marshal(fileWhitelist{Path: path, Watch: true})
+	core, logs := observer.New(zap.InfoLevel)
+
+	_, err := fromWhitelistSpecs(zap.New(core), clock.New(), Plugins{
+		{Type: valueWhiteListFileLoader, Name: "file", Spec: spec},
+		{Type: valueWhiteListFileLoader, Name: "broken", Spec: json.RawMessage(`{"path": 1}`)},
+	})
+	if err == nil {
+		t.Fatalf("fromWhitelistSpecs() with a broken spec must fail")
+	}
+	waitForStoppedWatchers(t, logs, 1)
+}
+
+func Test_MiddlewareApp_Cleanup(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "whitelist.txt")
+	writeFile(t, path, "1.2.3.4\n")
+	spec, _ := json.Marshal(fileWhitelist{Path: path, Watch: true})
+	core, logs := observer.New(zap.InfoLevel)
+	specs := Plugins{{Type: valueWhiteListFileLoader, Name: "file", Spec: spec}}
+
+	m := &MiddlewareApp{}
+	var err error
+	if m.whitelister, err = fromWhitelistSpecs(zap.New(core), clock.New(), specs); err != nil {
+		t.Fatal(err)
+	}
+	if m.blocklister, err = fromWhitelistSpecs(zap.New(core), clock.New(), specs); err != nil {
+		t.Fatal(err)
+	}
+	// the app was provisioned, but never started
+	if err := m.Cleanup(); err != nil {
+		t.Errorf("Cleanup() error = %v", err)
+	}
+	waitForStoppedWatchers(t, logs, 2)
+	if err := m.Cleanup(); err != nil {
+		t.Errorf("a second Cleanup() error = %v", err)
+	}
+}
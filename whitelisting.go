@@ -3,8 +3,15 @@ package doorman
 import (
 	"encoding/json"
 	"fmt"
-	"net"
+	"math/rand"
+	"net/http"
+	"net/netip"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/benbjohnson/clock"
+	"github.com/caddyserver/caddy/v2"
 	"go.uber.org/zap"
 )
 
@@ -14,12 +21,8 @@ var (
 	valueWhiteListListLoader = "list"
 )
 
-type IPMap map[string]bool
-type Networks []*net.IPNet
-
 type Whitelist struct {
-	ips  IPMap
-	nets Networks
+	nets *prefixTrie
 }
 
 type whitelistLoader interface {
@@ -28,89 +31,275 @@ type whitelistLoader interface {
 
 type staticWhiteList []string
 
-func parseStaticList(sw []string) (IPMap, Networks, error) {
-	statics := make(IPMap)
-	nets := make(Networks, 0)
+// parseStaticList parses IPs and CIDRs into a prefix trie.
+func parseStaticList(sw []string) (*prefixTrie, error) {
+	nets := &prefixTrie{}
 	for _, we := range sw {
-		iip, ipnet, err := net.ParseCIDR(we)
-		if err != nil {
-			ip := net.ParseIP(we)
-			if ip == nil {
-				return nil, nil, fmt.Errorf("cannot parse %q as ip", we)
-			}
-			statics[we] = true
-		} else {
-			// if we have an ipv4 with a 32bit mask, this is a singular ip
-			if ones, bits := ipnet.Mask.Size(); ones == 32 && bits == 32 {
-				statics[iip.String()] = true
-				continue
+		if strings.Contains(we, "/") {
+			p, err := netip.ParsePrefix(we)
+			if err != nil {
+				return nil, fmt.Errorf("cannot parse %q as network: %w", we, err)
 			}
-			nets = append(nets, ipnet)
+			nets.insert(p)
+			continue
+		}
+		ip, err := netip.ParseAddr(we)
+		if err != nil {
+			return nil, fmt.Errorf("cannot parse %q as ip", we)
 		}
+		ip = ip.Unmap().WithZone("")
+		nets.insert(netip.PrefixFrom(ip, ip.BitLen()))
 	}
-	return statics, nets, nil
+	return nets, nil
 }
 
 func (sw *staticWhiteList) Fetch(log *zap.Logger) (*Whitelist, error) {
-	ips, nets, err := parseStaticList(*sw)
+	nets, err := parseStaticList(*sw)
 	if err != nil {
 		return nil, err
 	}
 	return &Whitelist{
-		ips:  ips,
 		nets: nets,
 	}, nil
 }
 
 func (w *Whitelist) IsAllowed(log *zap.Logger, clip string) bool {
-	if ok := w.ips[clip]; ok {
+	ip, err := netip.ParseAddr(clip)
+	if err != nil {
+		return false
+	}
+	if n, ok := w.nets.lookup(ip); ok {
+		// this is called for every request, so do not format the net for
+		// nothing
+		if ce := log.Check(zap.DebugLevel, "ip is whitelisted"); ce != nil {
+			ce.Write(zap.String("net", n.String()), zap.String("ip", clip))
+		}
 		return true
 	}
-	ip := net.ParseIP(clip)
-	if ip == nil {
-		return false
+	return false
+}
+
+// whitelistSlot holds the current list of a loader. A reload swaps the list
+// atomically; if a loader fails, the last good list is kept.
+type whitelistSlot struct {
+	name   string
+	loader whitelistLoader
+	list   atomic.Pointer[Whitelist]
+	// loads counts the finished refreshes, good or not
+	loads atomic.Int64
+}
+
+func (ws *whitelistSlot) refresh(log *zap.Logger) error {
+	defer ws.loads.Add(1)
+	wl, err := ws.loader.Fetch(log)
+	if err != nil {
+		log.Error("cannot fetch loader data, keep last list", zap.String("backend", ws.name), zap.Error(err))
+		return err
 	}
+	ws.list.Store(wl)
+	return nil
+}
 
-	for _, n := range w.nets {
-		if n.Contains(ip) {
-			log.Debug("ip is whitelisted", zap.String("net", n.String()), zap.String("ip", clip))
-			return true
+// refreshingLoader is a loader with its own refresh interval. The interval
+// is asked again before every refresh, so it can change over time.
+type refreshingLoader interface {
+	refreshInterval() time.Duration
+}
+
+// WhitelistRefresh configures how often the whitelist loaders are fetched
+// again. Jitter is a fraction of the interval which is randomly added or
+// subtracted, so many instances do not fetch at the same moment. After a
+// failure the interval doubles up to MaxBackoff.
+type WhitelistRefresh struct {
+	Interval   Duration `json:"interval,omitempty"`
+	Jitter     float64  `json:"jitter,omitempty"`
+	MaxBackoff Duration `json:"max_backoff,omitempty"`
+}
+
+const (
+	defaultRefreshJitter = 0.1
+)
+
+func (wr WhitelistRefresh) interval(ldr whitelistLoader) time.Duration {
+	if rl, ok := ldr.(refreshingLoader); ok {
+		if iv := rl.refreshInterval(); iv > 0 {
+			return iv
 		}
 	}
-	return false
+	return time.Duration(wr.Interval)
+}
+
+// nextRefresh returns the duration until the next refresh. rnd is a random
+// value in [0,1).
+func (wr WhitelistRefresh) nextRefresh(interval time.Duration, failures int, rnd float64) time.Duration {
+	maxBackoff := time.Duration(wr.MaxBackoff)
+	if maxBackoff == 0 {
+		maxBackoff = 8 * interval
+	}
+	wait := interval
+	for i := 0; i < failures && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff && maxBackoff > interval {
+		wait = maxBackoff
+	}
+	jitter := wr.Jitter
+	if jitter == 0 {
+		jitter = defaultRefreshJitter
+	}
+	return wait + time.Duration(float64(wait)*jitter*(2*rnd-1))
+}
+
+// watchingLoader is a loader which notices changes of its source itself.
+type watchingLoader interface {
+	watch(log *zap.Logger, stop <-chan struct{}, changed func()) error
 }
 
 type whitelister struct {
-	loader     []whitelistLoader
-	whitelists []*Whitelist
+	slots    []*whitelistSlot
+	requests []requestWhitelist
+	done     chan struct{}
+}
+
+func newWhitelister() *whitelister {
+	return &whitelister{done: make(chan struct{})}
 }
 
 func (wl *whitelister) isAllowed(log *zap.Logger, clientip string) bool {
-	for _, w := range wl.whitelists {
-		if w.IsAllowed(log, clientip) {
+	for _, s := range wl.slots {
+		if w := s.list.Load(); w != nil && w.IsAllowed(log, clientip) {
 			return true
 		}
 	}
 	return false
 }
 
-func fromWhitelistSpecs(log *zap.Logger, bks Plugins) (*whitelister, error) {
-	res := whitelister{}
+func (wl *whitelister) allowRequest(log *zap.Logger, r *http.Request) (string, bool) {
+	for _, rw := range wl.requests {
+		if id, ok := rw.AllowRequest(log, r); ok {
+			return id, true
+		}
+	}
+	return "", false
+}
+
+func (wl *whitelister) add(log *zap.Logger, name string, ldr whitelistLoader) error {
+	slot := &whitelistSlot{name: name, loader: ldr}
+	_ = slot.refresh(log)
+	wl.slots = append(wl.slots, slot)
+	if w, ok := ldr.(watchingLoader); ok {
+		return w.watch(log, wl.done, func() { _ = slot.refresh(log) })
+	}
+	return nil
+}
+
+// startRefresh fetches every loader again in its interval until the
+// whitelister is stopped.
+func (wl *whitelister) startRefresh(log *zap.Logger, cl clock.Clock, cfg WhitelistRefresh) {
+	for _, s := range wl.slots {
+		go wl.refreshLoop(log, cl, cfg, s)
+	}
+}
+
+func (wl *whitelister) refreshLoop(log *zap.Logger, cl clock.Clock, cfg WhitelistRefresh, slot *whitelistSlot) {
+	done := wl.done
+	failures := 0
+	for {
+		interval := cfg.interval(slot.loader)
+		if interval <= 0 {
+			return
+		}
+		wait := cfg.nextRefresh(interval, failures, rand.Float64())
+		select {
+		case <-done:
+			return
+		case <-cl.After(wait):
+		}
+		if err := slot.refresh(log); err != nil {
+			failures++
+			continue
+		}
+		failures = 0
+	}
+}
+
+// stop ends all background work of the loaders.
+func (wl *whitelister) stop() {
+	if wl.done != nil {
+		close(wl.done)
+		wl.done = nil
+	}
+}
+
+func fromWhitelistSpecs(log *zap.Logger, cl clock.Clock, bks Plugins) (*whitelister, error) {
+	res := newWhitelister()
+	if err := res.addSpecs(log, cl, bks); err != nil {
+		// the watchers of the lists before must not leak
+		res.stop()
+		return nil, err
+	}
+	return res, nil
+}
+
+// addSpecs adds the lists of the specs.
+func (wl *whitelister) addSpecs(log *zap.Logger, cl clock.Clock, bks Plugins) error {
 	for _, b := range bks {
 		switch b.Type {
 		case valueWhiteListListLoader:
 			var w staticWhiteList
 			if err := json.Unmarshal(b.Spec, &w); err != nil {
-				return nil, fmt.Errorf("cannot unmarshal static whitelister: %w", err)
+				return fmt.Errorf("cannot unmarshal static whitelister: %w", err)
+			}
+			_ = wl.add(log, b.Name, &w)
+		case valueWhiteListFileLoader:
+			var w fileWhitelist
+			if err := json.Unmarshal(b.Spec, &w); err != nil {
+				return fmt.Errorf("cannot unmarshal file whitelister: %w", err)
+			}
+			if err := wl.add(log, b.Name, &w); err != nil {
+				return fmt.Errorf("cannot watch whitelist file %q: %w", w.Path, err)
+			}
+		case valueWhiteListURLLoader:
+			var w urlWhitelist
+			if err := json.Unmarshal(b.Spec, &w); err != nil {
+				return fmt.Errorf("cannot unmarshal url whitelister: %w", err)
+			}
+			uw, err := newURLWhitelist(&w, caddy.NewReplacer())
+			if err != nil {
+				return err
+			}
+			_ = wl.add(log, b.Name, uw)
+		case valueWhiteListCommandLoader:
+			var w commandWhitelist
+			if err := json.Unmarshal(b.Spec, &w); err != nil {
+				return fmt.Errorf("cannot unmarshal command whitelister: %w", err)
+			}
+			cw, err := newCommandWhitelist(w, caddy.NewReplacer())
+			if err != nil {
+				return err
+			}
+			_ = wl.add(log, b.Name, cw)
+		case valueWhiteListDNSLoader:
+			var w dnsWhitelist
+			if err := json.Unmarshal(b.Spec, &w); err != nil {
+				return fmt.Errorf("cannot unmarshal dns whitelister: %w", err)
+			}
+			dw, err := newDNSWhitelist(&w, cl, nil)
+			if err != nil {
+				return err
+			}
+			_ = wl.add(log, b.Name, dw)
+		case valueWhiteListMTLS:
+			var cfg clientCertConfig
+			if err := json.Unmarshal(b.Spec, &cfg); err != nil {
+				return fmt.Errorf("cannot unmarshal mtls whitelister: %w", err)
 			}
-			res.loader = append(res.loader, &w)
-			ldr, err := w.Fetch(log)
+			cc, err := newClientCertWhitelist(cfg)
 			if err != nil {
-				log.Error("cannot fetch loader data", zap.String("backend", b.Name), zap.Error(err))
-			} else {
-				res.whitelists = append(res.whitelists, ldr)
+				return fmt.Errorf("cannot create mtls whitelister %q: %w", b.Name, err)
 			}
+			wl.requests = append(wl.requests, cc)
 		}
 	}
-	return &res, nil
+	return nil
 }
@@ -1,37 +1,24 @@
 package doorman
 
 import (
-	"net"
+	"fmt"
 	"reflect"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/benbjohnson/clock"
 	"go.uber.org/zap"
 )
 
-func createNetworks(nw ...string) Networks {
-	res := make(Networks, 0)
-	for _, n := range nw {
-		_, netw, _ := net.ParseCIDR(n)
-		res = append(res, netw)
+func prefixStrings(t *prefixTrie) []string {
+	res := make([]string, 0)
+	for _, p := range t.prefixes() {
+		res = append(res, p.String())
 	}
 	return res
 }
 
-func compareNetworks(t *testing.T, got, want Networks) {
-	if len(got) != len(want) {
-		t.Errorf("got: %v, want %v", got, want)
-		return
-	}
-	for i := range got {
-		nw1 := got[i]
-		nw2 := want[i]
-		if nw1.String() != nw2.String() {
-			t.Errorf("got: %v, want %v", got, want)
-			return
-		}
-	}
-}
-
 func Test_parseStaticList(t *testing.T) {
 	type args struct {
 		ips []string
@@ -39,8 +26,7 @@ func Test_parseStaticList(t *testing.T) {
 	tests := []struct {
 		name    string
 		args    args
-		want    IPMap
-		want1   Networks
+		want    []string
 		wantErr bool
 	}{
 		{
@@ -48,8 +34,7 @@ func Test_parseStaticList(t *testing.T) {
 			args: args{
 				ips: []string{"1.2.3.4"},
 			},
-			want:    IPMap{"1.2.3.4": true},
-			want1:   make(Networks, 0),
+			want:    []string{"1.2.3.4/32"},
 			wantErr: false,
 		},
 		{
@@ -58,7 +43,6 @@ func Test_parseStaticList(t *testing.T) {
 				ips: []string{"a.2.3.4"},
 			},
 			want:    nil,
-			want1:   nil,
 			wantErr: true,
 		},
 		{
@@ -66,8 +50,7 @@ func Test_parseStaticList(t *testing.T) {
 			args: args{
 				ips: []string{"1.2.3.4/8"},
 			},
-			want:    make(IPMap),
-			want1:   createNetworks("1.0.0.0/8"),
+			want:    []string{"1.0.0.0/8"},
 			wantErr: false,
 		},
 		{
@@ -75,8 +58,7 @@ func Test_parseStaticList(t *testing.T) {
 			args: args{
 				ips: []string{"1.2.3.4/8", "2.3.4.5"},
 			},
-			want:    IPMap{"2.3.4.5": true},
-			want1:   createNetworks("1.0.0.0/8"),
+			want:    []string{"1.0.0.0/8", "2.3.4.5/32"},
 			wantErr: false,
 		},
 		{
@@ -84,8 +66,23 @@ func Test_parseStaticList(t *testing.T) {
 			args: args{
 				ips: []string{"1.2.3.4/32"},
 			},
-			want:    IPMap{"1.2.3.4": true},
-			want1:   make(Networks, 0),
+			want:    []string{"1.2.3.4/32"},
+			wantErr: false,
+		},
+		{
+			name: "overlapping networks are merged",
+			args: args{
+				ips: []string{"10.1.2.3", "10.1.0.0/16", "10.0.0.0/8", "10.2.0.0/16"},
+			},
+			want:    []string{"10.0.0.0/8"},
+			wantErr: false,
+		},
+		{
+			name: "ipv6 and mapped ipv4",
+			args: args{
+				ips: []string{"2001:db8::/32", "2001:db8:1::1", "::ffff:192.0.2.1"},
+			},
+			want:    []string{"192.0.2.1/32", "2001:db8::/32"},
 			wantErr: false,
 		},
 		{
@@ -94,21 +91,22 @@ func Test_parseStaticList(t *testing.T) {
 				ips: []string{"1.2.3.4/8", "2.3.4.5", "1.2.3.4/33"},
 			},
 			want:    nil,
-			want1:   nil,
 			wantErr: true,
 		},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, got1, err := parseStaticList(tt.args.ips)
+			got, err := parseStaticList(tt.args.ips)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("parseStaticList() error = %v, wantErr %v", err, tt.wantErr)
 				return
 			}
-			if !reflect.DeepEqual(got, tt.want) {
-				t.Errorf("parseStaticList() map: got = %v, want %v", got, tt.want)
+			if tt.wantErr {
+				return
+			}
+			if got := prefixStrings(got); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseStaticList() got = %v, want %v", got, tt.want)
 			}
-			compareNetworks(t, got1, tt.want1)
 		})
 	}
 }
@@ -176,3 +174,73 @@ func Test_isAllowed(t *testing.T) {
 		})
 	}
 }
+
+func Test_WhitelistRefresh_nextRefresh(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      WhitelistRefresh
+		failures int
+		rnd      float64
+		want     time.Duration
+	}{
+		{name: "middle of the jitter", cfg: WhitelistRefresh{}, rnd: 0.5, want: time.Minute},
+		{name: "default jitter", cfg: WhitelistRefresh{}, rnd: 0, want: 54 * time.Second},
+		{name: "configured jitter", cfg: WhitelistRefresh{Jitter: 0.5}, rnd: 1, want: 90 * time.Second},
+		{name: "backoff", cfg: WhitelistRefresh{}, failures: 2, rnd: 0.5, want: 4 * time.Minute},
+		{name: "default max backoff", cfg: WhitelistRefresh{}, failures: 10, rnd: 0.5, want: 8 * time.Minute},
+		{name: "max backoff", cfg: WhitelistRefresh{MaxBackoff: Duration(3 * time.Minute)}, failures: 2, rnd: 0.5, want: 3 * time.Minute},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.nextRefresh(time.Minute, tt.failures, tt.rnd); got != tt.want {
+				t.Errorf("nextRefresh() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+type countingLoader struct {
+	fetches int32
+	fail    int32
+}
+
+func (cl *countingLoader) Fetch(log *zap.Logger) (*Whitelist, error) {
+	atomic.AddInt32(&cl.fetches, 1)
+	if atomic.LoadInt32(&cl.fail) != 0 {
+		return nil, fmt.Errorf("source not reachable")
+	}
+	sw := staticWhiteList{"1.2.3.4"}
+	return sw.Fetch(log)
+}
+
+func Test_whitelister_refresh(t *testing.T) {
+	mock := clock.NewMock()
+	ldr := &countingLoader{}
+	wl := newWhitelister()
+	defer wl.stop()
+	if err := wl.add(zap.NewNop(), "counting", ldr); err != nil {
+		t.Fatal(err)
+	}
+	wl.startRefresh(zap.NewNop(), mock, WhitelistRefresh{Interval: Duration(time.Minute), Jitter: 0.01})
+
+	waitForFetches := func(want int32) {
+		deadline := time.Now().Add(5 * time.Second)
+		for time.Now().Before(deadline) {
+			// the refresh goroutine must be waiting before the clock moves
+			time.Sleep(10 * time.Millisecond)
+			if atomic.LoadInt32(&ldr.fetches) >= want {
+				return
+			}
+			mock.Add(2 * time.Minute)
+		}
+		t.Fatalf("loader was not fetched %d times", want)
+	}
+	waitForFetches(2)
+
+	// a failing source keeps the last good list
+	atomic.StoreInt32(&ldr.fail, 1)
+	waitForFetches(atomic.LoadInt32(&ldr.fetches) + 1)
+	if !wl.isAllowed(zap.NewNop(), "1.2.3.4") {
+		t.Errorf("the last list must be kept after a failed refresh")
+	}
+}
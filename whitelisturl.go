@@ -0,0 +1,149 @@
+package doorman
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+var (
+	_ whitelistLoader  = (*urlWhitelist)(nil)
+	_ refreshingLoader = (*urlWhitelist)(nil)
+
+	valueWhiteListURLLoader = "url"
+)
+
+const (
+	defaultURLWhitelistMaxSize = 1 * megabyte
+	defaultURLWhitelistTimeout = Duration(30 * time.Second)
+)
+
+// urlWhitelist fetches a list of IPs and CIDRs over HTTP, for example the
+// published egress ranges of an office or a VPN provider. The answer can be
+// a text list, a JSON array or a JSON document where the entries are
+// selected with JSONPath.
+type urlWhitelist struct {
+	URL      string      `json:"url"`
+	Headers  http.Header `json:"headers,omitempty"`
+	JSONPath string      `json:"json_path,omitempty"`
+	MaxSize  int64       `json:"max_size,omitempty"`
+	Timeout  Duration    `json:"timeout,omitempty"`
+	Interval Duration    `json:"interval,omitempty"`
+	Insecure bool        `json:"insecure,omitempty"`
+
+	lock         sync.Mutex
+	client       *http.Client
+	etag         string
+	lastModified string
+	last         *Whitelist
+}
+
+func newURLWhitelist(cfg *urlWhitelist, rpl *caddy.Replacer) (*urlWhitelist, error) {
+	cfg.URL = rpl.ReplaceKnown(cfg.URL, "")
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("the url whitelister needs an url")
+	}
+	for k, vs := range cfg.Headers {
+		for i, v := range vs {
+			vs[i] = rpl.ReplaceKnown(v, "")
+		}
+		cfg.Headers[k] = vs
+	}
+	if cfg.MaxSize == 0 {
+		cfg.MaxSize = defaultURLWhitelistMaxSize
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultURLWhitelistTimeout
+	}
+	cfg.client = &http.Client{
+		Timeout: time.Duration(cfg.Timeout),
+		Transport: &http.Transport{
+			Proxy: http.ProxyFromEnvironment,
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: cfg.Insecure,
+			},
+		},
+	}
+	return cfg, nil
+}
+
+func (uw *urlWhitelist) refreshInterval() time.Duration {
+	return time.Duration(uw.Interval)
+}
+
+func (uw *urlWhitelist) parse(contentType string, data []byte) ([]string, error) {
+	if uw.JSONPath != "" {
+		var doc interface{}
+		if err := json.Unmarshal(data, &doc); err != nil {
+			return nil, fmt.Errorf("cannot parse json document: %w", err)
+		}
+		return jsonPathStrings(doc, uw.JSONPath), nil
+	}
+	if strings.Contains(contentType, "json") || bytes.HasPrefix(bytes.TrimSpace(data), []byte("[")) {
+		return parseWhitelistData(formatJSON, data)
+	}
+	return parseWhitelistData(formatText, data)
+}
+
+func (uw *urlWhitelist) Fetch(log *zap.Logger) (*Whitelist, error) {
+	uw.lock.Lock()
+	defer uw.lock.Unlock()
+
+	rq, err := http.NewRequest(http.MethodGet, uw.URL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create request: %w", err)
+	}
+	for k, v := range uw.Headers {
+		rq.Header[k] = v
+	}
+	if uw.last != nil {
+		if uw.etag != "" {
+			rq.Header.Set("If-None-Match", uw.etag)
+		}
+		if uw.lastModified != "" {
+			rq.Header.Set("If-Modified-Since", uw.lastModified)
+		}
+	}
+	rsp, err := uw.client.Do(rq)
+	if err != nil {
+		return nil, fmt.Errorf("cannot fetch whitelist: %w", err)
+	}
+	defer rsp.Body.Close()
+	if rsp.StatusCode == http.StatusNotModified && uw.last != nil {
+		log.Debug("whitelist not modified", zap.String("url", uw.URL))
+		return uw.last, nil
+	}
+	if rsp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("cannot fetch whitelist, status: %d", rsp.StatusCode)
+	}
+	data, err := io.ReadAll(io.LimitReader(rsp.Body, uw.MaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("cannot read whitelist: %w", err)
+	}
+	if int64(len(data)) > uw.MaxSize {
+		return nil, fmt.Errorf("whitelist is larger than %d bytes", uw.MaxSize)
+	}
+	entries, err := uw.parse(rsp.Header.Get("Content-Type"), data)
+	if err != nil {
+		return nil, err
+	}
+	sw := staticWhiteList(entries)
+	wl, err := sw.Fetch(log)
+	if err != nil {
+		return nil, err
+	}
+	uw.last = wl
+	uw.etag = rsp.Header.Get("ETag")
+	uw.lastModified = rsp.Header.Get("Last-Modified")
+	log.Info("fetched whitelist", zap.String("url", uw.URL), zap.Int("entries", len(entries)))
+	return wl, nil
+}
@@ -0,0 +1,94 @@
+package doorman
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+func Test_urlWhitelist_Fetch(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		body        string
+		jsonPath    string
+		allowed     string
+		wantErr     bool
+	}{
+		{name: "text", contentType: "text/plain", body: "# office\n1.2.3.4\n10.0.0.0/8\n", allowed: "10.1.1.1"},
+		{name: "json array", contentType: "application/json", body: `["1.2.3.4", "10.0.0.0/8"]`, allowed: "10.1.1.1"},
+		{
+			name:        "json path",
+			contentType: "application/json",
+			body:        `{"prefixes":[{"ip_prefix":"10.0.0.0/8"},{"ip_prefix":"1.2.3.4/32"}]}`,
+			jsonPath:    "$.prefixes.ip_prefix",
+			allowed:     "1.2.3.4",
+		},
+		{name: "too large", contentType: "text/plain", body: strings.Repeat("1.2.3.4\n", 200), wantErr: true},
+		{name: "illegal entry", contentType: "text/plain", body: "no ip\n", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			defer srv.Close()
+			uw, err := newURLWhitelist(&urlWhitelist{URL: srv.URL, JSONPath: tt.jsonPath, MaxSize: 1000}, caddy.NewReplacer())
+			if err != nil {
+				t.Fatal(err)
+			}
+			wl, err := uw.Fetch(zap.NewNop())
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Fetch() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !wl.IsAllowed(zap.NewNop(), tt.allowed) {
+				t.Errorf("Fetch() list does not allow %s", tt.allowed)
+			}
+		})
+	}
+}
+
+func Test_urlWhitelist_notModified(t *testing.T) {
+	var calls, conditional int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("X-Api-Key") != "secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		_, _ = w.Write([]byte("1.2.3.4\n"))
+	}))
+	defer srv.Close()
+
+	uw, err := newURLWhitelist(&urlWhitelist{
+		URL:     srv.URL,
+		Headers: http.Header{"X-Api-Key": []string{"secret"}},
+	}, caddy.NewReplacer())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		wl, err := uw.Fetch(zap.NewNop())
+		if err != nil {
+			t.Fatalf("Fetch() error = %v", err)
+		}
+		if !wl.IsAllowed(zap.NewNop(), "1.2.3.4") {
+			t.Errorf("Fetch() list does not allow 1.2.3.4")
+		}
+	}
+	if calls != 2 || conditional != 1 {
+		t.Errorf("got %d calls with %d conditional requests, want 2 and 1", calls, conditional)
+	}
+}